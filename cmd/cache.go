@@ -0,0 +1,144 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cacheVersion is part of every cache key. Increase it whenever the format of
+// the cache changes.
+const cacheVersion = 1
+
+// cache remembers the files that keep-sorted had nothing to say about, so that
+// later runs with the same configuration can skip them. The entries are empty
+// files in dir, named after a hash of the configuration, the file's name, and
+// its contents.
+//
+// A nil *cache is valid and never has any entries.
+type cache struct {
+	dir string
+	// A hash of everything besides the file that affects the result.
+	config []byte
+	// Whether the current file read another file, e.g. with order_from. That
+	// file could change without the current file changing, so the result
+	// can't be cached. The blocks of a file may read concurrently.
+	readOther atomic.Bool
+}
+
+// newCache returns the cache in c.cacheDir for the configuration in c, or nil
+// if there's no c.cacheDir.
+func newCache(c *Config) (*cache, error) {
+	if c.cacheDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(c.cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+	h := sha256.New()
+	// Different versions of keep-sorted may sort differently.
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" || s.Key == "vcs.modified" {
+				version += " " + s.Value
+			}
+		}
+	}
+	for _, s := range []string{
+		fmt.Sprint(cacheVersion),
+		version,
+		c.id,
+		strings.Join(c.idAliases, ","),
+		fmt.Sprint(c.rewriteAliases),
+		c.startDirective,
+		c.endDirective,
+		c.defaultOptions.String(),
+		c.finalNewline,
+		c.lineEndings,
+		c.markdownFences,
+		strings.Join(c.fixOnly, ","),
+		string(c.configData),
+	} {
+		// The lengths keep the fields from running into each other.
+		fmt.Fprintf(h, "%d:%s\n", len(s), s)
+	}
+	return &cache{dir: c.cacheDir, config: h.Sum(nil)}, nil
+}
+
+// cacheable reports whether the result for the file fn could be cached.
+func cacheable(fn string) bool {
+	return fn != stdin
+}
+
+// readFile is called whenever the current file reads the file name, whichever
+// option made it do so.
+func (ca *cache) readFile(name string) {
+	if ca == nil {
+		return
+	}
+	log.Debug().Str("file", name).Msg("Not caching the result, since it depends on another file")
+	ca.readOther.Store(true)
+}
+
+func (ca *cache) path(fn, contents string) string {
+	h := sha256.New()
+	h.Write(ca.config)
+	fmt.Fprintf(h, "%d:%s\n", len(fn), fn)
+	h.Write([]byte(contents))
+	key := hex.EncodeToString(h.Sum(nil))
+	return filepath.Join(ca.dir, key[:2], key)
+}
+
+// isClean reports whether an earlier run found nothing to do in the file fn
+// with contents. It's called before every file, which starts over as not
+// having read any other file.
+func (ca *cache) isClean(fn, contents string) bool {
+	if ca == nil || !cacheable(fn) {
+		return false
+	}
+	ca.readOther.Store(false)
+	_, err := os.Stat(ca.path(fn, contents))
+	return err == nil
+}
+
+// markClean records that there's nothing to do in the file fn with contents.
+// The cache is only an optimization, so problems writing to it are logged
+// rather than returned.
+func (ca *cache) markClean(fn, contents string) {
+	if ca == nil || !cacheable(fn) || ca.readOther.Load() {
+		return
+	}
+	p := ca.path(fn, contents)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		log.Warn().Err(err).Msg("Could not write to cache")
+		return
+	}
+	if err := os.WriteFile(p, nil, 0644); err != nil && !errors.Is(err, fs.ErrExist) {
+		log.Warn().Err(err).Msg("Could not write to cache")
+	}
+}
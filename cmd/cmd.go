@@ -15,12 +15,15 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"maps"
 	"os"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -28,13 +31,53 @@ import (
 	"github.com/google/keep-sorted/keepsorted"
 	"github.com/rs/zerolog/log"
 	flag "github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	id             string
+	idAliases      []string
+	rewriteAliases bool
+	startDirective string
+	endDirective   string
 	defaultOptions keepsorted.BlockOptions
+	configFile     string
 	operation      operation
 	modifiedLines  []keepsorted.LineRange
+	explain        bool
+	noFixes        bool
+	cacheDir       string
+	mmap           bool
+	finalNewline   string
+	lineEndings    string
+	markdownFences string
+	strictOptions  bool
+	fixOnly        []string
+	keepGoing      bool
+	// Whether fix mode also fixes generated files.
+	includeGenerated bool
+
+	// The contents of configFile, once it's loaded.
+	configData []byte
+	// The cache in cacheDir, if any.
+	cache *cache
+
+	// Where files are read from and written to. See SetFS and SetStdio.
+	fsys   FS
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// configFile is the format of the file passed to --config.
+type configFile struct {
+	// Presets maps preset names to the options that blocks get with
+	// preset=name.
+	Presets map[string]string `yaml:"presets"`
+	// Defaults maps file patterns, like "*.py", to the default options for the
+	// blocks in files that match them.
+	Defaults map[string]string `yaml:"defaults"`
+	// StrictOptions is like --strict-options.
+	StrictOptions bool `yaml:"strict_options"`
 }
 
 func (c *Config) FromFlags(fs *flag.FlagSet) {
@@ -46,16 +89,44 @@ func (c *Config) FromFlags(fs *flag.FlagSet) {
 	if err := fs.MarkHidden("id"); err != nil {
 		panic(err)
 	}
+	fs.StringSliceVar(&c.idAliases, "id-aliases", nil, "Other identifiers that are recognized like --id, e.g. ones that were used before a migration. Can be a comma-separated list, or specified multiple times.")
+	fs.BoolVar(&c.rewriteAliases, "rewrite-id-aliases", false, "Whether to replace the identifiers from --id-aliases with --id when fixing files.")
+	fs.StringVar(&c.startDirective, "start-directive", "", "Use this instead of \"<id> start\" to start blocks, e.g. to take over files annotated for another tool. Requires --end-directive.")
+	fs.StringVar(&c.endDirective, "end-directive", "", "Use this instead of \"<id> end\" to end blocks. Requires --start-directive.")
 
 	c.defaultOptions = keepsorted.DefaultBlockOptions()
 	fs.Var(&blockOptionsFlag{&c.defaultOptions}, "default-options", "The options keep-sorted will use to sort. Per-block overrides apply on top of these options. Note: list options like prefix_order are not merged with per-block overrides. They are completely overridden.")
 
+	fs.StringVar(&c.configFile, "config", "", "A YAML file with additional configuration, e.g. named presets for blocks to use with preset=name.")
+
 	of := &operationFlag{op: &c.operation}
 	if err := of.Set("fix"); err != nil {
 		panic(err)
 	}
 	fs.Var(of, "mode", fmt.Sprintf("Determines what mode to run this tool in. One of %q", knownModes()))
 
+	fs.StringVar(&c.cacheDir, "cache-dir", "", "A directory to remember the files that don't need any changes in, so that later runs with the same configuration can skip them. Created if it doesn't exist.")
+
+	fs.BoolVar(&c.mmap, "mmap", false, "In lint mode, memory-map files instead of reading them, which takes less memory when linting a lot of files. The files must not change while keep-sorted runs.")
+
+	fs.BoolVar(&c.noFixes, "no-fixes", false, "In lint mode, leave the fixes out of the findings. That's quicker when only the presence of findings matters.")
+
+	fs.StringVar(&c.finalNewline, "final-newline", finalNewlinePreserve, fmt.Sprintf("What to do with the line break at the end of the files that are fixed. One of %q", finalNewlines))
+
+	fs.StringVar(&c.lineEndings, "line-endings", lineEndingsPreserve, fmt.Sprintf("What to do with the line endings of the files that are fixed if they aren't all the same. One of %q", lineEndings))
+
+	fs.BoolVar(&c.strictOptions, "strict-options", false, "Fail if the options of a block have any problem, like an unknown option or an invalid value, even when fixing files. Such problems are only warnings otherwise.")
+
+	fs.StringSliceVar(&c.fixOnly, "fix-only", nil, fmt.Sprintf("In fix mode, only apply these kinds of fixes, and report the other findings as warnings. Can be a comma-separated list, or specified multiple times. Any of %q", keepsorted.FixKinds))
+
+	fs.BoolVar(&c.keepGoing, "keep-going", false, "Keep going with the other files when a file can't be read or written, and fail at the end instead.")
+
+	fs.StringVar(&c.markdownFences, "markdown-fences", markdownFencesHonor, fmt.Sprintf("What to do with the directives in the fenced code blocks of Markdown files. One of %q", markdownFences))
+
+	fs.BoolVar(&c.includeGenerated, "include-generated", false, "In fix and diff mode, also fix the files that are marked as generated with a \"Code generated ... DO NOT EDIT.\" comment. They are skipped by default, since the next run of their generator would undo the changes.")
+
+	fs.BoolVar(&c.explain, "explain", false, "Instead of sorting files, explain why the two lines that are passed instead of files are ordered the way they are with --default-options.")
+
 	fs.Var(&lineRangeFlag{lineRanges: &c.modifiedLines}, "lines", "Line ranges of the form \"start:end\". Only processes keep-sorted blocks that overlap with the given line ranges. Can only be used when fixing a single file. This flag can either be a comma-separated list of line ranges, or it can be specified multiple times on the command line to specify multiple line ranges.")
 }
 
@@ -84,6 +155,7 @@ var (
 	operations = map[string]operation{
 		"lint": lint,
 		"fix":  fix,
+		"diff": diff,
 	}
 )
 
@@ -91,7 +163,9 @@ func knownModes() []string {
 	return slices.Sorted(maps.Keys(operations))
 }
 
-type operation func(fixer *keepsorted.Fixer, filenames []string, modifiedLines []keepsorted.LineRange) (ok bool, err error)
+// operation runs keep-sorted on filenames and adds what happened to each of
+// them to r.
+type operation func(ctx context.Context, c *Config, fixer *keepsorted.Fixer, filenames []string, r *Result) error
 
 type operationFlag struct {
 	op *operation
@@ -183,6 +257,9 @@ func (f *lineRangeFlag) parse(vals []string) ([]keepsorted.LineRange, error) {
 				return nil, fmt.Errorf("invalid line range %q: %w", val, err)
 			}
 		}
+		if start < 1 || end < 1 {
+			return nil, fmt.Errorf("invalid line range %q: line numbers start at 1", val)
+		}
 
 		lrs = append(lrs, keepsorted.LineRange{Start: start, End: end})
 	}
@@ -197,87 +274,476 @@ const (
 	stdin = "-"
 )
 
+// Run runs keep-sorted on files.
 func Run(c *Config, files []string) (ok bool, err error) {
+	return RunContext(context.Background(), c, files)
+}
+
+// RunContext is like Run, but it stops early and returns ctx.Err() once ctx is
+// done.
+func RunContext(ctx context.Context, c *Config, files []string) (ok bool, err error) {
+	r, err := Execute(ctx, c, files)
+	if err != nil {
+		return false, err
+	}
+	if err := r.Err(); err != nil {
+		return false, err
+	}
+	return r.OK(), nil
+}
+
+// Execute is like RunContext, but reports what happened to every file. The
+// error is a *ConfigError if c or files are invalid, ctx.Err() if ctx is done,
+// or an error writing to stdout. Problems with individual files are in the
+// Result instead.
+func Execute(ctx context.Context, c *Config, files []string) (*Result, error) {
 	if c.id == "" {
-		return false, errors.New("id cannot be empty")
+		return nil, configError("id cannot be empty")
+	}
+	if err := keepsorted.ValidateID(c.id); err != nil {
+		return nil, &ConfigError{err}
+	}
+
+	if !slices.Contains(finalNewlines, c.finalNewline) {
+		return nil, configError("unknown --final-newline %q. Valid values: %q", c.finalNewline, finalNewlines)
+	}
+
+	if !slices.Contains(lineEndings, c.lineEndings) {
+		return nil, configError("unknown --line-endings %q. Valid values: %q", c.lineEndings, lineEndings)
+	}
+
+	if !slices.Contains(markdownFences, c.markdownFences) {
+		return nil, configError("unknown --markdown-fences %q. Valid values: %q", c.markdownFences, markdownFences)
+	}
+
+	if c.explain && len(files) != 2 {
+		return nil, configError("--explain needs exactly two lines")
 	}
 
 	if len(files) == 0 {
-		return false, errors.New("must pass one or more filenames")
+		return nil, configError("must pass one or more filenames")
 	}
 
 	if len(c.modifiedLines) > 0 && len(files) > 1 {
-		return false, errors.New("cannot specify modifiedLines with more than one file")
+		return nil, configError("cannot specify modifiedLines with more than one file")
+	}
+
+	if c.configFile != "" {
+		if err := c.loadConfigFile(); err != nil {
+			return nil, &ConfigError{err}
+		}
+	}
+
+	if c.explain {
+		if _, err := fmt.Fprintln(c.stdoutWriter(), keepsorted.Explain(files[0], files[1], c.defaultOptions)); err != nil {
+			return nil, fmt.Errorf("could not write explanation to stdout: %w", err)
+		}
+		return &Result{}, nil
+	}
+
+	fixer := keepsorted.New(c.id, c.defaultOptions)
+	if len(c.idAliases) > 0 {
+		for _, alias := range c.idAliases {
+			if alias == "" || alias == c.id {
+				return nil, configError("invalid id alias %q", alias)
+			}
+			if err := keepsorted.ValidateID(alias); err != nil {
+				return nil, configError("invalid id alias: %w", err)
+			}
+		}
+		fixer = fixer.WithAliases(c.idAliases, c.rewriteAliases)
+	}
+	if c.startDirective != "" || c.endDirective != "" {
+		var err error
+		if fixer, err = fixer.WithDirectives(c.startDirective, c.endDirective); err != nil {
+			return nil, &ConfigError{err}
+		}
+	}
+
+	if c.markdownFences == markdownFencesIgnore {
+		fixer = fixer.WithMarkdownFences(true)
+	}
+	// order_from reads from the same file system as everything else, and keeps
+	// the file that it's for out of the cache.
+	fixer = fixer.WithReadFile(func(name string) ([]byte, error) {
+		c.cache.readFile(name)
+		return c.readFile(name)
+	})
+	if len(c.fixOnly) > 0 {
+		kinds := make([]keepsorted.FixKind, len(c.fixOnly))
+		for i, k := range c.fixOnly {
+			kinds[i] = keepsorted.FixKind(k)
+		}
+		var err error
+		if fixer, err = fixer.WithFixOnly(kinds); err != nil {
+			return nil, &ConfigError{err}
+		}
+	}
+
+	if len(c.modifiedLines) == 0 {
+		// With --lines, the result doesn't cover the entire file.
+		var err error
+		if c.cache, err = newCache(c); err != nil {
+			return nil, &ConfigError{err}
+		}
+	}
+
+	r := &Result{}
+	if err := c.operation(ctx, c, fixer, files, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *Config) loadConfigFile() error {
+	b, err := os.ReadFile(c.configFile)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	c.configData = b
+	var cf configFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cf); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("could not parse config file %s: %w", c.configFile, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(cf.Presets)) {
+		if err := c.defaultOptions.AddPreset(name, cf.Presets[name]); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", c.configFile, err)
+		}
+	}
+	for _, pattern := range slices.Sorted(maps.Keys(cf.Defaults)) {
+		if err := c.defaultOptions.AddFileDefaults(pattern, cf.Defaults[pattern]); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", c.configFile, err)
+		}
+	}
+	c.strictOptions = c.strictOptions || cf.StrictOptions
+	return nil
+}
+
+const (
+	// Leave the end of the file the way it was.
+	finalNewlinePreserve = "preserve"
+	// End every non-empty file with a line break.
+	finalNewlineEnsure = "ensure"
+	// Remove the line breaks at the end of every file.
+	finalNewlineStrip = "strip"
+)
+
+var finalNewlines = []string{finalNewlinePreserve, finalNewlineEnsure, finalNewlineStrip}
+
+// fixFile fixes the file fn with contents along with --line-endings and
+// --final-newline, which change more than the blocks of the file. Those only
+// apply to files that have blocks, since keep-sorted leaves every other file
+// alone.
+func (c *Config) fixFile(ctx context.Context, fixer *keepsorted.Fixer, fn, contents string) keepsorted.FileResult {
+	normalized := contents
+	if c.lineEndings == lineEndingsNormalize {
+		normalized = normalizeLineEndings(contents)
+	}
+	file := keepsorted.File{Name: fn, Contents: normalized, ModifiedLines: c.modifiedLines}
+	res := fixer.FixFile(ctx, file)
+	if res.Err != nil || normalized == contents && c.finalNewline == finalNewlinePreserve {
+		return res
+	}
+	if res.AlreadyCorrect && !fixer.HasBlocks(file) {
+		res.Fixed = contents
+		return res
+	}
+	res.AlreadyCorrect = res.AlreadyCorrect && normalized == contents
+	if fixed := c.withFinalNewline(res.Fixed); fixed != res.Fixed {
+		res.Fixed = fixed
+		res.AlreadyCorrect = res.AlreadyCorrect && fixed == contents
+	}
+	return res
+}
+
+// withFinalNewline applies --final-newline to the fixed contents s.
+func (c *Config) withFinalNewline(s string) string {
+	switch c.finalNewline {
+	case finalNewlineEnsure:
+		if s == "" || strings.HasSuffix(s, "\n") {
+			return s
+		}
+		if strings.Contains(s, "\r\n") {
+			return s + "\r\n"
+		}
+		return s + "\n"
+	case finalNewlineStrip:
+		for {
+			t, ok := strings.CutSuffix(s, "\n")
+			if !ok {
+				return s
+			}
+			s = strings.TrimSuffix(t, "\r")
+		}
 	}
+	return s
+}
+
+const (
+	// Leave every line ending the way it is.
+	lineEndingsPreserve = "preserve"
+	// Replace every line ending with the most common one in the file.
+	lineEndingsNormalize = "normalize"
+)
+
+var lineEndings = []string{lineEndingsPreserve, lineEndingsNormalize}
+
+const (
+	// Sort the blocks in fenced code blocks like any other block.
+	markdownFencesHonor = "honor"
+	// Leave the directives in fenced code blocks alone, e.g. because they're
+	// examples in documentation.
+	markdownFencesIgnore = "ignore"
+)
+
+var markdownFences = []string{markdownFencesHonor, markdownFencesIgnore}
 
-	return c.operation(keepsorted.New(c.id, c.defaultOptions), files, c.modifiedLines)
+// normalizeLineEndings replaces every line ending in s with the most common
+// one, CRLF or LF. CR line endings count as LF.
+func normalizeLineEndings(s string) string {
+	if !strings.Contains(s, "\r") {
+		return s
+	}
+	crlf := strings.Count(s, "\r\n")
+	lf := strings.Count(s, "\n") - crlf
+	cr := strings.Count(s, "\r") - crlf
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	if crlf > lf+cr {
+		s = strings.ReplaceAll(s, "\n", "\r\n")
+	}
+	return s
 }
 
-func fix(fixer *keepsorted.Fixer, filenames []string, modifiedLines []keepsorted.LineRange) (ok bool, err error) {
+// commentStart matches the start of a comment in any of the usual comment
+// syntaxes.
+const commentStart = `^(//|#|--|;|/?\*+|<!--)`
+
+var (
+	comment = regexp.MustCompile(commentStart)
+	// generatedComment matches the comment that marks a file as generated. See
+	// https://go.dev/s/generatedcode.
+	generatedComment = regexp.MustCompile(commentStart + `\s*Code generated .* DO NOT EDIT\.`)
+)
+
+// isGenerated reports whether contents is marked as generated: whether one of
+// the comments at the top of it, before anything else, is a generatedComment.
+func isGenerated(contents string) bool {
+	for contents != "" {
+		var l string
+		l, contents, _ = strings.Cut(contents, "\n")
+		l = strings.TrimSpace(l)
+		switch {
+		case l == "":
+		case generatedComment.MatchString(l):
+			return true
+		case !comment.MatchString(l):
+			return false
+		}
+	}
+	return false
+}
+
+func fix(ctx context.Context, c *Config, fixer *keepsorted.Fixer, filenames []string, r *Result) error {
 	for _, fn := range filenames {
-		contents, err := read(fn)
-		if err != nil {
-			return false, err
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		if want, alreadyFixed, warnings := fixer.Fix(fn, contents, modifiedLines); fn == stdin || !alreadyFixed {
-			if err := write(fn, want); err != nil {
-				return false, err
+		contents, err := c.read(fn)
+		if err != nil {
+			r.fail(fn, err)
+			if c.keepGoing {
+				continue
 			}
-			for _, warn := range warnings {
-				log := log.Warn()
-				if warn.Path != stdin {
-					log = log.Str("file", warn.Path)
+			return nil
+		}
+		if !c.includeGenerated && isGenerated(contents) {
+			log.Info().Str("file", fn).Msg("Skipping generated file")
+			if fn == stdin {
+				if err := c.write(fn, contents); err != nil {
+					r.fail(fn, err)
+					if c.keepGoing {
+						continue
+					}
+					return nil
 				}
-				if warn.Lines.Start == warn.Lines.End {
-					log = log.Int("line", warn.Lines.Start)
-				} else {
-					log = log.Int("start", warn.Lines.Start).Int("end", warn.Lines.End)
+			}
+			r.add(fn, StatusSkipped)
+			continue
+		}
+		if c.cache.isClean(fn, contents) {
+			r.add(fn, StatusUnchanged)
+			continue
+		}
+		res := c.fixFile(ctx, fixer, fn, contents)
+		if res.Err != nil {
+			return res.Err
+		}
+		if fn == stdin || !res.AlreadyCorrect {
+			if err := c.write(fn, res.Fixed); err != nil {
+				r.fail(fn, err)
+				if c.keepGoing {
+					continue
 				}
-				log.Msg(warn.Message)
+				return nil
+			}
+			if !res.AlreadyCorrect {
+				log.Info().
+					Str("file", fn).
+					Int("blocks_sorted", res.Stats.BlocksSorted).
+					Int("groups_moved", res.Stats.GroupsMoved).
+					Int("duplicates_removed", res.Stats.DuplicatesRemoved).
+					Msg("Fixed file")
+			}
+		}
+		// Some warnings, e.g. about mixed line endings, don't keep a file from
+		// being correct.
+		for _, warn := range res.Warnings {
+			log := log.Warn()
+			if warn.Path != stdin {
+				log = log.Str("file", warn.Path)
+			}
+			if warn.Lines.Start == warn.Lines.End {
+				log = log.Int("line", warn.Lines.Start)
+			} else {
+				log = log.Int("start", warn.Lines.Start).Int("end", warn.Lines.End)
 			}
+			log.Msg(warn.Message)
+		}
+		if c.strictOptions && slices.ContainsFunc(res.Warnings, isOptionWarning) {
+			// The file was still fixed, but the run fails.
+			r.add(fn, StatusFindings)
+		} else if res.AlreadyCorrect {
+			if len(res.Warnings) == 0 {
+				c.cache.markClean(fn, contents)
+			}
+			r.add(fn, StatusUnchanged)
+		} else {
+			r.add(fn, StatusFixed)
 		}
 	}
-	return true, nil
+	return nil
 }
 
-func lint(fixer *keepsorted.Fixer, filenames []string, modifiedLines []keepsorted.LineRange) (ok bool, err error) {
-	var fs []*keepsorted.Finding
+// isOptionWarning reports whether f is about a problem with the options of a
+// block, which --strict-options makes fatal.
+func isOptionWarning(f *keepsorted.Finding) bool {
+	return f.Warning != nil
+}
+
+// findingsSchemaVersion is the version of docs/findings.schema.json that the
+// output of lint follows. Increase it whenever that output changes in a way
+// that isn't backwards compatible.
+const findingsSchemaVersion = 1
+
+// lintFinding is a finding as it's written by lint.
+type lintFinding struct {
+	SchemaVersion int `json:"schema_version"`
+	*keepsorted.Finding
+}
+
+func lint(ctx context.Context, c *Config, fixer *keepsorted.Fixer, filenames []string, r *Result) error {
+	var fs []lintFinding
+	// The findings may point into the files, so they stay mapped until the
+	// findings are written.
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
 	for _, fn := range filenames {
-		contents, err := read(fn)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		contents, release, err := c.readMapped(fn)
 		if err != nil {
-			return false, err
+			r.fail(fn, err)
+			if c.keepGoing {
+				continue
+			}
+			return nil
+		}
+		if c.cache.isClean(fn, contents) {
+			release()
+			r.add(fn, StatusUnchanged)
+			continue
+		}
+		findings, err := fixer.FindingsFile(ctx, keepsorted.File{Name: fn, Contents: contents, ModifiedLines: c.modifiedLines, NoFixes: c.noFixes})
+		if err != nil {
+			release()
+			return err
+		}
+		if len(findings) > 0 {
+			releases = append(releases, release)
+			r.add(fn, StatusFindings)
+		} else {
+			c.cache.markClean(fn, contents)
+			release()
+			r.add(fn, StatusUnchanged)
+		}
+		for _, f := range findings {
+			fs = append(fs, lintFinding{findingsSchemaVersion, f})
 		}
-		fs = append(fs, fixer.Findings(fn, contents, modifiedLines)...)
 	}
 
 	if len(fs) == 0 {
-		return true, nil
+		return nil
 	}
 
-	out := json.NewEncoder(os.Stdout)
+	out := json.NewEncoder(c.stdoutWriter())
 	out.SetIndent("", "  ")
 	if err := out.Encode(fs); err != nil {
-		return false, fmt.Errorf("could not write findings to stdout: %w", err)
-	}
-
-	return false, nil
-}
-
-func read(fn string) (string, error) {
-	if fn == stdin {
-		b, err := io.ReadAll(os.Stdin)
-		return string(b), err
+		return fmt.Errorf("could not write findings to stdout: %w", err)
 	}
-
-	b, err := os.ReadFile(fn)
-	return string(b), err
+	return nil
 }
 
-func write(fn string, s string) error {
-	if fn == stdin {
-		_, err := os.Stdout.WriteString(s)
-		return err
+func diff(ctx context.Context, c *Config, fixer *keepsorted.Fixer, filenames []string, r *Result) error {
+	for _, fn := range filenames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		contents, err := c.read(fn)
+		if err != nil {
+			r.fail(fn, err)
+			if c.keepGoing {
+				continue
+			}
+			return nil
+		}
+		if !c.includeGenerated && isGenerated(contents) {
+			// Like fix, which wouldn't change them.
+			log.Info().Str("file", fn).Msg("Skipping generated file")
+			r.add(fn, StatusSkipped)
+			continue
+		}
+		if c.cache.isClean(fn, contents) {
+			r.add(fn, StatusUnchanged)
+			continue
+		}
+		var d string
+		if c.lineEndings == lineEndingsNormalize || c.finalNewline != finalNewlinePreserve {
+			// Fixing the file may change more than its blocks, so the diff is
+			// between the file and what fix would turn it into.
+			res := c.fixFile(ctx, fixer, fn, contents)
+			if res.Err != nil {
+				return res.Err
+			}
+			d = keepsorted.DiffContents(fn, contents, res.Fixed)
+		} else {
+			d = fixer.Diff(fn, contents, c.modifiedLines)
+		}
+		if d == "" {
+			r.add(fn, StatusUnchanged)
+			continue
+		}
+		if _, err := io.WriteString(c.stdoutWriter(), d); err != nil {
+			return fmt.Errorf("could not write diff to stdout: %w", err)
+		}
+		r.add(fn, StatusFindings)
 	}
-
-	return os.WriteFile(fn, []byte(s), 0644)
+	return nil
 }
@@ -0,0 +1,953 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/keep-sorted/keepsorted"
+	flag "github.com/spf13/pflag"
+)
+
+// mapFS is an FS in memory.
+type mapFS struct {
+	fstest.MapFS
+}
+
+func (m mapFS) WriteFile(name string, data []byte) error {
+	m.MapFS[name] = &fstest.MapFile{Data: data}
+	return nil
+}
+
+func newConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	c := &Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.FromFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Parse(%q) = %v", args, err)
+	}
+	return c
+}
+
+func TestRun(t *testing.T) {
+	fsys := mapFS{fstest.MapFS{
+		"unsorted.txt": {Data: []byte("# keep-sorted start\nb\na\n# keep-sorted end\n")},
+	}}
+	c := newConfig(t, "--mode=lint")
+	c.SetFS(fsys)
+	c.SetStdio(strings.NewReader(""), io.Discard)
+
+	ok, err := Run(c, []string{"unsorted.txt"})
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if ok {
+		t.Errorf("Run() = true, want false")
+	}
+}
+
+func TestRun_FS(t *testing.T) {
+	fsys := mapFS{fstest.MapFS{
+		"sorted.txt":   {Data: []byte("# keep-sorted start\na\nb\n# keep-sorted end\n")},
+		"unsorted.txt": {Data: []byte("# keep-sorted start\nb\na\n# keep-sorted end\n")},
+	}}
+	c := newConfig(t)
+	c.SetFS(fsys)
+	var stdout bytes.Buffer
+	c.SetStdio(strings.NewReader("# keep-sorted start\nd\nc\n# keep-sorted end\n"), &stdout)
+
+	r, err := Execute(context.Background(), c, []string{"sorted.txt", "unsorted.txt", "-"})
+	if err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	want := []FileResult{
+		{File: "sorted.txt", Status: StatusUnchanged},
+		{File: "unsorted.txt", Status: StatusFixed},
+		{File: "-", Status: StatusFixed},
+	}
+	if diff := cmp.Diff(want, r.Files); diff != "" {
+		t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+	}
+	if got, want := string(fsys.MapFS["unsorted.txt"].Data), "# keep-sorted start\na\nb\n# keep-sorted end\n"; got != want {
+		t.Errorf("unsorted.txt = %q, want %q", got, want)
+	}
+	if got, want := stdout.String(), "# keep-sorted start\nc\nd\n# keep-sorted end\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+}
+
+func TestRun_FinalNewline(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		flag string
+		in   string
+
+		want string
+	}{
+		{
+			name: "Preserve_Missing",
+			flag: "preserve",
+			in:   "# keep-sorted next 2 lines\nb\na",
+			want: "# keep-sorted next 2 lines\na\nb",
+		},
+		{
+			name: "Preserve_Present",
+			flag: "preserve",
+			in:   "# keep-sorted next 2 lines\nb\na\n",
+			want: "# keep-sorted next 2 lines\na\nb\n",
+		},
+		{
+			name: "Ensure",
+			flag: "ensure",
+			in:   "# keep-sorted start\na\nb\n# keep-sorted end",
+			want: "# keep-sorted start\na\nb\n# keep-sorted end\n",
+		},
+		{
+			name: "Ensure_CRLF",
+			flag: "ensure",
+			in:   "# keep-sorted start\r\na\r\nb\r\n# keep-sorted end",
+			want: "# keep-sorted start\r\na\r\nb\r\n# keep-sorted end\r\n",
+		},
+		{
+			name: "Strip",
+			flag: "strip",
+			in:   "# keep-sorted start\nb\na\n# keep-sorted end\n\n",
+			want: "# keep-sorted start\na\nb\n# keep-sorted end",
+		},
+		{
+			name: "Ensure_NoBlocks",
+			flag: "ensure",
+			in:   "b\na",
+			want: "b\na",
+		},
+		{
+			name: "Strip_NoBlocks",
+			flag: "strip",
+			in:   "b\na\n",
+			want: "b\na\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newConfig(t, "--final-newline", tc.flag)
+			var stdout bytes.Buffer
+			c.SetStdio(strings.NewReader(tc.in), &stdout)
+
+			if _, err := Execute(context.Background(), c, []string{"-"}); err != nil {
+				t.Fatalf("Execute() = %v", err)
+			}
+			if got := stdout.String(); got != tc.want {
+				t.Errorf("stdout = %q, want %q", got, tc.want)
+			}
+
+			// Fixing the output again doesn't change it.
+			c = newConfig(t, "--final-newline", tc.flag)
+			stdout.Reset()
+			c.SetStdio(strings.NewReader(tc.want), &stdout)
+			if _, err := Execute(context.Background(), c, []string{"-"}); err != nil {
+				t.Fatalf("Execute() = %v", err)
+			}
+			if got := stdout.String(); got != tc.want {
+				t.Errorf("stdout after fixing again = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRun_LineEndings(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		flag string
+		in   string
+
+		want string
+	}{
+		{
+			name: "Preserve",
+			flag: "preserve",
+			in:   "# keep-sorted start\r\nb\na\r\n# keep-sorted end\r\n",
+			want: "# keep-sorted start\r\na\r\nb\n# keep-sorted end\r\n",
+		},
+		{
+			name: "Normalize_CRLF",
+			flag: "normalize",
+			in:   "# keep-sorted start\r\nb\na\r\n# keep-sorted end\r\n",
+			want: "# keep-sorted start\r\na\r\nb\r\n# keep-sorted end\r\n",
+		},
+		{
+			name: "Normalize_CR",
+			flag: "normalize",
+			in:   "# keep-sorted start\rb\ra\r# keep-sorted end\r",
+			want: "# keep-sorted start\na\nb\n# keep-sorted end\n",
+		},
+		{
+			name: "Normalize_NoBlocks",
+			flag: "normalize",
+			in:   "b\r\na\n",
+			want: "b\r\na\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newConfig(t, "--line-endings", tc.flag)
+			var stdout bytes.Buffer
+			c.SetStdio(strings.NewReader(tc.in), &stdout)
+
+			if _, err := Execute(context.Background(), c, []string{"-"}); err != nil {
+				t.Fatalf("Execute() = %v", err)
+			}
+			if got := stdout.String(); got != tc.want {
+				t.Errorf("stdout = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRun_MixedLineEndings_Sorted(t *testing.T) {
+	fsys := mapFS{fstest.MapFS{
+		"file.txt": {Data: []byte("# keep-sorted start\r\na\nb\r\n# keep-sorted end\r\n")},
+	}}
+	c := newConfig(t)
+	c.SetFS(fsys)
+
+	r, err := Execute(context.Background(), c, []string{"file.txt"})
+	if err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	// Only warned about, so the file isn't rewritten.
+	if diff := cmp.Diff([]FileResult{{File: "file.txt", Status: StatusUnchanged}}, r.Files); diff != "" {
+		t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRun_DiffMatchesFix(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		args []string
+		in   string
+
+		want string
+	}{
+		{
+			name: "FinalNewline",
+			args: []string{"--final-newline=ensure"},
+			in:   "# keep-sorted start\na\nb\n# keep-sorted end",
+
+			want: "--- a/file.txt\n+++ b/file.txt\n@@ -1,4 +1,4 @@\n # keep-sorted start\n a\n b\n-# keep-sorted end\n\\ No newline at end of file\n+# keep-sorted end\n",
+		},
+		{
+			name: "LineEndings",
+			args: []string{"--line-endings=normalize"},
+			in:   "# keep-sorted start\r\nb\na\r\n# keep-sorted end\r\n",
+
+			want: "--- a/file.txt\n+++ b/file.txt\n@@ -1,4 +1,4 @@\n # keep-sorted start\r\n-b\n-a\r\n+a\r\n+b\r\n # keep-sorted end\r\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fsys := mapFS{fstest.MapFS{
+				"file.txt": {Data: []byte(tc.in)},
+			}}
+			c := newConfig(t, append(tc.args, "--mode=diff")...)
+			c.SetFS(fsys)
+			var stdout bytes.Buffer
+			c.SetStdio(strings.NewReader(""), &stdout)
+
+			r, err := Execute(context.Background(), c, []string{"file.txt"})
+			if err != nil {
+				t.Fatalf("Execute() = %v", err)
+			}
+			if diff := cmp.Diff([]FileResult{{File: "file.txt", Status: StatusFindings}}, r.Files); diff != "" {
+				t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.want, stdout.String()); diff != "" {
+				t.Errorf("stdout mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRun_UnknownFinalNewline(t *testing.T) {
+	c := newConfig(t, "--final-newline", "sometimes")
+	var ce *ConfigError
+	if _, err := Execute(context.Background(), c, []string{"-"}); !errors.As(err, &ce) {
+		t.Errorf("Execute() = %v, want a *ConfigError", err)
+	}
+}
+
+func TestRun_StrictOptions(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(config, []byte("strict_options: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+
+		args []string
+
+		want Status
+	}{
+		{
+			name: "Default",
+
+			want: StatusFixed,
+		},
+		{
+			name: "Flag",
+			args: []string{"--strict-options"},
+
+			want: StatusFindings,
+		},
+		{
+			name: "ConfigFile",
+			args: []string{"--config", config},
+
+			want: StatusFindings,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fsys := mapFS{fstest.MapFS{
+				"file.txt": {Data: []byte("# keep-sorted start case=maybe\nb\na\n# keep-sorted end\n")},
+			}}
+			c := newConfig(t, tc.args...)
+			c.SetFS(fsys)
+
+			r, err := Execute(context.Background(), c, []string{"file.txt"})
+			if err != nil {
+				t.Fatalf("Execute() = %v", err)
+			}
+			if diff := cmp.Diff([]FileResult{{File: "file.txt", Status: tc.want}}, r.Files); diff != "" {
+				t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+			}
+			// The file is fixed either way.
+			if got, want := string(fsys.MapFS["file.txt"].Data), "# keep-sorted start case=maybe\na\nb\n# keep-sorted end\n"; got != want {
+				t.Errorf("file.txt = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRun_FixOnly(t *testing.T) {
+	fsys := mapFS{fstest.MapFS{
+		"file.txt": {Data: []byte("# keep-sorted start\nb\na\n# keep-sorted end\n# keep-sorted start remove_duplicates=yes report_duplicates=yes\nc\nc\n# keep-sorted end\n")},
+	}}
+	c := newConfig(t, "--fix-only=duplicates")
+	c.SetFS(fsys)
+
+	if _, err := Execute(context.Background(), c, []string{"file.txt"}); err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	if got, want := string(fsys.MapFS["file.txt"].Data), "# keep-sorted start\nb\na\n# keep-sorted end\n# keep-sorted start remove_duplicates=yes report_duplicates=yes\nc\n# keep-sorted end\n"; got != want {
+		t.Errorf("file.txt = %q, want %q", got, want)
+	}
+}
+
+func TestRun_UnknownFixOnly(t *testing.T) {
+	c := newConfig(t, "--fix-only", "unordered,everything")
+	var ce *ConfigError
+	if _, err := Execute(context.Background(), c, []string{"-"}); !errors.As(err, &ce) {
+		t.Errorf("Execute() = %v, want a *ConfigError", err)
+	}
+}
+
+func TestRun_OrderFrom(t *testing.T) {
+	fsys := mapFS{fstest.MapFS{
+		"dir/file.txt":  {Data: []byte("# keep-sorted start order_from=order.txt\ndev\nprod\n# keep-sorted end\n")},
+		"dir/order.txt": {Data: []byte("prod\ndev\n")},
+	}}
+	c := newConfig(t)
+	c.SetFS(fsys)
+
+	if _, err := Execute(context.Background(), c, []string{"dir/file.txt"}); err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	if got, want := string(fsys.MapFS["dir/file.txt"].Data), "# keep-sorted start order_from=order.txt\nprod\ndev\n# keep-sorted end\n"; got != want {
+		t.Errorf("dir/file.txt = %q, want %q", got, want)
+	}
+}
+
+func TestRun_MarkdownFences(t *testing.T) {
+	const in = "```\n<!-- keep-sorted start -->\nb\na\n<!-- keep-sorted end -->\n```\n"
+	fsys := mapFS{fstest.MapFS{
+		"README.md": {Data: []byte(in)},
+	}}
+	c := newConfig(t, "--markdown-fences=ignore")
+	c.SetFS(fsys)
+
+	r, err := Execute(context.Background(), c, []string{"README.md"})
+	if err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	if diff := cmp.Diff([]FileResult{{File: "README.md", Status: StatusUnchanged}}, r.Files); diff != "" {
+		t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+	}
+	if got := string(fsys.MapFS["README.md"].Data); got != in {
+		t.Errorf("README.md = %q, want %q", got, in)
+	}
+}
+
+func TestRun_UnknownMarkdownFences(t *testing.T) {
+	c := newConfig(t, "--markdown-fences", "sometimes")
+	var ce *ConfigError
+	if _, err := Execute(context.Background(), c, []string{"-"}); !errors.As(err, &ce) {
+		t.Errorf("Execute() = %v, want a *ConfigError", err)
+	}
+}
+
+func TestExecute_Errors(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name string
+
+		ctx   context.Context
+		args  []string
+		files []string
+
+		wantConfigError bool
+		wantErr         error
+	}{
+		{
+			name: "EmptyID",
+
+			args:  []string{"--id="},
+			files: []string{"a.txt"},
+
+			wantConfigError: true,
+		},
+		{
+			name: "InvalidID",
+
+			args:  []string{"--id=keep sorted"},
+			files: []string{"a.txt"},
+
+			wantConfigError: true,
+		},
+		{
+			name: "UnknownLineEndings",
+
+			args:  []string{"--line-endings=unix"},
+			files: []string{"a.txt"},
+
+			wantConfigError: true,
+		},
+		{
+			name: "NoFiles",
+
+			wantConfigError: true,
+		},
+		{
+			name: "LinesWithMultipleFiles",
+
+			args:  []string{"--lines=1:2"},
+			files: []string{"a.txt", "b.txt"},
+
+			wantConfigError: true,
+		},
+		{
+			name: "InvalidAlias",
+
+			args:  []string{"--id-aliases=keep-sorted"},
+			files: []string{"a.txt"},
+
+			wantConfigError: true,
+		},
+		{
+			name: "DirectivesWithoutEnd",
+
+			args:  []string{"--start-directive=BEGIN"},
+			files: []string{"a.txt"},
+
+			wantConfigError: true,
+		},
+		{
+			name: "ExplainWithOneLine",
+
+			args:  []string{"--explain"},
+			files: []string{"a"},
+
+			wantConfigError: true,
+		},
+		{
+			name: "MissingConfigFile",
+
+			args:  []string{"--config=" + filepath.Join(t.TempDir(), "missing.yaml")},
+			files: []string{"a.txt"},
+
+			wantConfigError: true,
+		},
+		{
+			name: "Canceled_Fix",
+
+			ctx:   canceled,
+			args:  []string{"--mode=fix"},
+			files: []string{"a.txt", "b.txt"},
+
+			wantErr: context.Canceled,
+		},
+		{
+			name: "Canceled_Lint",
+
+			ctx:   canceled,
+			args:  []string{"--mode=lint"},
+			files: []string{"a.txt", "b.txt"},
+
+			wantErr: context.Canceled,
+		},
+		{
+			name: "Canceled_Diff",
+
+			ctx:   canceled,
+			args:  []string{"--mode=diff"},
+			files: []string{"a.txt", "b.txt"},
+
+			wantErr: context.Canceled,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := tc.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			c := newConfig(t, tc.args...)
+			c.SetFS(mapFS{fstest.MapFS{
+				"a.txt": {Data: []byte("a\n")},
+				"b.txt": {Data: []byte("b\n")},
+			}})
+			c.SetStdio(strings.NewReader(""), io.Discard)
+
+			r, err := Execute(ctx, c, tc.files)
+			if err == nil {
+				t.Fatalf("Execute() = %+v, nil, want an error", r)
+			}
+			var ce *ConfigError
+			if got := errors.As(err, &ce); got != tc.wantConfigError {
+				t.Errorf("Execute() = %v, is ConfigError: %t, want %t", err, got, tc.wantConfigError)
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("Execute() = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestResult(t *testing.T) {
+	errRead := errors.New("could not read")
+	errWrite := errors.New("could not write")
+	for _, tc := range []struct {
+		name string
+
+		files []FileResult
+
+		wantOK   bool
+		wantErrs []error
+	}{
+		{
+			name: "Empty",
+
+			wantOK: true,
+		},
+		{
+			name: "UnchangedAndFixed",
+
+			files: []FileResult{
+				{File: "a.txt", Status: StatusUnchanged},
+				{File: "b.txt", Status: StatusFixed},
+				{File: "c.txt", Status: StatusSkipped},
+			},
+
+			wantOK: true,
+		},
+		{
+			name: "Findings",
+
+			files: []FileResult{
+				{File: "a.txt", Status: StatusUnchanged},
+				{File: "b.txt", Status: StatusFindings},
+			},
+
+			wantOK: false,
+		},
+		{
+			name: "Failed",
+
+			files: []FileResult{
+				{File: "a.txt", Status: StatusFailed, Err: errRead},
+				{File: "b.txt", Status: StatusFixed},
+				{File: "c.txt", Status: StatusFailed, Err: errWrite},
+			},
+
+			wantOK:   false,
+			wantErrs: []error{errRead, errWrite},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Result{Files: tc.files}
+			if got := r.OK(); got != tc.wantOK {
+				t.Errorf("OK() = %t, want %t", got, tc.wantOK)
+			}
+			err := r.Err()
+			if len(tc.wantErrs) == 0 && err != nil {
+				t.Errorf("Err() = %v, want nil", err)
+			}
+			for _, want := range tc.wantErrs {
+				if !errors.Is(err, want) {
+					t.Errorf("Err() = %v, want it to include %v", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRun_MissingFile(t *testing.T) {
+	c := newConfig(t, "--mode=lint")
+	c.SetFS(mapFS{fstest.MapFS{}})
+
+	r, err := Execute(context.Background(), c, []string{"missing.txt"})
+	if err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	if len(r.Files) != 1 || r.Files[0].Status != StatusFailed {
+		t.Errorf("Execute() = %+v, want missing.txt to fail", r.Files)
+	}
+	if r.OK() {
+		t.Errorf("OK() = true, want false")
+	}
+}
+
+func TestRun_KeepGoing(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		args []string
+
+		want []FileResult
+	}{
+		{
+			name: "Default",
+
+			want: []FileResult{{File: "missing.txt", Status: StatusFailed}},
+		},
+		{
+			name: "Fix",
+			args: []string{"--keep-going"},
+
+			want: []FileResult{
+				{File: "missing.txt", Status: StatusFailed},
+				{File: "unsorted.txt", Status: StatusFixed},
+				{File: "other-missing.txt", Status: StatusFailed},
+			},
+		},
+		{
+			name: "Lint",
+			args: []string{"--keep-going", "--mode=lint"},
+
+			want: []FileResult{
+				{File: "missing.txt", Status: StatusFailed},
+				{File: "unsorted.txt", Status: StatusFindings},
+				{File: "other-missing.txt", Status: StatusFailed},
+			},
+		},
+		{
+			name: "Diff",
+			args: []string{"--keep-going", "--mode=diff"},
+
+			want: []FileResult{
+				{File: "missing.txt", Status: StatusFailed},
+				{File: "unsorted.txt", Status: StatusFindings},
+				{File: "other-missing.txt", Status: StatusFailed},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newConfig(t, tc.args...)
+			c.SetFS(mapFS{fstest.MapFS{
+				"unsorted.txt": {Data: []byte("# keep-sorted start\nb\na\n# keep-sorted end\n")},
+			}})
+			c.SetStdio(strings.NewReader(""), io.Discard)
+
+			files := []string{"missing.txt", "unsorted.txt", "other-missing.txt"}
+			r, err := Execute(context.Background(), c, files)
+			if err != nil {
+				t.Fatalf("Execute() = %v", err)
+			}
+			if diff := cmp.Diff(tc.want, r.Files, cmpopts.IgnoreFields(FileResult{}, "Err")); diff != "" {
+				t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+			}
+			if r.OK() {
+				t.Errorf("OK() = true, want false")
+			}
+			// Every failure is reported at the end.
+			err = r.Err()
+			for _, f := range r.Files {
+				if f.Status == StatusFailed && (err == nil || !strings.Contains(err.Error(), f.File)) {
+					t.Errorf("Err() = %v, want it to mention %s", err, f.File)
+				}
+			}
+		})
+	}
+}
+
+func TestRun_LintNoFixes(t *testing.T) {
+	c := newConfig(t, "--mode=lint", "--no-fixes")
+	c.SetFS(mapFS{fstest.MapFS{
+		"unsorted.txt": {Data: []byte("# keep-sorted start\nb\na\n# keep-sorted end\n")},
+	}})
+	var stdout bytes.Buffer
+	c.SetStdio(strings.NewReader(""), &stdout)
+
+	r, err := Execute(context.Background(), c, []string{"unsorted.txt"})
+	if err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	if diff := cmp.Diff([]FileResult{{File: "unsorted.txt", Status: StatusFindings}}, r.Files); diff != "" {
+		t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+	}
+	if got := stdout.String(); !strings.Contains(got, `"fixes": null`) {
+		t.Errorf("stdout = %s, want findings without fixes", got)
+	}
+}
+
+func TestRun_CacheDir(t *testing.T) {
+	dir := t.TempDir()
+	fsys := mapFS{fstest.MapFS{
+		"sorted.txt": {Data: []byte("# keep-sorted start\na\nb\n# keep-sorted end\n")},
+	}}
+	run := func(args ...string) []FileResult {
+		t.Helper()
+		c := newConfig(t, append([]string{"--cache-dir", dir}, args...)...)
+		c.SetFS(fsys)
+		c.SetStdio(strings.NewReader(""), io.Discard)
+		r, err := Execute(context.Background(), c, []string{"sorted.txt"})
+		if err != nil {
+			t.Fatalf("Execute() = %v", err)
+		}
+		return r.Files
+	}
+
+	run()
+	// The file is now remembered as clean, for every mode.
+	entries, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("cache entries = %v, %v, want one", entries, err)
+	}
+	if diff := cmp.Diff([]FileResult{{File: "sorted.txt", Status: StatusUnchanged}}, run("--mode=lint")); diff != "" {
+		t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+	}
+
+	// Other options are cached separately.
+	run("--default-options=numeric=yes")
+	if entries, _ := filepath.Glob(filepath.Join(dir, "*", "*")); len(entries) != 2 {
+		t.Errorf("cache entries = %v, want two", entries)
+	}
+
+	// Files that need to be fixed aren't skipped.
+	fsys.MapFS["sorted.txt"] = &fstest.MapFile{Data: []byte("# keep-sorted start\nb\na\n# keep-sorted end\n")}
+	if diff := cmp.Diff([]FileResult{{File: "sorted.txt", Status: StatusFixed}}, run()); diff != "" {
+		t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRun_CacheDir_OrderFrom(t *testing.T) {
+	dir := t.TempDir()
+	fsys := mapFS{fstest.MapFS{
+		// Nothing in the file itself mentions order_from.
+		"list.txt":  {Data: []byte("# keep-sorted start\nb\na\n# keep-sorted end\n")},
+		"order.txt": {Data: []byte("b\na\n")},
+	}}
+	run := func() []FileResult {
+		t.Helper()
+		c := newConfig(t, "--cache-dir", dir, "--mode=lint", "--default-options=order_from=order.txt")
+		c.SetFS(fsys)
+		c.SetStdio(strings.NewReader(""), io.Discard)
+		r, err := Execute(context.Background(), c, []string{"list.txt"})
+		if err != nil {
+			t.Fatalf("Execute() = %v", err)
+		}
+		return r.Files
+	}
+
+	if diff := cmp.Diff([]FileResult{{File: "list.txt", Status: StatusUnchanged}}, run()); diff != "" {
+		t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(dir, "*", "*")); len(entries) != 0 {
+		t.Errorf("cache entries = %v, want none", entries)
+	}
+
+	// The file is out of order once the file that order_from reads changes.
+	fsys.MapFS["order.txt"] = &fstest.MapFile{Data: []byte("a\nb\n")}
+	if diff := cmp.Diff([]FileResult{{File: "list.txt", Status: StatusFindings}}, run()); diff != "" {
+		t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRun_LintMmap(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"empty.txt":    "",
+		"sorted.txt":   "# keep-sorted start\na\nb\n# keep-sorted end\n",
+		"unsorted.txt": "# keep-sorted start\nb\na\n# keep-sorted end\n",
+	}
+	var names []string
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.Join(dir, name))
+	}
+	slices.Sort(names)
+
+	lint := func(args ...string) string {
+		t.Helper()
+		c := newConfig(t, append([]string{"--mode=lint"}, args...)...)
+		var stdout bytes.Buffer
+		c.SetStdio(strings.NewReader(""), &stdout)
+		if _, err := Execute(context.Background(), c, names); err != nil {
+			t.Fatalf("Execute() = %v", err)
+		}
+		return stdout.String()
+	}
+	want := lint()
+	if !strings.Contains(want, "unsorted.txt") {
+		t.Fatalf("lint() = %s, want a finding for unsorted.txt", want)
+	}
+	if diff := cmp.Diff(want, lint("--mmap")); diff != "" {
+		t.Errorf("lint(--mmap) diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRun_Generated(t *testing.T) {
+	const generated = "// Code generated by protoc-gen-go. DO NOT EDIT.\n\n// keep-sorted start\nb\na\n// keep-sorted end\n"
+	for _, tc := range []struct {
+		name string
+
+		args []string
+
+		wantStatus Status
+		want       string
+	}{
+		{
+			name: "Skipped",
+
+			wantStatus: StatusSkipped,
+			want:       generated,
+		},
+		{
+			name: "IncludeGenerated",
+			args: []string{"--include-generated"},
+
+			wantStatus: StatusFixed,
+			want:       "// Code generated by protoc-gen-go. DO NOT EDIT.\n\n// keep-sorted start\na\nb\n// keep-sorted end\n",
+		},
+		{
+			name: "Lint",
+			args: []string{"--mode=lint"},
+
+			wantStatus: StatusFindings,
+			want:       generated,
+		},
+		{
+			name: "Diff",
+			args: []string{"--mode=diff"},
+
+			wantStatus: StatusSkipped,
+			want:       generated,
+		},
+		{
+			name: "Diff_IncludeGenerated",
+			args: []string{"--mode=diff", "--include-generated"},
+
+			wantStatus: StatusFindings,
+			want:       generated,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fsys := mapFS{fstest.MapFS{
+				"gen.go": {Data: []byte(generated)},
+			}}
+			c := newConfig(t, tc.args...)
+			c.SetFS(fsys)
+			c.SetStdio(strings.NewReader(""), io.Discard)
+
+			r, err := Execute(context.Background(), c, []string{"gen.go"})
+			if err != nil {
+				t.Fatalf("Execute() = %v", err)
+			}
+			if diff := cmp.Diff([]FileResult{{File: "gen.go", Status: tc.wantStatus}}, r.Files); diff != "" {
+				t.Errorf("Execute() mismatch (-want +got):\n%s", diff)
+			}
+			if got := string(fsys.MapFS["gen.go"].Data); got != tc.want {
+				t.Errorf("gen.go = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsGenerated(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{"// Code generated by protoc-gen-go. DO NOT EDIT.\npackage foo\n", true},
+		{"// Copyright 2024\n\n// Code generated by stringer; DO NOT EDIT.\n", true},
+		{"#!/bin/sh\n# Code generated by make. DO NOT EDIT.\n", true},
+		{"<!-- Code generated by docgen. DO NOT EDIT. -->\n", true},
+		{"package foo\n\n// Code generated by protoc-gen-go. DO NOT EDIT.\n", false},
+		{"// Code generated by hand. Feel free to edit.\n", false},
+		{"", false},
+	} {
+		if got := isGenerated(tc.in); got != tc.want {
+			t.Errorf("isGenerated(%q) = %t, want %t", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestLineRangeFlag(t *testing.T) {
+	for _, tc := range []struct {
+		in string
+
+		want    []keepsorted.LineRange
+		wantErr bool
+	}{
+		{in: "3", want: []keepsorted.LineRange{{Start: 3, End: 3}}},
+		{in: "1:5,8:9", want: []keepsorted.LineRange{{Start: 1, End: 5}, {Start: 8, End: 9}}},
+		{in: "0:0", wantErr: true},
+		{in: "-2:4", wantErr: true},
+		{in: "2:-4", wantErr: true},
+		{in: "a:b", wantErr: true},
+	} {
+		var got []keepsorted.LineRange
+		err := (&lineRangeFlag{lineRanges: &got}).Set(tc.in)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("Set(%q) = %v, want error: %t", tc.in, err, tc.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Set(%q) mismatch (-want +got):\n%s", tc.in, diff)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// FS is a file system that Run can read files from and write them back to.
+type FS interface {
+	fs.FS
+	// WriteFile replaces the contents of the file name with data.
+	WriteFile(name string, data []byte) error
+}
+
+// SetFS makes Run use fsys instead of the operating system's file system.
+// The names of the files that are passed to Run are passed to fsys as they
+// are, so they need to be valid for fsys.
+func (c *Config) SetFS(fsys FS) {
+	c.fsys = fsys
+}
+
+// SetStdio makes Run read the file "-" from stdin and write everything that
+// would go to standard output to stdout.
+func (c *Config) SetStdio(stdin io.Reader, stdout io.Writer) {
+	c.stdin, c.stdout = stdin, stdout
+}
+
+// osFS is the file system of the operating system. Unlike os.DirFS, it
+// accepts any path that os.Open does.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) WriteFile(name string, data []byte) error {
+	return os.WriteFile(name, data, 0644)
+}
+
+func (c *Config) fileSystem() FS {
+	if c.fsys == nil {
+		return osFS{}
+	}
+	return c.fsys
+}
+
+func (c *Config) stdinReader() io.Reader {
+	if c.stdin == nil {
+		return os.Stdin
+	}
+	return c.stdin
+}
+
+func (c *Config) stdoutWriter() io.Writer {
+	if c.stdout == nil {
+		return os.Stdout
+	}
+	return c.stdout
+}
+
+func (c *Config) read(fn string) (string, error) {
+	if fn == stdin {
+		b, err := io.ReadAll(c.stdinReader())
+		return string(b), err
+	}
+
+	b, err := fs.ReadFile(c.fileSystem(), fn)
+	return string(b), err
+}
+
+// readFile reads the file name from the file system, e.g. for order_from.
+func (c *Config) readFile(name string) ([]byte, error) {
+	return fs.ReadFile(c.fileSystem(), name)
+}
+
+// readMapped is like read, but memory-maps fn with --mmap. The contents may
+// only be used until release is called.
+func (c *Config) readMapped(fn string) (contents string, release func(), _ error) {
+	if !c.mmap || fn == stdin || c.fsys != nil {
+		contents, err := c.read(fn)
+		return contents, func() {}, err
+	}
+	return mmapFile(fn)
+}
+
+func (c *Config) write(fn string, s string) error {
+	if fn == stdin {
+		_, err := io.WriteString(c.stdoutWriter(), s)
+		return err
+	}
+
+	return c.fileSystem().WriteFile(fn, []byte(s))
+}
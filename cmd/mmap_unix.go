@@ -0,0 +1,48 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmapFile maps the file name into memory. The contents may only be used until
+// release is called, and they change if the file does.
+func mmapFile(name string) (contents string, release func(), _ error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	size := st.Size()
+	if size == 0 || int64(int(size)) != size || !st.Mode().IsRegular() {
+		// There's nothing to map, or mapping the file doesn't work.
+		b, err := os.ReadFile(name)
+		return string(b), func() {}, err
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return "", nil, err
+	}
+	return unsafe.String(&b[0], len(b)), func() { syscall.Munmap(b) }, nil
+}
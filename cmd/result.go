@@ -0,0 +1,99 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Status is what happened to a file.
+type Status string
+
+const (
+	// StatusUnchanged means that the file was already sorted.
+	StatusUnchanged Status = "unchanged"
+	// StatusFixed means that keep-sorted fixed the file.
+	StatusFixed Status = "fixed"
+	// StatusFindings means that the file needs to be fixed, but keep-sorted only
+	// reported it, e.g. with --mode=lint.
+	StatusFindings Status = "findings"
+	// StatusSkipped means that keep-sorted left the file alone without looking
+	// at its blocks, e.g. because it's generated.
+	StatusSkipped Status = "skipped"
+	// StatusFailed means that the file couldn't be read or written.
+	StatusFailed Status = "failed"
+)
+
+// FileResult is what happened to a single file.
+type FileResult struct {
+	File   string
+	Status Status
+	// Why the file failed, if its Status is StatusFailed.
+	Err error
+}
+
+// Result is what Execute did with every file, in the order that they were
+// processed. Files that weren't processed, e.g. because an earlier file
+// failed without --keep-going, aren't included.
+type Result struct {
+	Files []FileResult
+}
+
+// OK returns whether every file is sorted now, i.e. whether keep-sorted
+// should exit successfully.
+func (r *Result) OK() bool {
+	for _, f := range r.Files {
+		if f.Status == StatusFindings || f.Status == StatusFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns the errors of every file that failed, or nil if none did.
+func (r *Result) Err() error {
+	var errs []error
+	for _, f := range r.Files {
+		errs = append(errs, f.Err)
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Result) add(file string, status Status) {
+	r.Files = append(r.Files, FileResult{File: file, Status: status})
+}
+
+func (r *Result) fail(file string, err error) {
+	r.Files = append(r.Files, FileResult{File: file, Status: StatusFailed, Err: err})
+}
+
+// ConfigError is the error that Execute returns if c or the arguments are
+// invalid, before any file was processed.
+type ConfigError struct {
+	err error
+}
+
+func configError(format string, a ...any) *ConfigError {
+	return &ConfigError{fmt.Errorf(format, a...)}
+}
+
+func (e *ConfigError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.err
+}
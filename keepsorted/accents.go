@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"strings"
+	"unicode"
+)
+
+// accentedLetters lists the Latin letters with diacritics for each base
+// letter. This covers the precomposed forms in Latin-1 Supplement, Latin
+// Extended-A and -B, and Latin Extended Additional, plus a few letters with
+// strokes that don't decompose.
+var accentedLetters = []struct {
+	base    rune
+	letters string
+}{
+	{'A', "ÀÁÂÃÄÅĀĂĄǍǞǠǺȀȂȦḀẠẢẤẦẨẪẬẮẰẲẴẶ"},
+	{'B', "ḂḄḆ"},
+	{'C', "ÇĆĈĊČḈ"},
+	{'D', "ĎĐḊḌḎḐḒ"},
+	{'E', "ÈÉÊËĒĔĖĘĚȄȆȨḔḖḘḚḜẸẺẼẾỀỂỄỆ"},
+	{'F', "Ḟ"},
+	{'G', "ĜĞĠĢǦǴḠ"},
+	{'H', "ĤĦȞḢḤḦḨḪ"},
+	{'I', "ÌÍÎÏĨĪĬĮİǏȈȊḬḮỈỊ"},
+	{'J', "Ĵ"},
+	{'K', "ĶǨḰḲḴ"},
+	{'L', "ĹĻĽŁḶḸḺḼ"},
+	{'M', "ḾṀṂ"},
+	{'N', "ÑŃŅŇǸṄṆṈṊ"},
+	{'O', "ÒÓÔÕÖØŌŎŐƠǑǪǬȌȎȪȬȮȰṌṎṐṒỌỎỐỒỔỖỘỚỜỞỠỢ"},
+	{'P', "ṔṖ"},
+	{'R', "ŔŖŘȐȒṘṚṜṞ"},
+	{'S', "ŚŜŞŠȘṠṢṤṦṨ"},
+	{'T', "ŢŤȚṪṬṮṰ"},
+	{'U', "ÙÚÛÜŨŪŬŮŰŲƯǓǕǗǙǛȔȖṲṴṶṸṺỤỦỨỪỬỮỰ"},
+	{'V', "ṼṾ"},
+	{'W', "ŴẀẂẄẆẈ"},
+	{'X', "ẊẌ"},
+	{'Y', "ÝŶŸȲẎỲỴỶỸ"},
+	{'Z', "ŹŻŽẐẒẔ"},
+	{'a', "àáâãäåāăąǎǟǡǻȁȃȧḁạảấầẩẫậắằẳẵặ"},
+	{'b', "ḃḅḇ"},
+	{'c', "çćĉċčḉ"},
+	{'d', "ďđḋḍḏḑḓ"},
+	{'e', "èéêëēĕėęěȅȇȩḕḗḙḛḝẹẻẽếềểễệ"},
+	{'f', "ḟ"},
+	{'g', "ĝğġģǧǵḡ"},
+	{'h', "ĥħȟḣḥḧḩḫẖ"},
+	{'i', "ìíîïĩīĭįıǐȉȋḭḯỉị"},
+	{'j', "ĵǰ"},
+	{'k', "ķǩḱḳḵ"},
+	{'l', "ĺļľłḷḹḻḽ"},
+	{'m', "ḿṁṃ"},
+	{'n', "ñńņňǹṅṇṉṋ"},
+	{'o', "òóôõöøōŏőơǒǫǭȍȏȫȭȯȱṍṏṑṓọỏốồổỗộớờởỡợ"},
+	{'p', "ṕṗ"},
+	{'r', "ŕŗřȑȓṙṛṝṟ"},
+	{'s', "śŝşšșṡṣṥṧṩ"},
+	{'t', "ţťțṫṭṯṱẗ"},
+	{'u', "ùúûüũūŭůűųưǔǖǘǚǜȕȗṳṵṷṹṻụủứừửữự"},
+	{'v', "ṽṿ"},
+	{'w', "ŵẁẃẅẇẉẘ"},
+	{'x', "ẋẍ"},
+	{'y', "ýÿŷȳẏẙỳỵỷỹ"},
+	{'z', "źżžẑẓẕ"},
+}
+
+var accentFolds = func() map[rune]rune {
+	m := make(map[rune]rune)
+	for _, l := range accentedLetters {
+		for _, r := range l.letters {
+			m[r] = l.base
+		}
+	}
+	return m
+}()
+
+// foldAccents replaces accented Latin letters with their base letter, and
+// drops combining marks, e.g. both "é" and "e\u0301" become "e".
+func foldAccents(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		if b, ok := accentFolds[r]; ok {
+			return b
+		}
+		return r
+	}, s)
+}
@@ -16,8 +16,15 @@ package keepsorted
 
 import (
 	"cmp"
+	"fmt"
+	"hash/maphash"
+	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog/log"
 )
@@ -41,7 +48,23 @@ type block struct {
 
 type blockMetadata struct {
 	startDirective, endDirective string
-	opts                         blockOptions
+	// The start and end directives of the other identifiers that the file is
+	// sorted for, e.g. aliases. Their blocks are moved around as a whole, like
+	// nested blocks.
+	otherStartDirectives, otherEndDirectives []string
+	// pinDirective marks a line group that keeps its position in the block.
+	pinDirective string
+	opts         blockOptions
+}
+
+// startsBlock reports whether l has a start directive of any identifier.
+func (m blockMetadata) startsBlock(l string) bool {
+	return strings.Contains(l, m.startDirective) || slices.ContainsFunc(m.otherStartDirectives, func(d string) bool { return strings.Contains(l, d) })
+}
+
+// endsBlock reports whether l has an end directive of any identifier.
+func (m blockMetadata) endsBlock(l string) bool {
+	return strings.Contains(l, m.endDirective) || slices.ContainsFunc(m.otherEndDirectives, func(d string) bool { return strings.Contains(l, d) })
 }
 
 type incompleteBlock struct {
@@ -68,6 +91,32 @@ const (
 // should be included in the result. Mostly useful for filtering keep-sorted
 // blocks to just the ones that were modified by the currently CL.
 func (f *Fixer) newBlocks(filename string, lines []string, offset int, include func(start, end int) bool) (_ []block, _ []incompleteBlock, warnings []*Finding) {
+	// Most lines don't have any directive, so only the ones that might are
+	// looked at more closely.
+	candidates := f.directiveLines(lines)
+	if f.ignoreMarkdownFences && len(candidates) > 0 && isMarkdownFile(filename) {
+		fenced := fencedLines(lines)
+		candidates = slices.DeleteFunc(candidates, func(i int) bool { return fenced[i] })
+	}
+	if slices.ContainsFunc(candidates, func(i int) bool { return containsWord(lines[i], f.disableFileDirective) }) {
+		return nil, nil, nil
+	}
+
+	if opts, ok := f.defaultOptions.forFile(filename); ok {
+		// The defaults for this kind of file apply before the pragma.
+		g := *f
+		g.defaultOptions = opts
+		f = &g
+	}
+	fileOpts, ok, warns := f.fileOptions(filename, lines, candidates, offset)
+	warnings = append(warnings, warns...)
+	if ok {
+		// Every block in this file starts from the options in the pragma.
+		g := *f
+		g.defaultOptions = fileOpts
+		f = &g
+	}
+
 	var blocks []block
 	var incompleteBlocks []incompleteBlock
 
@@ -80,83 +129,176 @@ func (f *Fixer) newBlocks(filename string, lines []string, offset int, include f
 	// nestedBlocks by nesting level. nestedBlocks[0] is the slice of blocks that
 	// are nested under the current top-level block.
 	var nestedBlocks [][]block
-	for i, l := range lines {
-		if strings.Contains(l, f.startDirective) {
-			starts = append(starts, startLine{i, l})
-		} else if strings.Contains(l, f.endDirective) {
-			if len(starts) == 0 {
-				incompleteBlocks = append(incompleteBlocks, incompleteBlock{i + offset, endDirective})
-				continue
+	type canonicalFinding struct {
+		*Finding
+		// Whether the fix may be applied automatically.
+		fixable bool
+	}
+	// Start directives whose options aren't in canonical form.
+	var canonical []canonicalFinding
+	// addBlock records the block that starts at start and ends at endIndex,
+	// which is the index of its end directive (or one past its last line).
+	// end is the line with the end directive, if the block has one.
+	addBlock := func(start startLine, endIndex int, directive, end string) {
+		endDirectiveIndex := endIndex
+		// Keep any blank lines leading up to the end tag by simply excluding
+		// them from being sorted (any at the beginning should already be sorted
+		// at the top).
+		// The original justification for this was better handling of markdown
+		// lists (cr/423863898), but the markdown formatter doesn't seem to care
+		// about the newlines anymore.
+		// It's nice to keep this around so that users can add a little extra
+		// formatting to their keep-sorted blocks.
+		for endIndex > start.index && strings.TrimSpace(lines[endIndex-1]) == "" {
+			endIndex--
+		}
+
+		if !include(start.index+offset, endIndex+offset) {
+			return
+		}
+
+		directiveIndex := start.index
+		commentMarker, options, last := f.directiveOptions(lines, start.index, endIndex, directive)
+		start.index = last
+		opts, optionWarnings := parseBlockOptions(commentMarker, options, f.defaultOptions)
+		if opts.OrderFrom != "" {
+			var err error
+			if opts.manifest, err = f.readManifest(filename, opts.OrderFrom); err != nil {
+				optionWarnings = append(optionWarnings, err)
 			}
-			start := starts[len(starts)-1]
-			starts = starts[0 : len(starts)-1]
-			endIndex := i
-
-			// Keep any blank lines leading up to the end tag by simply excluding
-			// them from being sorted (any at the beginning should already be sorted
-			// at the top).
-			// The original justification for this was better handling of markdown
-			// lists (cr/423863898), but the markdown formatter doesn't seem to care
-			// about the newlines anymore.
-			// It's nice to keep this around so that users can add a little extra
-			// formatting to their keep-sorted blocks.
-			for endIndex > start.index && strings.TrimSpace(lines[endIndex-1]) == "" {
-				endIndex--
+		}
+		for _, warn := range optionWarnings {
+			warnings = append(warnings, optionFinding(filename, lines, directiveIndex, start.index, offset, warn))
+		}
+		// Top-level keep-sorted directives have depth 0. Nested keep-sorted
+		// directives will have depth >= 1 based on how deep it is.
+		depth := len(starts)
+		// ignore reports msg about the directive at index i, and leaves the block
+		// alone. The blocks nested in it belong to its parent instead.
+		ignore := func(i int, msg string) {
+			warnings = append(warnings, finding(filename, i+offset, i+offset, msg))
+			if len(nestedBlocks) == depth+1 {
+				inner := nestedBlocks[depth]
+				nestedBlocks = nestedBlocks[0:depth]
+				if depth == 0 {
+					blocks = append(blocks, inner...)
+				} else {
+					nestedBlocks[depth-1] = append(nestedBlocks[depth-1], inner...)
+				}
+			}
+		}
+		if !opts.AfterCode && codeBeforeComment(commentMarker, opts.commentMarker) {
+			ignore(directiveIndex, errorDirectiveAfterCode(f.ID))
+			return
+		}
+		if endPrefix, _, ok := strings.Cut(end, f.endDirective); ok && !opts.AfterCode && codeBeforeComment(endPrefix, opts.commentMarker) {
+			ignore(endDirectiveIndex, errorDirectiveAfterCode(f.ID))
+			return
+		}
+		if opts.Canonicalize && len(optionWarnings) == 0 && start.index == directiveIndex && directive == f.startDirective {
+			if l, ok := f.canonicalDirective(commentMarker, options); ok && l != start.line {
+				fix := replacement(start.index+offset, start.index+offset, l+"\n")
+				canonical = append(canonical, canonicalFinding{
+					finding(filename, start.index+offset, start.index+offset, errorNonCanonicalOptions, fix),
+					len(starts) == 0 && opts.Enforce != enforceLint,
+				})
 			}
+		}
+
+		metadata := blockMetadata{
+			startDirective:       f.startDirective,
+			endDirective:         f.endDirective,
+			otherStartDirectives: f.otherStartDirectives,
+			otherEndDirectives:   f.otherEndDirectives,
+			pinDirective:         f.pinDirective,
+			opts:                 opts,
+		}
+		first := start.index + 1
+		start.index += opts.SkipLines
+		if start.index > endIndex {
+			return
+		}
+		if opts.SkipLines > 0 && !wholeGroups(lines[first:endIndex], opts.SkipLines, metadata) {
+			ignore(directiveIndex, errorSkipLinesSplitsGroup(opts.SkipLines))
+			return
+		}
 
-			if !include(start.index+offset, endIndex+offset) {
+		block := block{
+			metadata: metadata,
+			start:    start.index + offset,
+			end:      endIndex + offset,
+			lines:    lines[start.index+1 : endIndex],
+		}
+		// For example, consider depth=0:
+		// If we just finished a top-level block and there are first-level nested
+		// blocks present, we need to remove those from nestedBlocks and include
+		// them on this block.
+		// It isn't possible for len(nestedBlocks) to be > depth+1:
+		// At depth n, n != 0, we increase the length of nestedBlocks to be n.
+		// At depth m=n-1, the length of nestedBlocks will initially be n=m+1 (the assertion from above)
+		// and then we trim that down to be length m when we add the nested blocks
+		// to the current block.
+		if len(nestedBlocks) == depth+1 {
+			block.nestedBlocks = nestedBlocks[depth]
+			nestedBlocks = nestedBlocks[0:depth]
+		}
+		if depth == 0 {
+			// Top-level blocks get returned.
+			// Nested blocks are returned via their top-level block.
+			blocks = append(blocks, block)
+		} else {
+			// Otherwise, the current block appears to be nested. Add it to nestedBlocks.
+			for len(nestedBlocks) < depth {
+				nestedBlocks = append(nestedBlocks, nil)
+			}
+			nestedBlocks[depth-1] = append(nestedBlocks[depth-1], block)
+		}
+		// Invariant: len(nestedBlocks) == depth
+	}
+	// Whether we're between an off and an on directive.
+	var off bool
+	for _, i := range candidates {
+		l := lines[i]
+		if off {
+			off = !containsWord(l, f.onDirective)
+			continue
+		}
+		if containsWord(l, f.offDirective) {
+			off = true
+			continue
+		}
+		if len(starts) == 0 {
+			// One-shot directives are only recognized outside of other blocks.
+			endIndex, directive, err := f.oneShotBlock(lines, i)
+			if err != nil {
+				warnings = append(warnings, finding(filename, i+offset, i+offset, err.Error()))
 				continue
 			}
-
-			commentMarker, options, _ := strings.Cut(start.line, f.startDirective)
-			opts, optionWarnings := parseBlockOptions(commentMarker, options, f.defaultOptions)
-			for _, warn := range optionWarnings {
-				warnings = append(warnings, finding(filename, start.index+offset, start.index+offset, warn.Error()))
+			if directive != "" {
+				addBlock(startLine{i, l}, endIndex, directive, "")
+				continue
 			}
-
-			start.index += opts.SkipLines
-			if start.index > endIndex {
+		}
+		if strings.Contains(l, f.startDirective) {
+			if f.startOptions(lines, i).Until == untilDedent {
+				warnings = append(warnings, finding(filename, i+offset, i+offset, errorNestedUntilDedent))
 				continue
 			}
-
-			// Top-level keep-sorted directives have depth 0. Nested keep-sorted
-			// directives will have depth >= 1 based on how deep it is.
-			depth := len(starts)
-			block := block{
-				metadata: blockMetadata{
-					startDirective: f.startDirective,
-					endDirective:   f.endDirective,
-					opts:           opts,
-				},
-				start: start.index + offset,
-				end:   endIndex + offset,
-				lines: lines[start.index+1 : endIndex],
+			starts = append(starts, startLine{i, l})
+		} else if strings.Contains(l, f.endDirective) {
+			if len(starts) == 0 {
+				incompleteBlocks = append(incompleteBlocks, incompleteBlock{i + offset, endDirective})
+				continue
 			}
-			// For example, consider depth=0:
-			// If we just finished a top-level block and there are first-level nested
-			// blocks present, we need to remove those from nestedBlocks and include
-			// them on this block.
-			// It isn't possible for len(nestedBlocks) to be > depth+1:
-			// At depth n, n != 0, we increase the length of nestedBlocks to be n.
-			// At depth m=n-1, the length of nestedBlocks will initially be n=m+1 (the assertion from above)
-			// and then we trim that down to be length m when we add the nested blocks
-			// to the current block.
-			if len(nestedBlocks) == depth+1 {
-				block.nestedBlocks = nestedBlocks[depth]
-				nestedBlocks = nestedBlocks[0:depth]
+			start := starts[len(starts)-1]
+			starts = starts[0 : len(starts)-1]
+			if warn := f.endDirectiveOptions(filename, start.line, start.index+offset, l, i+offset); warn != nil {
+				warnings = append(warnings, warn)
 			}
-			if depth == 0 {
-				// Top-level blocks get returned.
-				// Nested blocks are returned via their top-level block.
-				blocks = append(blocks, block)
-			} else {
-				// Otherwise, the current block appears to be nested. Add it to nestedBlocks.
-				for len(nestedBlocks) < depth {
-					nestedBlocks = append(nestedBlocks, nil)
-				}
-				nestedBlocks[depth-1] = append(nestedBlocks[depth-1], block)
+			if warn := endDirectiveIndentation(filename, start.line, start.index+offset, l, i+offset); warn != nil {
+				warnings = append(warnings, warn)
 			}
-			// Invariant: len(nestedBlocks) == depth
+			addBlock(start, i, f.startDirective, l)
 		}
 	}
 	if len(starts) > 0 {
@@ -170,13 +312,372 @@ func (f *Fixer) newBlocks(filename string, lines []string, offset int, include f
 		}
 	}
 
+	for _, c := range canonical {
+		// Nested directives are part of the lines that their parent block might
+		// rewrite, so they can only be fixed by hand.
+		c.Fixes[0].automatic = c.fixable && len(incompleteBlocks) == 0
+		c.kind = FixNormalizeDirectives
+		warnings = append(warnings, c.Finding)
+	}
+
 	return blocks, incompleteBlocks, warnings
 }
 
+// wholeGroups reports whether the first n of lines are made up of whole line
+// groups, so that skip_lines doesn't separate e.g. a sticky comment from the
+// line that it belongs to.
+func wholeGroups(lines []string, n int, metadata blockMetadata) bool {
+	for _, lg := range groupLines(lines, metadata) {
+		if n <= 0 {
+			break
+		}
+		n -= len(lg.comment) + len(lg.lines)
+	}
+	return n == 0
+}
+
+// codeBeforeComment reports whether prefix, the part of a line in front of a
+// directive, has code in front of the comment that the directive is in, e.g.
+// "foo(); //". customMarker is the comment_marker option, if any.
+func codeBeforeComment(prefix, customMarker string) bool {
+	i := -1
+	for _, m := range append([]string{customMarker}, commentMarkers...) {
+		if j := strings.Index(prefix, m); m != "" && j >= 0 && (i < 0 || j < i) {
+			i = j
+		}
+	}
+	if i <= 0 {
+		return false
+	}
+	code := strings.TrimSpace(prefix[:i])
+	return code != "" && !slices.Contains(templateDelimiters, code)
+}
+
+// templateDelimiters open the comments of template languages, e.g. the "{{" of
+// "{{/* keep-sorted start */}}", so they aren't code in front of a comment.
+var templateDelimiters = []string{"{", "{{", "{{-", "{%", "{%-", "<%", "<%-"}
+
+var lineCount = regexp.MustCompile(`^\s+(\d+)\s+lines?\b`)
+
+// directiveLines returns the indexes of the lines that may contain a directive
+// of f. Every directive contains f.ID, except for start and end directives
+// that were changed with WithDirectives, so this only needs to look for one
+// string per line in most cases.
+func (f *Fixer) directiveLines(lines []string) []int {
+	customStart := !strings.Contains(f.startDirective, f.ID)
+	customEnd := !strings.Contains(f.endDirective, f.ID)
+	var idx []int
+	for i, l := range lines {
+		if strings.Contains(l, f.ID) || customStart && strings.Contains(l, f.startDirective) || customEnd && strings.Contains(l, f.endDirective) {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// isMarkdownFile reports whether filename is the name of a Markdown file.
+func isMarkdownFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// fencedLines reports for each of lines whether it's part of a fenced code
+// block in Markdown, fences included. Only fences that aren't nested in
+// another Markdown construct are recognized, like in CommonMark: up to three
+// spaces, then at least three backticks or tildes, closed by at least as many
+// of the same character.
+func fencedLines(lines []string) []bool {
+	fenced := make([]bool, len(lines))
+	// The fence of the code block we're in, if any.
+	var open string
+	for i, l := range lines {
+		trimmed := strings.TrimLeft(l, " ")
+		fence := ""
+		if len(l)-len(trimmed) <= 3 {
+			fence = codeFence(trimmed)
+		}
+		if open == "" {
+			if len(fence) >= 3 && !(fence[0] == '`' && strings.Contains(trimmed[len(fence):], "`")) {
+				open = fence
+				fenced[i] = true
+			}
+			continue
+		}
+		fenced[i] = true
+		if strings.HasPrefix(fence, open) && strings.TrimSpace(trimmed[len(fence):]) == "" {
+			open = ""
+		}
+	}
+	return fenced
+}
+
+// codeFence returns the run of backticks or tildes at the start of s.
+func codeFence(s string) string {
+	if s == "" || s[0] != '`' && s[0] != '~' {
+		return ""
+	}
+	return s[:len(s)-len(strings.TrimLeft(s, s[:1]))]
+}
+
+// fileOptions returns the default options for the blocks in lines, with the
+// options from every file-scoped options pragma applied to f.defaultOptions.
+// Only the pragmas before the first other directive count, so that a pragma
+// can't change blocks above it. candidates are the lines that may contain a
+// directive, see directiveLines. ok is false if there aren't any pragmas that
+// count.
+func (f *Fixer) fileOptions(filename string, lines []string, candidates []int, offset int) (opts blockOptions, ok bool, warnings []*Finding) {
+	var options []string
+	var pragmas []int
+	afterDirective := false
+	for _, i := range candidates {
+		if _, o, found := strings.Cut(lines[i], f.fileOptionsDirective); !found {
+			afterDirective = afterDirective || f.isDirective(lines[i])
+		} else if afterDirective {
+			warnings = append(warnings, finding(filename, i+offset, i+offset, errorLateFileOptions(f.ID)))
+		} else {
+			options = append(options, o)
+			pragmas = append(pragmas, i)
+		}
+	}
+	if len(options) == 0 {
+		return blockOptions{}, false, warnings
+	}
+	opts, warns := parseBlockOptions("", strings.Join(options, " "), f.defaultOptions)
+	for _, warn := range warns {
+		warnings = append(warnings, optionFinding(filename, lines, pragmas[0], pragmas[len(pragmas)-1], offset, warn))
+	}
+	return opts, true, warnings
+}
+
+// oneShotBlock checks whether lines[i] is a one-shot directive, which sorts
+// the lines that follow it without needing an end directive. Start directives
+// with until=dedent count as one-shot directives, too. It returns the
+// index just past the block's last line and the part of lines[i] that makes up
+// the directive. directive is empty if lines[i] isn't a one-shot directive.
+func (f *Fixer) oneShotBlock(lines []string, i int) (endIndex int, directive string, _ error) {
+	l := lines[i]
+	if m := f.nextLineCount(l); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, "", fmt.Errorf("%s has invalid line count %q", f.nextDirective, m[1])
+		}
+		directive = f.nextDirective + m[0]
+		// Option continuation lines don't count towards n.
+		endIndex = i + 1
+		for endIndex < len(lines) && strings.Contains(lines[endIndex], f.optionDirective) {
+			endIndex++
+		}
+		endIndex = min(endIndex+n, len(lines))
+	} else if strings.Contains(l, f.untilBlankDirective) {
+		directive = f.untilBlankDirective
+		endIndex = i + 1
+		for endIndex < len(lines) && strings.TrimSpace(lines[endIndex]) != "" {
+			endIndex++
+		}
+	} else if containsWord(l, f.fileDirective) {
+		directive = f.fileDirective
+		endIndex = len(lines)
+	} else if strings.Contains(l, f.startDirective) {
+		opts := f.startOptions(lines, i)
+		if opts.Until != untilDedent {
+			return 0, "", nil
+		}
+		directive = f.startDirective
+		indent, _ := countIndent(l, opts.TabWidth)
+		for endIndex = i + 1; endIndex < len(lines); endIndex++ {
+			if in, ok := countIndent(lines[endIndex], opts.TabWidth); ok && in < indent {
+				break
+			}
+		}
+	} else {
+		return 0, "", nil
+	}
+
+	// Don't swallow any directives that come afterwards.
+	for j := i + 1; j < endIndex; j++ {
+		if f.isDirective(lines[j]) {
+			return j, directive, nil
+		}
+	}
+	return endIndex, directive, nil
+}
+
+// startOptions returns the options of the start directive at lines[i],
+// ignoring any warnings.
+func (f *Fixer) startOptions(lines []string, i int) blockOptions {
+	commentMarker, options, _ := f.directiveOptions(lines, i, len(lines), f.startDirective)
+	opts, _ := parseBlockOptions(commentMarker, options, f.defaultOptions)
+	return opts
+}
+
+// directiveOptions returns the options of the directive at lines[i], along
+// with the index of the last line they're on. Long option lists can be
+// continued on the following lines, up until end.
+func (f *Fixer) directiveOptions(lines []string, i, end int, directive string) (commentMarker, options string, last int) {
+	commentMarker, options, _ = strings.Cut(lines[i], directive)
+	for last = i; last+1 < end; last++ {
+		_, more, ok := strings.Cut(lines[last+1], f.optionDirective)
+		if !ok {
+			break
+		}
+		options += " " + more
+	}
+	return commentMarker, options, last
+}
+
+// nextLineCount returns the match of lineCount after the next directive in l,
+// or nil if l doesn't have a next directive. Without a line count, e.g. in
+// "keep-sorted next steps", it's just some text.
+func (f *Fixer) nextLineCount(l string) []string {
+	_, after, ok := strings.Cut(l, f.nextDirective)
+	if !ok {
+		return nil
+	}
+	return lineCount.FindStringSubmatch(after)
+}
+
+// isDirective reports whether l contains a directive that starts or ends a
+// block, or that turns keep-sorted off.
+func (f *Fixer) isDirective(l string) bool {
+	for _, d := range []string{f.startDirective, f.endDirective, f.untilBlankDirective} {
+		if strings.Contains(l, d) {
+			return true
+		}
+	}
+	return f.nextLineCount(l) != nil || containsWord(l, f.fileDirective) || containsWord(l, f.offDirective)
+}
+
+// containsWord reports whether l contains w, and w isn't just the beginning of
+// a longer word in l.
+func containsWord(l, w string) bool {
+	for {
+		i := strings.Index(l, w)
+		if i < 0 {
+			return false
+		}
+		l = l[i+len(w):]
+		if r, _ := utf8.DecodeRuneInString(l); l == "" || !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return true
+		}
+	}
+}
+
+// endDirectiveIndentation returns a finding if the end directive endLine isn't
+// indented the same way as the start directive startLine. The finding's fix
+// indents it like the start directive.
+func endDirectiveIndentation(filename, startLine string, start int, endLine string, end int) *Finding {
+	startIndent := startLine[:len(startLine)-len(strings.TrimLeftFunc(startLine, unicode.IsSpace))]
+	rest := strings.TrimLeftFunc(endLine, unicode.IsSpace)
+	if endLine[:len(endLine)-len(rest)] == startIndent {
+		return nil
+	}
+	return finding(filename, end, end, errorDirectiveIndentation(start), replacement(end, end, startIndent+rest+"\n"))
+}
+
+// endDirectiveOptions returns a finding if the end directive endLine has
+// options on it, since those are ignored. The finding's fix moves them to the
+// start directive startLine.
+func (f *Fixer) endDirectiveOptions(filename, startLine string, start int, endLine string, end int) *Finding {
+	commentMarker, after, _ := strings.Cut(endLine, f.endDirective)
+	options, closer := cutCommentCloser(after)
+	options = strings.TrimSpace(options)
+	if _, ok := newParser(options).popKey(); !ok {
+		return nil
+	}
+	if _, warns := parseBlockOptions("", options, blockOptions{}); len(warns) > 0 {
+		// Probably just a comment.
+		return nil
+	}
+	startLine, startCloser := cutCommentCloser(startLine)
+	fix := Fix{
+		Replacements: []Replacement{
+			{Lines: lineRange(start, start), NewContent: startLine + " " + options + startCloser + "\n"},
+			{Lines: lineRange(end, end), NewContent: commentMarker + f.endDirective + closer + "\n"},
+		},
+	}
+	return finding(filename, end, end, errorEndDirectiveOptions(f.ID), fix)
+}
+
+// cutCommentCloser removes the end of a block comment, like "-->", from the
+// end of s. closer is what was removed, including a leading space.
+func cutCommentCloser(s string) (_, closer string) {
+	s = strings.TrimRightFunc(s, unicode.IsSpace)
+	for _, c := range []string{"-->", "*/"} {
+		if strings.HasSuffix(s, c) {
+			return strings.TrimRightFunc(strings.TrimSuffix(s, c), unicode.IsSpace), " " + c
+		}
+	}
+	return s, ""
+}
+
+// readManifest reads the order_from file at path, which is relative to the
+// directory of filename. It returns the index of every non-blank line.
+func (f *Fixer) readManifest(filename, path string) (map[string]int, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(filename), path)
+	}
+	b, err := f.readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("order_from could not be read: %w", err)
+	}
+	manifest := make(map[string]int)
+	for _, l := range strings.Split(string(b), "\n") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		if _, ok := manifest[l]; !ok {
+			manifest[l] = len(manifest)
+		}
+	}
+	return manifest, nil
+}
+
+// canonicalDirective returns the start directive with its options in canonical
+// form. commentMarker is everything in front of the directive.
+func (f *Fixer) canonicalDirective(commentMarker, options string) (string, bool) {
+	// Keep the end of a comment that was started in commentMarker.
+	options, closer := cutCommentCloser(options)
+	canonical, ok := canonicalOptions(options, f.defaultOptions)
+	if !ok {
+		return "", false
+	}
+	if canonical != "" {
+		canonical = " " + canonical
+	}
+	return commentMarker + f.startDirective + canonical + closer, true
+}
+
 // sorted returns a slice which represents the correct sorting of b.lines.
 // If b.lines is already correctly sorted, we will return b.lines, true.
 func (b block) sorted() (sorted []string, alreadySorted bool) {
+	sorted, alreadySorted, _ = b.sort(false, false)
+	return sorted, alreadySorted
+}
+
+// sortedStable is like sorted, but also reports whether sorting is stable:
+// sorting the result again, or any nested block that sorting changed, wouldn't
+// change anything else.
+func (b block) sortedStable() (sorted []string, alreadySorted, stable bool) {
+	return b.sort(false, true)
+}
+
+// isSorted is like sorted, but only reports whether b is already sorted. It
+// stops looking as soon as it finds something out of order, without sorting
+// anything if it can help it.
+func (b block) isSorted() bool {
+	_, alreadySorted, _ := b.sort(true, false)
+	return alreadySorted
+}
+
+// sort implements sorted, sortedStable, and isSorted. If checkOnly is true,
+// sorted is nil whenever alreadySorted is false. stable is only meaningful if
+// checkStable is true.
+func (b block) sort(checkOnly, checkStable bool) (sorted []string, alreadySorted, stable bool) {
 	alreadySorted = true
+	stable = true
 
 	// Sort the nested blocks first so that their changes are visible to the
 	// outer block.
@@ -186,8 +687,12 @@ func (b block) sorted() (sorted []string, alreadySorted bool) {
 	}
 	var nestedResults []nestedResult
 	for _, n := range b.nestedBlocks {
-		lines, already := n.sorted()
+		lines, already, nestedStable := n.sort(checkOnly, checkStable)
+		stable = stable && nestedStable
 		if !already {
+			if checkOnly {
+				return nil, false, stable
+			}
 			alreadySorted = false
 		}
 		nestedResults = append(nestedResults, nestedResult{lines, already})
@@ -238,50 +743,89 @@ func (b block) sorted() (sorted []string, alreadySorted bool) {
 
 	groups := groupLines(lines, b.metadata)
 	log.Printf("Previous %d groups were for block at index %d are (options %v)", len(groups), b.start, b.metadata.opts)
-	trimTrailingComma := handleTrailingComma(groups)
+	hooks := b.metadata.opts.hooks
+	groups = runHooks(hooks, beforeSort, groups)
+	trimTrailingSeparator := handleTrailingSeparator(groups, b.metadata.opts.separator())
 
 	wasNewlineSeparated := true
-	if b.metadata.opts.NewlineSeparated {
+	// The number of blank lines before each group, and after the last group.
+	// Only used by newline_separated=preserve.
+	var blankLines []int
+	switch b.metadata.opts.newlineSeparated() {
+	case NewlineSeparationYes:
 		wasNewlineSeparated = isNewlineSeparated(groups)
-		var withoutNewlines []lineGroup
-		for _, lg := range groups {
-			if isNewline(lg) {
-				continue
+		groups, _ = removeNewlines(groups)
+	case NewlineSeparationPreserve:
+		groups, blankLines = removeNewlines(groups)
+	}
+	// The section that each group belongs to, and the number of blank lines
+	// before each section and after the last section. Only used by sections=yes.
+	var sections, sectionBlankLines []int
+	if b.metadata.opts.Sections {
+		groups, blankLines = removeNewlines(groups)
+		for i := range groups {
+			if i == 0 || blankLines[i] > 0 {
+				sectionBlankLines = append(sectionBlankLines, blankLines[i])
 			}
-			withoutNewlines = append(withoutNewlines, lg)
+			sections = append(sections, len(sectionBlankLines)-1)
 		}
-		groups = withoutNewlines
+		sectionBlankLines = append(sectionBlankLines, blankLines[len(blankLines)-1])
 	}
 
 	removedDuplicate := false
 	if b.metadata.opts.RemoveDuplicates {
-		seen := map[string]bool{}
+		seen := newDedupSet(b.metadata.opts.dedupKey)
 		var deduped []lineGroup
-		for _, lg := range groups {
-			if s := lg.joinedLines() + "\n" + strings.Join(lg.comment, "\n"); !seen[s] {
-				seen[s] = true
+		var dedupedSections []int
+		for i, lg := range groups {
+			// A key with a different value isn't removed, since that would lose
+			// information. It's reported instead.
+			if original, ok := seen.addOrFind(lg, i); !ok || b.metadata.opts.differentValue(lg, original.lg) {
 				deduped = append(deduped, lg)
+				if sections != nil {
+					dedupedSections = append(dedupedSections, sections[i])
+				}
 			} else {
 				removedDuplicate = true
 			}
 		}
 		groups = deduped
+		sections = dedupedSections
 	}
 
+	b.metadata.opts.pinEnds(groups)
+	b.metadata.opts.withSortKeys(groups)
 	less := b.lessFn()
+	split := splitSections(groups, sections)
 
-	if alreadySorted && wasNewlineSeparated && !removedDuplicate && slices.IsSortedFunc(groups, less) {
-		trimTrailingComma(groups)
-		return lines, true
+	// The hooks could change anything, so we can only tell whether the block
+	// was already sorted once they've run.
+	misindented := false
+	if b.metadata.opts.NormalizeIndent {
+		_, misindented = normalizeIndent(groups)
+	}
+	if len(hooks) == 0 && alreadySorted && wasNewlineSeparated && !removedDuplicate && !misindented && allSorted(split, less, b.pinned) {
+		trimTrailingSeparator(groups)
+		return lines, true, stable
+	}
+	if checkOnly && len(hooks) == 0 {
+		trimTrailingSeparator(groups)
+		return nil, false, stable
 	}
 
-	slices.SortStableFunc(groups, less)
+	for _, s := range split {
+		sortUnpinned(s, less, b.pinned)
+	}
 
-	trimTrailingComma(groups)
+	trimTrailingSeparator(groups)
+	if b.metadata.opts.NormalizeIndent {
+		groups, _ = normalizeIndent(groups)
+	}
 
-	if b.metadata.opts.NewlineSeparated {
+	newline := lineGroup{lines: []string{""}}
+	switch b.metadata.opts.newlineSeparated() {
+	case NewlineSeparationYes:
 		var separated []lineGroup
-		newline := lineGroup{lines: []string{""}}
 		for _, lg := range groups {
 			if separated != nil {
 				separated = append(separated, newline)
@@ -289,15 +833,482 @@ func (b block) sorted() (sorted []string, alreadySorted bool) {
 			separated = append(separated, lg)
 		}
 		groups = separated
+	case NewlineSeparationPreserve:
+		var separated []lineGroup
+		for i, lg := range groups {
+			for range blankLines[i] {
+				separated = append(separated, newline)
+			}
+			separated = append(separated, lg)
+		}
+		// If we removed duplicates, there are fewer groups than there used to be.
+		// The blank lines after the last group still go at the end.
+		for range blankLines[len(blankLines)-1] {
+			separated = append(separated, newline)
+		}
+		groups = separated
+	}
+	if b.metadata.opts.Sections {
+		var separated []lineGroup
+		var n int
+		for _, s := range split {
+			for range sectionBlankLines[sections[n]] {
+				separated = append(separated, newline)
+			}
+			separated = append(separated, s...)
+			n += len(s)
+		}
+		for range sectionBlankLines[len(sectionBlankLines)-1] {
+			separated = append(separated, newline)
+		}
+		groups = separated
 	}
+	groups = runHooks(hooks, afterSort, groups)
 
 	l := make([]string, 0, len(lines))
 	for _, g := range groups {
-		l = append(l, g.allLines()...)
+		l = g.appendLines(l)
+	}
+	if len(hooks) > 0 && alreadySorted && slices.Equal(l, lines) {
+		return lines, true, stable
+	}
+	if checkStable && stable {
+		// The nested blocks were already checked, and they're somewhere else in l
+		// now.
+		again := b
+		again.lines = l
+		again.nestedBlocks = nil
+		stable = again.isSorted()
+	}
+	return l, false, stable
+}
+
+// tornApart reports whether sorting b would probably tear apart constructs
+// that span multiple lines, because b's lines are balanced as a whole (see
+// codeBlock), but some of its line groups aren't. If so, it also returns the
+// options that would keep those constructs together.
+func (b block) tornApart() (suggestion string, ok bool) {
+	opts := b.metadata.opts
+	if opts.Block || opts.JSON || opts.XML || opts.YAML || opts.Markdown || len(opts.PairedLines) > 0 || opts.Preprocessor || opts.GroupBy == groupByBlankLines {
+		// These already know which lines belong together.
+		return "", false
+	}
+	// Without lang, an apostrophe is more likely to be part of some prose than
+	// the start of a string.
+	ignoreQuotes := opts.Lang == ""
+	all := codeBlock{ignoreQuotes: ignoreQuotes}
+	for _, l := range b.lines {
+		all.append(l, opts)
+	}
+	if all.expectsContinuation() {
+		return "", false
+	}
+	for _, lg := range groupLines(b.lines, b.metadata) {
+		cb := codeBlock{ignoreQuotes: ignoreQuotes}
+		for _, l := range lg.lines {
+			cb.append(l, opts)
+		}
+		if cb.expectsContinuation() {
+			if opts.StickyComments {
+				return "block=yes", true
+			}
+			return "block=yes sticky_comments=yes", true
+		}
+	}
+	return "", false
+}
+
+// order returns the indexes of the elements of b (see numElements) in the
+// order that sorting would put them in.
+func (b block) order() []int {
+	var elements []lineGroup
+	for _, lg := range groupLines(b.lines, b.metadata) {
+		if isElement(lg) {
+			elements = append(elements, lg)
+		}
+	}
+	b.metadata.opts.withSortKeys(elements)
+	less := b.lessFn()
+	order := make([]int, len(elements))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(i, j int) int {
+		return less(elements[i], elements[j])
+	})
+	return order
+}
+
+// sortedLike returns b.lines with the elements of b (see numElements)
+// rearranged into order, which is typically the order of another block.
+// Everything else stays where it is.
+// If b.lines is already in that order, we will return b.lines, true.
+func (b block) sortedLike(order []int) (sorted []string, alreadySorted bool) {
+	if slices.IsSorted(order) {
+		return b.lines, true
+	}
+
+	groups := groupLines(b.lines, b.metadata)
+	trimTrailingSeparator := handleTrailingSeparator(groups, b.metadata.opts.separator())
+	var idx []int
+	for i, lg := range groups {
+		if isElement(lg) {
+			idx = append(idx, i)
+		}
+	}
+	reordered := slices.Clone(groups)
+	for i, j := range order {
+		reordered[idx[i]] = groups[idx[j]]
+	}
+	trimTrailingSeparator(reordered)
+
+	l := make([]string, 0, len(b.lines))
+	for _, g := range reordered {
+		l = g.appendLines(l)
 	}
 	return l, false
 }
 
+// numElements returns the number of lineGroups in b that would be sorted,
+// not counting blank lines or comments without any content after them.
+func (b block) numElements() int {
+	var n int
+	for _, lg := range groupLines(b.lines, b.metadata) {
+		if isElement(lg) {
+			n++
+		}
+	}
+	return n
+}
+
+// fixStats describes what sorting b did, given its sorted lines.
+func (b block) fixStats(sorted []string) FixStats {
+	elements := func(lines []string) []string {
+		var keys []string
+		for _, lg := range groupLines(lines, b.metadata) {
+			if isElement(lg) {
+				keys = append(keys, strings.Join(lg.allLines(), "\n"))
+			}
+		}
+		return keys
+	}
+	before, after := elements(b.lines), elements(sorted)
+	positions := make(map[string][]int)
+	for i, k := range after {
+		positions[k] = append(positions[k], i)
+	}
+	// Where every element that's still around ended up, in its original order.
+	var moved []int
+	for _, k := range before {
+		if ps := positions[k]; len(ps) > 0 {
+			moved = append(moved, ps[0])
+			positions[k] = ps[1:]
+		}
+	}
+	return FixStats{
+		BlocksSorted: 1,
+		// The elements that stayed in the same relative order didn't need to move.
+		GroupsMoved:       len(moved) - longestIncreasing(moved),
+		DuplicatesRemoved: max(0, len(before)-len(after)),
+	}
+}
+
+// longestIncreasing returns the length of the longest strictly increasing
+// subsequence of s.
+func longestIncreasing(s []int) int {
+	// tails[i] is the smallest last element of an increasing subsequence of
+	// length i+1.
+	var tails []int
+	for _, v := range s {
+		i, _ := slices.BinarySearch(tails, v)
+		if i == len(tails) {
+			tails = append(tails, v)
+		} else {
+			tails[i] = v
+		}
+	}
+	return len(tails)
+}
+
+// isElement determines if lg is something that would be sorted, rather than a
+// blank line or a comment without any content after it.
+func isElement(lg lineGroup) bool {
+	return len(lg.lines) > 0 && !isNewline(lg)
+}
+
+// allBlocks returns bs along with all of the blocks nested within them.
+func allBlocks(bs []block) []block {
+	return appendAllBlocks(nil, bs)
+}
+
+// appendAllBlocks is allBlocks, but appends to all instead of copying every
+// level of nesting into the level above it, which is quadratic in the depth.
+func appendAllBlocks(all []block, bs []block) []block {
+	for _, b := range bs {
+		all = append(all, b)
+		all = appendAllBlocks(all, b.nestedBlocks)
+	}
+	return all
+}
+
+// duplicate is a lineGroup that has the same content as an earlier lineGroup
+// in the same block.
+type duplicate struct {
+	// The index range in block.lines of the duplicate lineGroup.
+	lines indexRange
+	// The index in block.lines of the first line of the original lineGroup.
+	original int
+	// Whether the content of the duplicate differs from the original. This can
+	// only happen with dedupe_keys=yes. Such duplicates are never removed.
+	differs bool
+}
+
+// duplicates returns every lineGroup in b.lines that RemoveDuplicates would
+// remove while sorting.
+func (b block) duplicates() []duplicate {
+	if !b.metadata.opts.RemoveDuplicates {
+		return nil
+	}
+
+	groups := groupLines(b.lines, b.metadata)
+	last := len(groups) - 1
+	for last >= 0 && len(groups[last].lines) == 0 {
+		last--
+	}
+	sep := b.metadata.opts.separator()
+	lastHadSeparator := last >= 0 && groups[last].hasSuffix(sep)
+	trimTrailingSeparator := handleTrailingSeparator(groups, sep)
+	defer trimTrailingSeparator(groups)
+
+	var dups []duplicate
+	// The groups that were seen, along with the index in b.lines of their first
+	// line.
+	seen := newDedupSet(b.metadata.opts.dedupKey)
+	var cursor int
+	// The index in b.lines of the blank lines right before the current group.
+	blankLines := -1
+	for i, lg := range groups {
+		start := cursor
+		cursor += len(lg.comment) + len(lg.lines)
+		removeFrom := start
+		if b.metadata.opts.newlineSeparated() != NewlineSeparationNo {
+			if isNewline(lg) {
+				if blankLines < 0 {
+					blankLines = start
+				}
+				continue
+			}
+			if blankLines >= 0 && seen.len() > 0 {
+				// Remove the blank lines that separate a duplicate from its
+				// predecessor along with the duplicate itself.
+				removeFrom = blankLines
+			}
+			blankLines = -1
+		}
+		if original, ok := seen.addOrFind(lg, start); ok {
+			if i == last && !lastHadSeparator && lg.hasSuffix(sep) {
+				// Removing the last line would leave a trailing separator behind on
+				// the new last line. Only sorting can fix that.
+				return nil
+			}
+			dups = append(dups, duplicate{indexRange{start: removeFrom, end: cursor, init: true}, original.value, b.metadata.opts.differentValue(lg, original.lg)})
+		}
+	}
+	return dups
+}
+
+// commentDuplicates returns every lineGroup in b.lines that RemoveDuplicates
+// keeps only because its comment is different from the comment of an earlier
+// lineGroup with the same lines.
+func (b block) commentDuplicates() []duplicate {
+	if !b.metadata.opts.RemoveDuplicates || b.metadata.opts.DedupeKeys {
+		return nil
+	}
+
+	groups := groupLines(b.lines, b.metadata)
+	trimTrailingSeparator := handleTrailingSeparator(groups, b.metadata.opts.separator())
+	defer trimTrailingSeparator(groups)
+
+	var dups []duplicate
+	seen := newDedupSet(lineGroup.dedupKey)
+	seenLines := newDedupSet(lineGroup.joinedLines)
+	var cursor int
+	for _, lg := range groups {
+		start := cursor
+		cursor += len(lg.comment) + len(lg.lines)
+		if !isElement(lg) {
+			continue
+		}
+		if _, ok := seen.addOrFind(lg, start); ok {
+			// RemoveDuplicates removes this one.
+			continue
+		}
+		if original, ok := seenLines.addOrFind(lg, start); ok {
+			dups = append(dups, duplicate{lines: indexRange{start: start, end: cursor, init: true}, original: original.value})
+		}
+	}
+	return dups
+}
+
+// dedupSet remembers line groups by a key, like remove_duplicates does. Only
+// the hashes of the keys are kept, and the keys are only computed again when
+// two hashes are the same, so large blocks with long lines don't need a copy
+// of every key.
+type dedupSet struct {
+	key  func(lineGroup) string
+	hash func(string) uint64
+	// The groups that were added, by the hash of their key.
+	entries map[uint64][]dedupEntry
+	n       int
+}
+
+type dedupEntry struct {
+	lg    lineGroup
+	value int
+}
+
+func newDedupSet(key func(lineGroup) string) *dedupSet {
+	seed := maphash.MakeSeed()
+	return &dedupSet{
+		key:     key,
+		hash:    func(s string) uint64 { return maphash.String(seed, s) },
+		entries: make(map[uint64][]dedupEntry),
+	}
+}
+
+// addOrFind returns the entry for the group with the same key as lg if there
+// is one. Otherwise, it adds lg along with value.
+func (s *dedupSet) addOrFind(lg lineGroup, value int) (_ dedupEntry, found bool) {
+	k := s.key(lg)
+	h := s.hash(k)
+	for _, e := range s.entries[h] {
+		if s.key(e.lg) == k {
+			return e, true
+		}
+	}
+	s.entries[h] = append(s.entries[h], dedupEntry{lg, value})
+	s.n++
+	return dedupEntry{}, false
+}
+
+// len returns the number of groups in s.
+func (s *dedupSet) len() int {
+	return s.n
+}
+
+// splitSections splits gs into runs of groups that belong to the same
+// section. The runs share gs's backing array. If sections is nil, all of gs is
+// one run.
+func splitSections(gs []lineGroup, sections []int) [][]lineGroup {
+	if sections == nil {
+		return [][]lineGroup{gs}
+	}
+	var split [][]lineGroup
+	start := 0
+	for i := range gs {
+		if i+1 == len(gs) || sections[i+1] != sections[i] {
+			split = append(split, gs[start:i+1])
+			start = i + 1
+		}
+	}
+	return split
+}
+
+// allSorted determines if every one of split is sorted, not counting the
+// pinned groups.
+func allSorted(split [][]lineGroup, less func(a, b lineGroup) int, pinned func(lineGroup) bool) bool {
+	for _, s := range split {
+		idx := unpinned(s, pinned)
+		for i := 1; i < len(idx); i++ {
+			if less(s[idx[i-1]], s[idx[i]]) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sortUnpinned sorts the groups in gs that aren't pinned, leaving the pinned
+// groups where they are.
+func sortUnpinned(gs []lineGroup, less func(a, b lineGroup) int, pinned func(lineGroup) bool) {
+	idx := unpinned(gs, pinned)
+	if len(idx) == len(gs) {
+		slices.SortStableFunc(gs, less)
+		return
+	}
+	sorted := make([]lineGroup, len(idx))
+	for i, j := range idx {
+		sorted[i] = gs[j]
+	}
+	slices.SortStableFunc(sorted, less)
+	for i, j := range idx {
+		gs[j] = sorted[i]
+	}
+}
+
+// pinEnds marks the first PinFirst and the last PinLast groups in groups that
+// have any lines as pinned. Blank lines and comments on their own don't count.
+func (opts blockOptions) pinEnds(groups []lineGroup) {
+	n := opts.PinFirst
+	for i := 0; i < len(groups) && n > 0; i++ {
+		if isElement(groups[i]) {
+			groups[i].pinnedEnd = true
+			n--
+		}
+	}
+	n = opts.PinLast
+	for i := len(groups) - 1; i >= 0 && n > 0; i-- {
+		if isElement(groups[i]) {
+			groups[i].pinnedEnd = true
+			n--
+		}
+	}
+}
+
+// unpinned returns the indexes of the groups in gs that aren't pinned.
+func unpinned(gs []lineGroup, pinned func(lineGroup) bool) []int {
+	var idx []int
+	for i, lg := range gs {
+		if !pinned(lg) {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// pinned determines if lg is marked with the pin directive, or is kept in
+// place by pin_first or pin_last, which keeps it at its position while the rest
+// of the block is sorted around it.
+func (b block) pinned(lg lineGroup) bool {
+	if lg.pinnedEnd {
+		return true
+	}
+	if b.metadata.pinDirective == "" {
+		return false
+	}
+	hasPin := func(l string) bool {
+		return strings.Contains(l, b.metadata.pinDirective)
+	}
+	return slices.ContainsFunc(lg.comment, hasPin) || slices.ContainsFunc(lg.lines, hasPin)
+}
+
+// removeNewlines removes the groups that are just an empty line.
+// It also returns how many empty lines there were before each of the
+// remaining groups, and (as the last element) after the last remaining group.
+func removeNewlines(gs []lineGroup) (_ []lineGroup, blankLines []int) {
+	var withoutNewlines []lineGroup
+	blankLines = []int{0}
+	for _, lg := range gs {
+		if isNewline(lg) {
+			blankLines[len(blankLines)-1]++
+			continue
+		}
+		withoutNewlines = append(withoutNewlines, lg)
+		blankLines = append(blankLines, 0)
+	}
+	return withoutNewlines, blankLines
+}
+
 // isNewlineSeparated determines if the given lineGroups are already NewlineSeparated.
 //
 // e.g.
@@ -330,24 +1341,31 @@ func isNewline(lg lineGroup) bool {
 	return len(lg.comment) == 0 && len(lg.lines) == 1 && strings.TrimSpace(lg.lines[0]) == ""
 }
 
-// handleTrailingComma handles the special case that all lines of a sorted segment are terminated
-// by a comma except for the final element; in this case, we add a ',' to the
-// last linegroup and strip it again after sorting.
-func handleTrailingComma(lgs []lineGroup) (trimTrailingComma func([]lineGroup)) {
+// handleTrailingSeparator handles the special case that all lines of a sorted
+// segment are terminated by a separator (e.g. a comma) except for the final
+// element; in this case, we add the separator to the last linegroup and strip
+// it again after sorting. The lines of lgs are shared with the rest of the
+// file, which other blocks may be reading at the same time, so the groups that
+// change get their own copy of their lines.
+func handleTrailingSeparator(lgs []lineGroup, sep string) (trimTrailingSeparator func([]lineGroup)) {
 	var dataGroups []lineGroup
-	for _, lg := range lgs {
+	last := -1
+	for i, lg := range lgs {
 		if len(lg.lines) > 0 {
 			dataGroups = append(dataGroups, lg)
+			last = i
 		}
 	}
 
-	if n := len(dataGroups); n > 1 && allHaveSuffix(dataGroups[0:n-1], ",") && !dataGroups[n-1].hasSuffix(",") {
-		dataGroups[n-1].append(",")
+	if n := len(dataGroups); n > 1 && allHaveSuffix(dataGroups[0:n-1], sep) && !dataGroups[n-1].hasSuffix(sep) {
+		lgs[last].lines = slices.Clone(lgs[last].lines)
+		lgs[last].append(sep)
 
 		return func(lgs []lineGroup) {
 			for i := len(lgs) - 1; i >= 0; i-- {
 				if len(lgs[i].lines) > 0 {
-					lgs[i].trimSuffix(",")
+					lgs[i].lines = slices.Clone(lgs[i].lines)
+					lgs[i].trimSuffix(sep)
 					return
 				}
 			}
@@ -368,6 +1386,30 @@ func allHaveSuffix(lgs []lineGroup, s string) bool {
 }
 
 func (b block) lessFn() func(a, b lineGroup) int {
+	steps := b.comparisons()
+	return func(a, b lineGroup) int {
+		for _, s := range steps {
+			if c := s.cmp(a, b); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+}
+
+// comparison is one of the steps that decide how two line groups are ordered.
+// Later steps only matter if the earlier ones consider the groups equal.
+type comparison struct {
+	// What the step compares, for Explain.
+	name string
+	cmp  func(a, b lineGroup) int
+}
+
+// sortKeyStep is the name of the comparison of the sort keys.
+const sortKeyStep = "sort key"
+
+// comparisons returns the steps of lessFn, in order.
+func (b block) comparisons() []comparison {
 	// Always put groups that are only comments last.
 	commentOnlyBlock := comparingProperty(func(lg lineGroup) int {
 		if len(lg.lines) > 0 {
@@ -383,14 +1425,33 @@ func (b block) lessFn() func(a, b lineGroup) int {
 	//
 	// An empty prefix can be used to move all remaining entries to a position
 	// between other prefixes.
+	//
+	// Prefixes with an explicit weight (e.g. INIT_=(-10)) use that instead.
 	var prefixWeights []prefixWeight
 	for i, p := range b.metadata.opts.PrefixOrder {
-		prefixWeights = append(prefixWeights, prefixWeight{p, i - len(b.metadata.opts.PrefixOrder)})
+		w := prefixWeight{p, i - len(b.metadata.opts.PrefixOrder)}
+		if m := explicitPrefixWeight.FindStringSubmatch(p); m != nil {
+			w.prefix = m[1]
+			// validate already made sure that the weight is valid.
+			w.weight, _ = strconv.Atoi(m[2])
+		}
+		prefixWeights = append(prefixWeights, w)
 	}
 	slices.SortStableFunc(prefixWeights, func(a, b prefixWeight) int {
 		return cmp.Compare(b.prefix, a.prefix)
 	})
 
+	// Lines that are listed in the OrderFrom file go first, in the same order
+	// as in that file.
+	manifestOrder := comparingProperty(func(lg lineGroup) int {
+		if i, ok := b.metadata.opts.manifest[b.metadata.opts.manifestKey(lg)]; ok {
+			return i - len(b.metadata.opts.manifest)
+		}
+		return 0
+	})
+
+	extensionOrder := b.metadata.opts.extensionOrder()
+
 	prefixOrder := comparingProperty(func(lg lineGroup) int {
 		for _, w := range prefixWeights {
 			if lg.hasPrefix(w.prefix) {
@@ -418,28 +1479,64 @@ func (b block) lessFn() func(a, b lineGroup) int {
 	//   foo_6
 	//   Foo_45
 	//   foo_123
-	transformOrder := comparingPropertyWith(func(lg lineGroup) numericTokens {
-		l := lg.joinedLines()
-		if s, ok := b.metadata.opts.removeIgnorePrefix(l); ok {
-			l = s
-		}
-		if !b.metadata.opts.CaseSensitive {
-			l = strings.ToLower(l)
+	regexes, priority := b.metadata.opts.byRegex()
+	transformOrder := comparingPropertyWith(func(lg lineGroup) []numericTokens {
+		if lg.keys != nil {
+			return lg.keys.tokens
 		}
-		return b.metadata.opts.maybeParseNumeric(l)
-	}, numericTokens.compare)
+		return b.metadata.opts.sortTokens(lg, regexes, priority)
+	}, func(a, b []numericTokens) int {
+		return slices.CompareFunc(a, b, numericTokens.compare)
+	})
 
-	return func(a, b lineGroup) int {
-		for _, cmp := range []func(a, b lineGroup) int{
-			commentOnlyBlock,
-			prefixOrder,
-			transformOrder,
-		} {
-			if c := cmp(a, b); c != 0 {
-				return c
-			}
+	return []comparison{
+		{"comment-only groups go last", commentOnlyBlock},
+		{"order_from", manifestOrder},
+		{"prefix_order", prefixOrder},
+		{"option extensions", extensionOrder},
+		{sortKeyStep, transformOrder},
+		{"entire lines, as a tie-breaker", lineGroup.less},
+	}
+}
+
+// sortTokens returns the sort key of lg, after every option that transforms
+// it has been applied.
+func (opts blockOptions) sortTokens(lg lineGroup, regexes []*regexp.Regexp, priority []int) []numericTokens {
+	var tokens []numericTokens
+	for _, k := range regexKey(opts.regexInput(lg), regexes, priority) {
+		if s, ok := opts.removeIgnorePrefix(k); ok {
+			k = s
+		}
+		if !opts.CaseSensitive {
+			k = strings.ToLower(k)
+		}
+		if opts.FoldAccents {
+			k = foldAccents(k)
 		}
-		return a.less(b)
+		tokens = append(tokens, opts.maybeParseNumeric(k))
+	}
+	return tokens
+}
+
+// regexInput returns the part of lg that the ByRegex patterns are matched
+// against, after every option that applies before them.
+func (opts blockOptions) regexInput(lg lineGroup) string {
+	l := opts.maybeTrailingComment(lg.joinedLines())
+	if opts.CSV {
+		// Quoted fields may contain line breaks.
+		l = opts.maybeCSVField(strings.Join(lg.lines, "\n"))
+	}
+	l = opts.maybePresetKey(l)
+	return opts.maybeJSONKey(opts.maybeRemoveListMarker(l))
+}
+
+// withSortKeys precomputes the sort keys of groups, which must not be
+// modified afterwards: the keys wouldn't change with them.
+func (opts blockOptions) withSortKeys(groups []lineGroup) {
+	regexes, priority := opts.byRegex()
+	for i := range groups {
+		groups[i].keys = &sortKeys{joined: groups[i].joinedLines()}
+		groups[i].keys.tokens = opts.sortTokens(groups[i], regexes, priority)
 	}
 }
 
@@ -460,6 +1557,8 @@ func comparingPropertyWith[T any, R any](f func(T) R, cmp func(R, R) int) func(a
 	}
 }
 
+var explicitPrefixWeight = regexp.MustCompile(`^(.*)=\((-?\d+)\)$`)
+
 type prefixWeight struct {
 	prefix string
 	weight int
@@ -0,0 +1,210 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The number of unchanged lines around every change in a diff.
+const diffContext = 3
+
+// Diff returns a unified diff that applies the fix of f to contents, the
+// original content of f.Path. If f has an automatic fix, that's the one that
+// is used. Otherwise, it's the first fix. Diff returns the empty string if f
+// doesn't have any fixes.
+func (f *Finding) Diff(contents string) string {
+	if len(f.Fixes) == 0 {
+		return ""
+	}
+	fix := f.Fixes[0]
+	for _, fx := range f.Fixes {
+		if fx.automatic {
+			fix = fx
+			break
+		}
+	}
+	return Diff(f.Path, contents, fix.Replacements)
+}
+
+// Diff returns a unified diff of the changes that Fix would make to contents.
+// It returns the empty string if there aren't any.
+func (f *Fixer) Diff(filename, contents string, modifiedLines []LineRange) string {
+	var repls []Replacement
+	for _, finding := range f.Findings(filename, contents, modifiedLines) {
+		if finding.lintOnly {
+			continue
+		}
+		for _, fix := range finding.Fixes {
+			if !fix.automatic {
+				continue
+			}
+			r := fix.Replacements[0]
+			if len(repls) > 0 && r.Lines.Start <= repls[len(repls)-1].Lines.End {
+				// Overlaps with a change that already covers it.
+				continue
+			}
+			repls = append(repls, r)
+		}
+	}
+	return Diff(filename, contents, repls)
+}
+
+// Diff returns a unified diff that applies replacements to contents, the
+// original content of path. The replacements may not overlap.
+func Diff(path, contents string, replacements []Replacement) string {
+	if len(replacements) == 0 {
+		return ""
+	}
+	lines := strings.Split(contents, "\n")
+	if lines[len(lines)-1] == "" {
+		// Don't count the empty string after the final newline as a line.
+		lines = lines[:len(lines)-1]
+	}
+	noFinalNewline := !strings.HasSuffix(contents, "\n")
+	repls := slices.Clone(replacements)
+	slices.SortFunc(repls, func(a, b Replacement) int {
+		return cmp.Compare(a.Lines.Start, b.Lines.Start)
+	})
+
+	var s strings.Builder
+	// Paths in a unified diff are relative.
+	path = strings.TrimPrefix(path, "/")
+	fmt.Fprintf(&s, "--- a/%s\n+++ b/%s\n", path, path)
+	// The difference in length between the old and new lines so far.
+	var delta int
+	for len(repls) > 0 {
+		// Changes that are close enough to share their context go in one hunk.
+		n := 1
+		for n < len(repls) && repls[n].Lines.Start-diffContext <= repls[n-1].Lines.End+diffContext+1 {
+			n++
+		}
+		delta = writeHunk(&s, lines, noFinalNewline, repls[:n], delta)
+		repls = repls[n:]
+	}
+	return s.String()
+}
+
+// writeHunk writes a single hunk of a unified diff that contains repls. delta
+// is the difference in length between the old and new lines before this hunk.
+// noFinalNewline is whether the last of lines doesn't end with a line break.
+// It returns delta after this hunk.
+func writeHunk(s *strings.Builder, lines []string, noFinalNewline bool, repls []Replacement, delta int) int {
+	// Indexes in lines, end is exclusive.
+	start := max(0, repls[0].Lines.Start-1-diffContext)
+	end := min(len(lines), repls[len(repls)-1].Lines.End+diffContext)
+
+	var body strings.Builder
+	// writeOld writes lines[i:j] with the given prefix.
+	writeOld := func(prefix string, i, j int) {
+		for k := i; k < j; k++ {
+			body.WriteString(prefix + lines[k] + "\n")
+			if noFinalNewline && k == len(lines)-1 {
+				body.WriteString(noNewlineMarker)
+			}
+		}
+	}
+	oldLen, newLen := end-start, end-start
+	cursor := start
+	for _, r := range repls {
+		writeOld(" ", cursor, r.Lines.Start-1)
+		writeOld("-", r.Lines.Start-1, r.Lines.End)
+		newLines := strings.Split(strings.TrimSuffix(r.NewContent, "\n"), "\n")
+		if r.NewContent == "" {
+			newLines = nil
+		}
+		for _, l := range newLines {
+			body.WriteString("+" + l + "\n")
+		}
+		if r.NewContent != "" && !strings.HasSuffix(r.NewContent, "\n") {
+			body.WriteString(noNewlineMarker)
+		}
+		newLen += len(newLines) - (r.Lines.End - r.Lines.Start + 1)
+		cursor = r.Lines.End
+	}
+	writeOld(" ", cursor, end)
+
+	fmt.Fprintf(s, "@@ -%s +%s @@\n", hunkRange(start, oldLen), hunkRange(start+delta, newLen))
+	s.WriteString(body.String())
+	return delta + newLen - oldLen
+}
+
+// noNewlineMarker follows the last line of a diff's old or new file if it
+// doesn't end with a line break.
+const noNewlineMarker = "\\ No newline at end of file\n"
+
+// DiffContents returns a unified diff from old to new, two versions of the
+// content of path. It returns the empty string if they're the same.
+func DiffContents(path, old, new string) string {
+	if old == new {
+		return ""
+	}
+	oldLines, newLines := linesAfter(old), linesAfter(new)
+	var repls []Replacement
+	if len(oldLines) == len(newLines) {
+		// Sorting and normalizing line endings only change lines in place.
+		for i := 0; i < len(oldLines); {
+			if oldLines[i] == newLines[i] {
+				i++
+				continue
+			}
+			j := i
+			for j < len(oldLines) && oldLines[j] != newLines[j] {
+				j++
+			}
+			repls = append(repls, Replacement{Lines: LineRange{i + 1, j}, NewContent: strings.Join(newLines[i:j], "")})
+			i = j
+		}
+	} else {
+		// Otherwise, everything between the unchanged lines at either end
+		// changed.
+		n := min(len(oldLines), len(newLines))
+		prefix := 0
+		for prefix < n && oldLines[prefix] == newLines[prefix] {
+			prefix++
+		}
+		suffix := 0
+		for suffix < n-prefix && oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+			suffix++
+		}
+		repls = append(repls, Replacement{
+			Lines:      LineRange{prefix + 1, len(oldLines) - suffix},
+			NewContent: strings.Join(newLines[prefix:len(newLines)-suffix], ""),
+		})
+	}
+	return Diff(path, old, repls)
+}
+
+// linesAfter splits s into lines that keep their line breaks.
+func linesAfter(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// hunkRange formats the range of a hunk header. start is the index of the
+// first line of the hunk.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		// Empty ranges refer to the line before them.
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
@@ -0,0 +1,218 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		contents     string
+		replacements []Replacement
+
+		want string
+	}{
+		{
+			name: "NoReplacements",
+
+			contents: "a\n",
+
+			want: "",
+		},
+		{
+			name: "Replacement",
+
+			contents: "1\n2\n3\n4\nc\nb\na\n5\n",
+			replacements: []Replacement{
+				{Lines: lineRange(5, 7), NewContent: "a\nb\nc\n"},
+			},
+
+			want: `--- a/file
++++ b/file
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-c
+-b
+-a
++a
++b
++c
+ 5
+`,
+		},
+		{
+			name: "Deletion",
+
+			contents: "a\na\nb",
+			replacements: []Replacement{
+				{Lines: lineRange(2, 2), NewContent: ""},
+			},
+
+			want: `--- a/file
++++ b/file
+@@ -1,3 +1,2 @@
+ a
+-a
+ b
+\ No newline at end of file
+`,
+		},
+		{
+			name: "SeparateHunks",
+
+			contents: "x\n1\n2\n3\n4\n5\n6\n7\n8\ny\nz\n",
+			replacements: []Replacement{
+				{Lines: lineRange(10, 10), NewContent: "Y\n"},
+				{Lines: lineRange(1, 1), NewContent: ""},
+			},
+
+			want: `--- a/file
++++ b/file
+@@ -1,4 +1,3 @@
+-x
+ 1
+ 2
+ 3
+@@ -7,5 +6,5 @@
+ 6
+ 7
+ 8
+-y
++Y
+ z
+`,
+		},
+		{
+			name: "SharedContext",
+
+			contents: "x\n1\n2\n3\n4\n5\n6\ny\n",
+			replacements: []Replacement{
+				{Lines: lineRange(1, 1), NewContent: "X\n"},
+				{Lines: lineRange(8, 8), NewContent: "Y\n"},
+			},
+
+			want: `--- a/file
++++ b/file
+@@ -1,8 +1,8 @@
+-x
++X
+ 1
+ 2
+ 3
+ 4
+ 5
+ 6
+-y
++Y
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, Diff("file", tc.contents, tc.replacements)); diff != "" {
+				t.Errorf("Diff() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDiffContents(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		old, new string
+
+		want string
+	}{
+		{
+			name: "Same",
+
+			old: "a\nb\n",
+			new: "a\nb\n",
+		},
+		{
+			name: "InPlace",
+
+			old: "a\r\nb\nc\n",
+			new: "a\nb\nc\n",
+
+			want: "--- a/file\n+++ b/file\n@@ -1,3 +1,3 @@\n-a\r\n+a\n b\n c\n",
+		},
+		{
+			name: "FinalNewlineAdded",
+
+			old: "a\nb",
+			new: "a\nb\n",
+
+			want: "--- a/file\n+++ b/file\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "FinalNewlineRemoved",
+
+			old: "a\nb\n",
+			new: "a\nb",
+
+			want: "--- a/file\n+++ b/file\n@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			name: "LinesRemoved",
+
+			old: "x\na\na\nb\n",
+			new: "x\na\nb\n",
+
+			want: "--- a/file\n+++ b/file\n@@ -1,4 +1,3 @@\n x\n a\n-a\n b\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, DiffContents("file", tc.old, tc.new)); diff != "" {
+				t.Errorf("DiffContents() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFinding_Diff(t *testing.T) {
+	initZerolog(t)
+	contents := `
+// keep-sorted-test start
+b
+a
+// keep-sorted-test end
+`
+	fs := New("keep-sorted-test", BlockOptions{}).Findings("file.go", contents, nil)
+	if len(fs) != 1 {
+		t.Fatalf("Findings() = %v, want exactly one finding", fs)
+	}
+	want := `--- a/file.go
++++ b/file.go
+@@ -1,5 +1,5 @@
+` + " " + `
+ // keep-sorted-test start
+-b
+-a
++a
++b
+ // keep-sorted-test end
+`
+	if diff := cmp.Diff(want, fs[0].Diff(contents)); diff != "" {
+		t.Errorf("Diff() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// The kinds of Directive.
+const (
+	DirectiveStart = "start"
+	DirectiveEnd   = "end"
+)
+
+// Directive is a line that starts or ends a keep-sorted block, split into its
+// parts. For example, "  // keep-sorted start numeric=yes" has the Indent
+// "  ", the CommentMarker "//", the ID "keep-sorted", the Kind "start", and
+// the Options "numeric=yes".
+type Directive struct {
+	Indent        string
+	CommentMarker string
+	ID            string
+	// Either DirectiveStart or DirectiveEnd.
+	Kind string
+	// The options, as they're written on the line.
+	Options string
+	// The end of a block comment that the directive is in, e.g. "-->".
+	CommentCloser string
+}
+
+// ParseDirective splits line into the parts of a directive. It returns an
+// error if line isn't a start or end directive.
+func ParseDirective(line string) (Directive, error) {
+	var d Directive
+	rest := strings.TrimLeftFunc(line, unicode.IsSpace)
+	d.Indent = line[:len(line)-len(rest)]
+	d.CommentMarker = guessCommentMarker(rest)
+	rest = strings.TrimPrefix(rest, d.CommentMarker)
+	rest, closer := cutCommentCloser(rest)
+	d.CommentCloser = strings.TrimSpace(closer)
+
+	m := directiveParts.FindStringSubmatch(rest)
+	if m == nil || (m[2] != DirectiveStart && m[2] != DirectiveEnd) {
+		return Directive{}, fmt.Errorf("%q is not a start or end directive", line)
+	}
+	d.ID, d.Kind, d.Options = m[1], m[2], strings.TrimSpace(m[3])
+	return d, nil
+}
+
+// directiveParts matches the ID, the kind, and the options of a directive,
+// which may be separated by any amount of whitespace.
+var directiveParts = regexp.MustCompile(`^\s*(\S+)\s+(\S+)(?:\s+(.*))?$`)
+
+// BlockOptions parses the options of d on top of DefaultBlockOptions.
+func (d Directive) BlockOptions() (BlockOptions, error) {
+	opts, warns := parseBlockOptions(d.CommentMarker, d.Options, defaultOptions)
+	if err := errors.Join(warns...); err != nil {
+		return BlockOptions{}, err
+	}
+	return BlockOptions{opts}, nil
+}
+
+// String renders d as a line. If the options of d are valid, they're written
+// in the same canonical form as with canonicalize=yes.
+func (d Directive) String() string {
+	var s strings.Builder
+	s.WriteString(d.Indent)
+	if d.CommentMarker != "" {
+		s.WriteString(d.CommentMarker + " ")
+	}
+	s.WriteString(d.ID + " " + d.Kind)
+	options := strings.TrimSpace(d.Options)
+	if canonical, ok := canonicalOptions(options, defaultOptions); ok {
+		options = canonical
+	}
+	if options != "" {
+		s.WriteString(" " + options)
+	}
+	if d.CommentCloser != "" {
+		s.WriteString(" " + d.CommentCloser)
+	}
+	return s.String()
+}
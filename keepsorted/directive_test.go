@@ -0,0 +1,127 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDirective(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		in string
+
+		want       Directive
+		wantString string
+		wantErr    bool
+	}{
+		{
+			name: "Start",
+
+			in: "  // keep-sorted start",
+
+			want:       Directive{Indent: "  ", CommentMarker: "//", ID: "keep-sorted", Kind: DirectiveStart},
+			wantString: "  // keep-sorted start",
+		},
+		{
+			name: "Options",
+
+			in: "# keep-sorted start  numeric=yes block=yes",
+
+			want:       Directive{CommentMarker: "#", ID: "keep-sorted", Kind: DirectiveStart, Options: "numeric=yes block=yes"},
+			wantString: "# keep-sorted start block=yes numeric=yes",
+		},
+		{
+			name: "ExtraSpaces",
+
+			in: "//  keep-sorted \t start   numeric=yes",
+
+			want:       Directive{CommentMarker: "//", ID: "keep-sorted", Kind: DirectiveStart, Options: "numeric=yes"},
+			wantString: "// keep-sorted start numeric=yes",
+		},
+		{
+			name: "ExtraSpaces_End",
+
+			in: "<!-- my-id   end   -->",
+
+			want:       Directive{CommentMarker: "<!--", ID: "my-id", Kind: DirectiveEnd, CommentCloser: "-->"},
+			wantString: "<!-- my-id end -->",
+		},
+		{
+			name: "CommentCloser",
+
+			in: "<!-- my-id end -->",
+
+			want:       Directive{CommentMarker: "<!--", ID: "my-id", Kind: DirectiveEnd, CommentCloser: "-->"},
+			wantString: "<!-- my-id end -->",
+		},
+		{
+			name: "UnknownOptionsAreKept",
+
+			in: "// keep-sorted start foo=bar numeric=yes",
+
+			want:       Directive{CommentMarker: "//", ID: "keep-sorted", Kind: DirectiveStart, Options: "foo=bar numeric=yes"},
+			wantString: "// keep-sorted start foo=bar numeric=yes",
+		},
+		{
+			name: "NotADirective",
+
+			in: "// keep-sorted is great",
+
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseDirective(tc.in)
+			if err != nil {
+				if !tc.wantErr {
+					t.Errorf("ParseDirective(%q) = %v", tc.in, err)
+				}
+				return
+			}
+			if tc.wantErr {
+				t.Fatalf("ParseDirective(%q) = %#v, want error", tc.in, got)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseDirective(%q) mismatch (-want +got):\n%s", tc.in, diff)
+			}
+			if s := got.String(); s != tc.wantString {
+				t.Errorf("String() = %q, want %q", s, tc.wantString)
+			}
+		})
+	}
+}
+
+func TestDirective_BlockOptions(t *testing.T) {
+	d, err := ParseDirective("// keep-sorted start numeric=yes")
+	if err != nil {
+		t.Fatalf("ParseDirective() = %v", err)
+	}
+	opts, err := d.BlockOptions()
+	if err != nil {
+		t.Fatalf("BlockOptions() = %v", err)
+	}
+	if !opts.opts.Numeric || opts.opts.commentMarker != "//" {
+		t.Errorf("BlockOptions() = %v, want numeric=yes with comment marker //", opts)
+	}
+
+	d.Options = "numeric=maybe"
+	if _, err := d.BlockOptions(); err == nil {
+		t.Errorf("BlockOptions() with %q succeeded, want error", d.Options)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Explanation is why two lines are ordered the way they are.
+type Explanation struct {
+	A, B string
+	// Negative if A sorts before B, positive if A sorts after B, and zero if
+	// they're identical.
+	Result int
+	// The step of the comparison that decided the order, e.g. "prefix_order",
+	// or the option that transformed the sort key, e.g. "numeric". Empty if the
+	// lines are identical.
+	Step string
+}
+
+func (e Explanation) String() string {
+	switch {
+	case e.Result < 0:
+		return fmt.Sprintf("%q sorts before %q because of %s", e.A, e.B, e.Step)
+	case e.Result > 0:
+		return fmt.Sprintf("%q sorts after %q because of %s", e.A, e.B, e.Step)
+	}
+	return fmt.Sprintf("%q and %q are identical", e.A, e.B)
+}
+
+// Explain compares the lines a and b with opts, as if they were the only
+// lines of two line groups in a block, and reports which step of the
+// comparison decided their order. If it was the sort key, the option that
+// transformed the key into what decided the order is reported instead, if
+// there is one. order_from is ignored, since there's no
+// file to read it from.
+func Explain(a, b string, opts BlockOptions) Explanation {
+	e := Explanation{A: a, B: b}
+	blk := block{metadata: blockMetadata{opts: opts.opts}}
+	ga, gb := lineGroup{lines: []string{a}}, lineGroup{lines: []string{b}}
+	for _, c := range blk.comparisons() {
+		if e.Result = c.cmp(ga, gb); e.Result != 0 {
+			e.Step = c.name
+			if c.name == sortKeyStep {
+				e.Step = keyStep(ga, gb, blk.metadata.opts)
+			}
+			break
+		}
+	}
+	return e
+}
+
+// keyTransform is an option that transforms the sort key.
+type keyTransform struct {
+	name string
+	// off turns the option off in opts and reports whether it was on.
+	off func(opts *blockOptions) bool
+}
+
+// keyTransforms are the options that transform the sort key, in the order
+// that sortTokens applies them.
+var keyTransforms = []keyTransform{
+	{"by_comment", func(opts *blockOptions) bool {
+		on := opts.ByComment
+		opts.ByComment = false
+		return on
+	}},
+	{"csv", func(opts *blockOptions) bool {
+		on := opts.CSV
+		opts.CSV = false
+		return on
+	}},
+	{"preset", func(opts *blockOptions) bool {
+		p, _ := opts.preset(opts.Preset)
+		opts.Preset = ""
+		return p.key != nil
+	}},
+	{"markdown", func(opts *blockOptions) bool {
+		on := opts.Markdown
+		opts.Markdown = false
+		return on
+	}},
+	{"json", func(opts *blockOptions) bool {
+		on := opts.JSON
+		opts.JSON = false
+		return on
+	}},
+	{"by_regex", func(opts *blockOptions) bool {
+		on := len(opts.ByRegex) > 0
+		opts.ByRegex, opts.ByRegexPriority = nil, nil
+		return on
+	}},
+	{"ignore_prefixes", func(opts *blockOptions) bool {
+		on := len(opts.IgnorePrefixes) > 0
+		opts.IgnorePrefixes = nil
+		return on
+	}},
+	{"case", func(opts *blockOptions) bool {
+		on := !opts.CaseSensitive
+		opts.CaseSensitive = true
+		return on
+	}},
+	{"fold_accents", func(opts *blockOptions) bool {
+		on := opts.FoldAccents
+		opts.FoldAccents = false
+		return on
+	}},
+	{"numeric", func(opts *blockOptions) bool {
+		on := opts.Numeric
+		opts.Numeric = false
+		return on
+	}},
+}
+
+// keyStep returns the name of the last option that changed how the sort keys
+// of a and b compare, as the options that transform them are applied one after
+// the other. If none did, the lines themselves decided, and sortKeyStep is
+// returned.
+func keyStep(a, b lineGroup, opts blockOptions) string {
+	plain := opts
+	var on []keyTransform
+	for _, t := range keyTransforms {
+		if t.off(&plain) {
+			on = append(on, t)
+		}
+	}
+	step, prev := sortKeyStep, compareKeys(a, b, plain)
+	for i, t := range on {
+		// Only the transforms up to and including t are on.
+		o := opts
+		for _, later := range on[i+1:] {
+			later.off(&o)
+		}
+		if r := compareKeys(a, b, o); r != prev {
+			step, prev = t.name, r
+		}
+	}
+	return step
+}
+
+// compareKeys compares the sort keys of a and b with opts.
+func compareKeys(a, b lineGroup, opts blockOptions) int {
+	regexes, priority := opts.byRegex()
+	return slices.CompareFunc(opts.sortTokens(a, regexes, priority), opts.sortTokens(b, regexes, priority), numericTokens.compare)
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExplain(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		a, b    string
+		options string
+
+		want Explanation
+	}{
+		{
+			name: "SortKey",
+
+			a: "apple", b: "banana",
+
+			want: Explanation{A: "apple", B: "banana", Result: -1, Step: "sort key"},
+		},
+		{
+			name: "Numeric",
+
+			a: "a10", b: "a9",
+			options: "numeric=yes",
+
+			want: Explanation{A: "a10", B: "a9", Result: 1, Step: "numeric"},
+		},
+		{
+			name: "Numeric_NotNeeded",
+
+			a: "a1", b: "a2",
+			options: "numeric=yes",
+
+			want: Explanation{A: "a1", B: "a2", Result: -1, Step: "sort key"},
+		},
+		{
+			name: "Case",
+
+			a: "Banana", b: "apple",
+			options: "case=no",
+
+			want: Explanation{A: "Banana", B: "apple", Result: 1, Step: "case"},
+		},
+		{
+			name: "IgnorePrefixes",
+
+			a: "const b", b: "var a",
+			options: "ignore_prefixes=const,var",
+
+			want: Explanation{A: "const b", B: "var a", Result: 1, Step: "ignore_prefixes"},
+		},
+		{
+			name: "ByRegex",
+
+			a: "a = 2", b: "b = 1",
+			options: `by_regex=\d+`,
+
+			want: Explanation{A: "a = 2", B: "b = 1", Result: 1, Step: "by_regex"},
+		},
+		{
+			name: "LastTransformWins",
+
+			a: "a10", b: "A9",
+			options: "case=no numeric=yes",
+
+			want: Explanation{A: "a10", B: "A9", Result: 1, Step: "numeric"},
+		},
+		{
+			name: "PrefixOrder",
+
+			a: "apple", b: "banana",
+			options: "prefix_order=banana",
+
+			want: Explanation{A: "apple", B: "banana", Result: 1, Step: "prefix_order"},
+		},
+		{
+			name: "TieBreaker",
+
+			a: "Apple", b: "apple",
+			options: "case=no",
+
+			want: Explanation{A: "Apple", B: "apple", Result: -1, Step: "entire lines, as a tie-breaker"},
+		},
+		{
+			name: "Identical",
+
+			a: "apple", b: "apple",
+
+			want: Explanation{A: "apple", B: "apple"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			opts, err := ParseBlockOptions(tc.options)
+			if err != nil {
+				t.Fatalf("ParseBlockOptions(%q) = %v", tc.options, err)
+			}
+			got := Explain(tc.a, tc.b, opts)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Explain(%q, %q) mismatch (-want +got):\n%s", tc.a, tc.b, diff)
+			}
+		})
+	}
+}
+
+func TestExplanation_String(t *testing.T) {
+	got := Explanation{A: "b", B: "a", Result: 1, Step: "sort key"}.String()
+	if want := `"b" sorts after "a" because of sort key`; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
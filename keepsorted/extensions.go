@@ -0,0 +1,106 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// OptionExtension defines an option that isn't built into keep-sorted, e.g.
+// to sort lines in a way that only makes sense within one organization.
+type OptionExtension struct {
+	// Key is what the option is called on the start directive, e.g.
+	// "team_order".
+	Key string
+	// Parse parses the value of the option into whatever Compare needs.
+	Parse func(value string) (any, error)
+	// Compare orders two line groups of a block that uses the option. value is
+	// what Parse returned for that block. Line groups that Compare considers
+	// equal are ordered by the built-in options.
+	Compare func(value any, a, b string) int
+}
+
+// AddOptionExtension defines an option that blocks can use in addition to the
+// built-in ones.
+func (opts *BlockOptions) AddOptionExtension(ext OptionExtension) error {
+	if !keyRegex.MatchString(ext.Key + "=") {
+		return fmt.Errorf("option %q must only contain lowercase letters and underscores", ext.Key)
+	}
+	if _, ok := fieldIndexByKey[ext.Key]; ok {
+		return fmt.Errorf("option %q is already built in", ext.Key)
+	}
+	if _, ok := opts.opts.extensions[ext.Key]; ok {
+		return fmt.Errorf("option %q was already added", ext.Key)
+	}
+	if ext.Parse == nil || ext.Compare == nil {
+		return errors.New("option extensions need both Parse and Compare")
+	}
+	opts.opts.extensions = maps.Clone(opts.opts.extensions)
+	if opts.opts.extensions == nil {
+		opts.opts.extensions = make(map[string]OptionExtension)
+	}
+	opts.opts.extensions[ext.Key] = ext
+	return nil
+}
+
+// setExtension parses the value of ext from parser.
+func (opts *blockOptions) setExtension(parser *parser, ext OptionExtension) error {
+	val, err := parser.popValue(reflect.TypeFor[string]())
+	if err != nil {
+		return warning(InvalidValue, ext.Key, "while parsing option %q: %w", ext.Key, err)
+	}
+	parsed, err := ext.Parse(val.String())
+	if err != nil {
+		return warning(InvalidValue, ext.Key, "option %q has invalid value %q: %w", ext.Key, val.String(), err)
+	}
+	// The maps may be shared with the options that these were copied from.
+	opts.extensionValues = maps.Clone(opts.extensionValues)
+	opts.extensionStrings = maps.Clone(opts.extensionStrings)
+	if opts.extensionValues == nil {
+		opts.extensionValues = make(map[string]any)
+		opts.extensionStrings = make(map[string]string)
+	}
+	opts.extensionValues[ext.Key] = parsed
+	opts.extensionStrings[ext.Key] = val.String()
+	return nil
+}
+
+// extensionsString formats the option extensions that are set, in the same
+// way as String.
+func (opts blockOptions) extensionsString() []string {
+	var s []string
+	for _, key := range slices.Sorted(maps.Keys(opts.extensionStrings)) {
+		s = append(s, fmt.Sprintf("%s=%s", key, formatString(opts.extensionStrings[key])))
+	}
+	return s
+}
+
+// extensionOrder returns a function that orders line groups with every
+// option extension that's set, in order of their keys.
+func (opts blockOptions) extensionOrder() func(a, b lineGroup) int {
+	keys := slices.Sorted(maps.Keys(opts.extensionValues))
+	return func(a, b lineGroup) int {
+		for _, key := range keys {
+			if c := opts.extensions[key].Compare(opts.extensionValues[key], a.joinedLines(), b.joinedLines()); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// File is the content of a file for FixFile, FixFiles, and FindingsFile.
+type File struct {
+	Name     string
+	Contents string
+	// The lines that were modified, as with Fix. If nil, the entire file is
+	// considered.
+	ModifiedLines []LineRange
+	// If non-nil, these options are applied on top of the default options of
+	// the Fixer for this file, the way the options of a start directive are,
+	// e.g. to honor the settings of a single request in a server that shares
+	// one Fixer.
+	Options *BlockOptions
+	// If true, FindingsFile leaves out the fixes, for callers that only need to
+	// know whether there are any findings. That's quicker, because the blocks
+	// that are out of order don't need to be sorted. FixFile ignores NoFixes.
+	NoFixes bool
+}
+
+// forFile returns the Fixer that handles file, which is f unless file
+// overrides the default options.
+func (f *Fixer) forFile(file File) *Fixer {
+	if file.Options == nil {
+		return f
+	}
+	g := *f
+	g.defaultOptions = f.defaultOptions.override(file.Options.opts)
+	g.aliases = nil
+	for _, a := range f.aliases {
+		b := *a
+		b.defaultOptions = a.defaultOptions.override(file.Options.opts)
+		g.aliases = append(g.aliases, &b)
+	}
+	return &g
+}
+
+// FileResult is what FixFile did with a File. Apart from Stats, the fields
+// are the return values of FixContext for that file.
+type FileResult struct {
+	Fixed          string
+	AlreadyCorrect bool
+	Warnings       []*Finding
+	Stats          FixStats
+	Err            error
+}
+
+// FixStats counts the changes that fixing a file made.
+type FixStats struct {
+	// The number of blocks that were out of order.
+	BlocksSorted int
+	// The number of line groups that had to move to put their blocks in order.
+	GroupsMoved int
+	// The number of duplicate line groups that were removed.
+	DuplicatesRemoved int
+}
+
+func (s *FixStats) add(other FixStats) {
+	s.BlocksSorted += other.BlocksSorted
+	s.GroupsMoved += other.GroupsMoved
+	s.DuplicatesRemoved += other.DuplicatesRemoved
+}
+
+// FixFiles fixes files with up to concurrency goroutines at a time, or with
+// runtime.GOMAXPROCS(0) if concurrency isn't positive. The results are in the
+// same order as files. Once ctx is done, the files that haven't been fixed
+// yet have ctx.Err() as their Err.
+//
+// A Fixer is safe to use from multiple goroutines, so calling FixFile
+// from goroutines of your own works just as well. FixFiles is merely a
+// convenience for the common case.
+func (f *Fixer) FixFiles(ctx context.Context, files []File, concurrency int) []FileResult {
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	results := make([]FileResult, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(concurrency, len(files)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = f.FixFile(ctx, files[i])
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
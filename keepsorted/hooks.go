@@ -0,0 +1,70 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"slices"
+)
+
+// LineGroup is a group of lines that keep-sorted moves around as a unit, e.g.
+// a line and the lines that continue it.
+type LineGroup struct {
+	// The sticky comments above Lines, which move together with them.
+	Comment []string
+	// The lines that the group is sorted by.
+	Lines []string
+}
+
+// SortHooks let callers change the line groups of every block while it's
+// sorted. Either hook may be nil. The blocks of a file are sorted concurrently,
+// so the hooks must be safe to call from multiple goroutines.
+type SortHooks struct {
+	// BeforeSort runs right after the lines of a block are split into groups,
+	// before anything else is done with them.
+	BeforeSort func(groups []LineGroup) []LineGroup
+	// AfterSort runs after the groups are sorted and the blank lines between
+	// them are put back, right before the block is written out.
+	AfterSort func(groups []LineGroup) []LineGroup
+}
+
+// AddSortHooks adds hooks that run every time a block is sorted, after the
+// hooks that were added before.
+func (opts *BlockOptions) AddSortHooks(h SortHooks) {
+	opts.opts.hooks = append(slices.Clip(opts.opts.hooks), h)
+}
+
+// runHooks passes groups through the hook that hook selects from every
+// SortHooks in hooks.
+func runHooks(hooks []SortHooks, hook func(SortHooks) func([]LineGroup) []LineGroup, groups []lineGroup) []lineGroup {
+	for _, h := range hooks {
+		fn := hook(h)
+		if fn == nil {
+			continue
+		}
+		lgs := make([]LineGroup, len(groups))
+		for i, lg := range groups {
+			lgs[i] = LineGroup{Comment: slices.Clone(lg.comment), Lines: slices.Clone(lg.lines)}
+		}
+		lgs = fn(lgs)
+		groups = make([]lineGroup, len(lgs))
+		for i, lg := range lgs {
+			groups[i] = lineGroup{comment: lg.Comment, lines: lg.Lines}
+		}
+	}
+	return groups
+}
+
+func beforeSort(h SortHooks) func([]LineGroup) []LineGroup { return h.BeforeSort }
+func afterSort(h SortHooks) func([]LineGroup) []LineGroup  { return h.AfterSort }
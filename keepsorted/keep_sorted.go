@@ -16,52 +16,439 @@ package keepsorted
 
 import (
 	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"runtime"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/Workiva/go-datastructures/augmentedtree"
 )
 
 const (
-	errorUnordered = "These lines are out of order."
+	errorUnordered           = "These lines are out of order."
+	errorNonCanonicalOptions = "The options of this directive aren't sorted and formatted consistently."
+	errorTrivialBlock        = "This block has fewer than two elements, so there's nothing to keep sorted."
+	errorNestedUntilDedent   = "until=dedent may not be used inside another block."
+	errorCRLineEndings       = "This file has CR line endings, which aren't recognized, so none of its blocks are sorted."
+	errorUnstableSort        = "These lines are out of order, but sorting them again would change them again, so they aren't sorted automatically. Please report this along with the options of this block."
+	errorUnbalancedSort      = "These lines are out of order, but sorting them would change which braces and quotes match up, so they aren't sorted automatically."
 )
 
-func errorMissingDirective(id, dir string) string {
-	return fmt.Sprintf("This instruction doesn't have matching '%s %s' line. %s will not attempt to sort anything until this is addressed.", id, dir, id)
+func errorMissingDirective(id, directive string) string {
+	return fmt.Sprintf("This instruction doesn't have matching '%s' line. %s will not attempt to sort anything until this is addressed.", directive, id)
+}
+
+func errorDuplicate(originalLine int) string {
+	return fmt.Sprintf("This is a duplicate of line %d.", originalLine)
+}
+
+func errorCommentDuplicate(originalLine int) string {
+	return fmt.Sprintf("This is the same as line %d except for its comment, so both are kept. Merge the comments, or remove one of them.", originalLine)
+}
+
+func errorDuplicateKey(originalLine int) string {
+	return fmt.Sprintf("This has the same key as line %d, but a different value.", originalLine)
+}
+
+func errorEndDirectiveOptions(id string) string {
+	return fmt.Sprintf("Options on the '%s end' line are ignored. They belong on the '%s start' line.", id, id)
+}
+
+func errorAlias(id string) string {
+	return fmt.Sprintf("This directive should use %q instead.", id)
+}
+
+func errorDirectiveAfterCode(id string) string {
+	return fmt.Sprintf("This directive comes after code on the same line, so %s ignores it. Put it in a comment of its own, or add after_code=yes.", id)
+}
+
+func errorLateFileOptions(id string) string {
+	return fmt.Sprintf("This '%s options:' pragma comes after another directive, so %s ignores it. Move it above the first block.", id, id)
+}
+
+func errorSkipLinesSplitsGroup(n int) string {
+	return fmt.Sprintf("skip_lines=%d ends in the middle of a group of lines, e.g. between a sticky comment and the line it belongs to, so this block isn't sorted.", n)
+}
+
+func errorRegexMatchesNothing(re string) string {
+	return fmt.Sprintf("The by_regex pattern %q doesn't match anything in this block, so it has no effect.", re)
+}
+
+func errorOddIndentation(r rune) string {
+	return fmt.Sprintf("This line is indented with %U, which counts as a single space, so it might not be grouped the way it looks. Indent it with spaces or tabs instead.", r)
+}
+
+func errorMixedLineEndings(endings string) string {
+	return fmt.Sprintf("This file mixes line endings (%s). Every line keeps its line ending when it's sorted, so they might end up in unexpected places.", endings)
+}
+
+func errorDirectiveIndentation(start int) string {
+	return fmt.Sprintf("This end directive isn't indented like the start directive on line %d, so the block might not end where it looks like it does.", start)
+}
+
+func errorDuplicateName(name string) string {
+	return fmt.Sprintf("There's already a block named %q.", name)
+}
+
+func errorUnknownName(name string) string {
+	return fmt.Sprintf("There's no block named %q to take the order from.", name)
+}
+
+func errorRegexTooExpensive(n int) string {
+	return fmt.Sprintf("Matching by_regex against the %d lines of this block would take too long, so it isn't sorted. Try simpler regular expressions, or split up the block.", n)
+}
+
+func errorTornApart(suggestion string) string {
+	return fmt.Sprintf("These lines are out of order, but it looks like sorting them would tear apart code that spans multiple lines, so they aren't sorted automatically. Try %s.", suggestion)
+}
+
+func errorDifferentElements(n int, name string, other int) string {
+	return fmt.Sprintf("This block has %d elements, but block %q has %d, so they can't be kept in the same order.", n, name, other)
 }
 
 // Fixer runs the business logic of keep-sorted.
+//
+// A Fixer doesn't change once it's created, so it's safe to use from multiple
+// goroutines at once, as long as any hooks and option extensions that its
+// options have are as well.
 type Fixer struct {
 	ID string
 
-	defaultOptions blockOptions
-	startDirective string
-	endDirective   string
+	defaultOptions  blockOptions
+	startDirective  string
+	endDirective    string
+	optionDirective string
+	// One-shot directives that don't need an end directive.
+	nextDirective       string
+	untilBlankDirective string
+	fileDirective       string
+	// Marks a line group that stays where it is while its block is sorted.
+	pinDirective string
+	// Directives between off and on are ignored.
+	offDirective string
+	onDirective  string
+	// Changes the default options for every block in the file.
+	fileOptionsDirective string
+	// Turns keep-sorted off for the entire file.
+	disableFileDirective string
+
+	// Fixers for other identifiers that are recognized in addition to ID.
+	aliases []*Fixer
+	// The start and end directives of the other Fixers that run on the same
+	// files. Blocks of theirs that are nested in a block of this Fixer are kept
+	// together.
+	otherStartDirectives, otherEndDirectives []string
+	// Whether Fix replaces the aliases with ID.
+	rewriteAliases bool
+	// Whether the directives in the fenced code blocks of Markdown files are
+	// ignored.
+	ignoreMarkdownFences bool
+	// The kinds of fixes that are applied automatically, or nil for all of them.
+	fixOnly map[FixKind]bool
+	// Reads the files that blocks refer to, e.g. with order_from.
+	readFile func(name string) ([]byte, error)
 }
 
 // New creates a new fixer with the given string as its identifier.
 // By default, id is "keep-sorted"
 func New(id string, defaultOptions BlockOptions) *Fixer {
 	return &Fixer{
-		ID:             id,
-		defaultOptions: defaultOptions.opts,
-		startDirective: id + " start",
-		endDirective:   id + " end",
+		ID:                   id,
+		defaultOptions:       defaultOptions.opts,
+		startDirective:       id + " start",
+		endDirective:         id + " end",
+		optionDirective:      id + " option:",
+		nextDirective:        id + " next",
+		untilBlankDirective:  id + " until-blank",
+		fileDirective:        id + " file",
+		pinDirective:         id + ": pin",
+		offDirective:         id + " off",
+		onDirective:          id + " on",
+		fileOptionsDirective: id + " options:",
+		disableFileDirective: id + " disable-file",
+		readFile:             os.ReadFile,
+	}
+}
+
+// NewFixer is like New, but returns an error if id isn't a valid identifier.
+// See ValidateID.
+func NewFixer(id string, defaultOptions BlockOptions) (*Fixer, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+	return New(id, defaultOptions), nil
+}
+
+var validID = regexp.MustCompile(`^\pL[\pL\pN_.-]*$`)
+
+// ValidateID returns an error if id can't be used as the identifier of a
+// Fixer. Identifiers start with a letter, which can be followed by letters,
+// digits, hyphens, underscores, and dots. Anything else, like whitespace or a
+// comment marker, would make directives match in unexpected places, or not at
+// all.
+func ValidateID(id string) error {
+	if !validID.MatchString(id) {
+		return fmt.Errorf("invalid identifier %q: it must start with a letter, followed by letters, digits, '-', '_', or '.'", id)
+	}
+	return nil
+}
+
+// WithAliases returns a copy of f that also recognizes directives that use
+// one of aliases instead of f.ID, e.g. an identifier from before a migration.
+// If rewrite is true, Fix replaces the aliases with f.ID, and Findings reports
+// every directive that still uses one.
+func (f *Fixer) WithAliases(aliases []string, rewrite bool) *Fixer {
+	g := *f
+	g.aliases = nil
+	for _, id := range aliases {
+		g.aliases = append(g.aliases, New(id, BlockOptions{f.defaultOptions}))
+	}
+	g.rewriteAliases = rewrite
+	return &g
+}
+
+// WithDirectives returns a copy of f that uses start and end as its start
+// and end directives instead of the ones based on f.ID, e.g. to take over files
+// that were annotated for another tool.
+func (f *Fixer) WithDirectives(start, end string) (*Fixer, error) {
+	if start == "" || end == "" {
+		return nil, errors.New("start and end directives cannot be empty")
+	}
+	if strings.Contains(start, end) || strings.Contains(end, start) {
+		return nil, fmt.Errorf("start directive %q and end directive %q cannot contain each other", start, end)
+	}
+	g := *f
+	g.startDirective = start
+	g.endDirective = end
+	return &g, nil
+}
+
+// WithMarkdownFences returns a copy of f that ignores the directives in the
+// fenced code blocks (``` or ~~~) of Markdown files if ignore is true, e.g. so
+// that the examples in a README aren't sorted. Otherwise, they're recognized
+// like any other directive, which is the default.
+func (f *Fixer) WithMarkdownFences(ignore bool) *Fixer {
+	g := *f
+	g.ignoreMarkdownFences = ignore
+	g.aliases = nil
+	for _, a := range f.aliases {
+		g.aliases = append(g.aliases, a.WithMarkdownFences(ignore))
+	}
+	return &g
+}
+
+// WithReadFile returns a copy of f that reads the files that blocks refer to,
+// e.g. with order_from, with readFile instead of os.ReadFile.
+func (f *Fixer) WithReadFile(readFile func(name string) ([]byte, error)) *Fixer {
+	g := *f
+	g.readFile = readFile
+	g.aliases = nil
+	for _, a := range f.aliases {
+		g.aliases = append(g.aliases, a.WithReadFile(readFile))
+	}
+	return &g
+}
+
+// WithFixOnly returns a copy of f that only applies the fixes of the given
+// kinds automatically. The other findings are reported as warnings instead,
+// like the findings of blocks with enforce=lint.
+func (f *Fixer) WithFixOnly(kinds []FixKind) (*Fixer, error) {
+	only := make(map[FixKind]bool)
+	for _, k := range kinds {
+		if !slices.Contains(FixKinds, k) {
+			return nil, fmt.Errorf("unknown kind of fix %q. Valid kinds: %q", k, FixKinds)
+		}
+		only[k] = true
+	}
+	g := *f
+	g.fixOnly = only
+	g.aliases = nil
+	for _, a := range f.aliases {
+		a, _ := a.WithFixOnly(kinds)
+		g.aliases = append(g.aliases, a)
+	}
+	return &g, nil
+}
+
+// fixes reports whether the fixes of kind k are applied automatically.
+func (f *Fixer) fixes(k FixKind) bool {
+	return f.fixOnly == nil || f.fixOnly[k]
+}
+
+// mayHaveDirectives reports whether contents could contain any directive of f
+// or its aliases. Most files don't, and this is a lot quicker than looking for
+// them line by line.
+func (f *Fixer) mayHaveDirectives(contents string) bool {
+	for _, g := range append([]*Fixer{f}, f.aliases...) {
+		// Every directive but the start and end directives contains the ID, and
+		// those only don't when they were changed with WithDirectives.
+		if strings.Contains(contents, g.ID) || strings.Contains(contents, g.startDirective) || strings.Contains(contents, g.endDirective) {
+			return true
+		}
+	}
+	return false
+}
+
+// directives returns all of the directives of f, in the same order for every
+// Fixer.
+func (f *Fixer) directives() []string {
+	return []string{
+		f.startDirective,
+		f.endDirective,
+		f.optionDirective,
+		f.nextDirective,
+		f.untilBlankDirective,
+		f.fileDirective,
+		f.pinDirective,
+		f.offDirective,
+		f.onDirective,
+		f.fileOptionsDirective,
+		f.disableFileDirective,
+	}
+}
+
+// knowEachOther returns copies of fixers that know the start and end
+// directives of the others, so that none of them tears apart the blocks of
+// another.
+func knowEachOther(fixers []*Fixer) []*Fixer {
+	if len(fixers) < 2 {
+		return fixers
 	}
+	ret := make([]*Fixer, len(fixers))
+	for i, f := range fixers {
+		g := *f
+		g.otherStartDirectives, g.otherEndDirectives = nil, nil
+		for j, other := range fixers {
+			if j != i {
+				g.otherStartDirectives = append(g.otherStartDirectives, other.startDirective)
+				g.otherEndDirectives = append(g.otherEndDirectives, other.endDirective)
+			}
+		}
+		ret[i] = &g
+	}
+	return ret
+}
+
+// replaceAliases replaces the directives in lines that use an alias with the
+// ones that use f.ID. It returns the indexes of the lines that changed.
+func (f *Fixer) replaceAliases(lines []string) (replaced []int) {
+	want := f.directives()
+	for i, l := range lines {
+		for _, a := range f.aliases {
+			for j, d := range a.directives() {
+				if containsWord(l, d) {
+					l = strings.Replace(l, d, want[j], 1)
+				}
+			}
+		}
+		if l != lines[i] {
+			lines[i] = l
+			replaced = append(replaced, i)
+		}
+	}
+	return replaced
 }
 
 // Fix all of the findings on contents to make keep-sorted happy.
 func (f *Fixer) Fix(filename, contents string, modifiedLines []LineRange) (fixed string, alreadyCorrect bool, warnings []*Finding) {
+	// The background context is never canceled, so there's no error.
+	fixed, alreadyCorrect, warnings, _ = f.FixContext(context.Background(), filename, contents, modifiedLines)
+	return fixed, alreadyCorrect, warnings
+}
+
+// FixContext is like Fix, but stops early and returns ctx.Err() once ctx is
+// done.
+func (f *Fixer) FixContext(ctx context.Context, filename, contents string, modifiedLines []LineRange) (fixed string, alreadyCorrect bool, warnings []*Finding, err error) {
+	r := f.FixFile(ctx, File{Name: filename, Contents: contents, ModifiedLines: modifiedLines})
+	return r.Fixed, r.AlreadyCorrect, r.Warnings, r.Err
+}
+
+// FixFile is like FixContext, but takes a File, which can override the
+// default options, and also returns statistics about what was fixed.
+func (f *Fixer) FixFile(ctx context.Context, file File) FileResult {
+	if !f.mayHaveDirectives(file.Contents) {
+		return FileResult{Fixed: file.Contents, AlreadyCorrect: true}
+	}
+	f = f.forFile(file)
+	filename, contents, modifiedLines := file.Name, file.Contents, file.ModifiedLines
+	var r FileResult
+	fixers := []*Fixer{f}
+	alreadyCorrect := true
+	if f.rewriteAliases && !f.fixes(FixAliases) {
+		for _, i := range f.replaceAliases(strings.Split(contents, "\n")) {
+			r.Warnings = append(r.Warnings, finding(filename, i+1, i+1, errorAlias(f.ID)))
+			alreadyCorrect = false
+		}
+		fixers = knowEachOther(append(fixers, f.aliases...))
+	} else if f.rewriteAliases {
+		lines := strings.Split(contents, "\n")
+		if len(f.replaceAliases(lines)) > 0 {
+			contents = strings.Join(lines, "\n")
+			alreadyCorrect = false
+		}
+	} else {
+		fixers = knowEachOther(append(fixers, f.aliases...))
+	}
+
+	if w := lineEndingsFinding(filename, contents, fixers); w != nil {
+		r.Warnings = append(r.Warnings, w)
+	}
+	r.Fixed = contents
+	for _, fixer := range fixers {
+		var ok bool
+		var w []*Finding
+		var stats FixStats
+		var err error
+		r.Fixed, ok, w, stats, err = fixer.fix(ctx, filename, r.Fixed, modifiedLines)
+		if err != nil {
+			return FileResult{Err: err}
+		}
+		alreadyCorrect = alreadyCorrect && ok
+		r.Warnings = append(r.Warnings, w...)
+		r.Stats.add(stats)
+	}
+	r.AlreadyCorrect = alreadyCorrect
+	return r
+}
+
+func (f *Fixer) fix(ctx context.Context, filename, contents string, modifiedLines []LineRange) (fixed string, alreadyCorrect bool, warnings []*Finding, stats FixStats, _ error) {
+	// A block that goes all the way to the end of a file without a final line
+	// break, e.g. keep-sorted next, would otherwise move its last line without
+	// a line ending. It's sorted as if the file ended with the same line ending
+	// as the rest of it, which is taken away again afterwards.
+	var missing string
+	if !strings.HasSuffix(contents, "\n") {
+		missing = "\n"
+		if i := strings.LastIndexByte(contents, '\n'); i > 0 && contents[i-1] == '\r' {
+			missing = "\r\n"
+		}
+		contents += missing
+	}
 	lines := strings.Split(contents, "\n")
-	findings := f.findings(filename, lines, modifiedLines)
+	findings, err := f.findings(ctx, filename, lines, modifiedLines, false)
+	if err != nil {
+		return "", false, nil, FixStats{}, err
+	}
 	if len(findings) == 0 {
-		return contents, true, nil
+		return strings.TrimSuffix(contents, missing), true, nil, FixStats{}, nil
 	}
 
+	// The lines between the fixes are copied straight from contents, which is
+	// a lot cheaper than joining them back together.
+	offsets := lineOffsets(lines)
 	var s strings.Builder
+	s.Grow(len(contents))
 	startLine := 1
 	for _, finding := range findings {
+		if finding.lintOnly {
+			continue
+		}
+
 		var fix *Fix
 		for _, f := range finding.Fixes {
 			if !f.automatic {
@@ -83,14 +470,30 @@ func (f *Fixer) Fix(filename, contents string, modifiedLines []LineRange) (fixed
 		endLine := repl.Lines.Start
 
 		// -1 to convert line number to index number.
-		s.WriteString(linesToString(lines[startLine-1 : endLine-1]))
+		if startLine < endLine {
+			s.WriteString(contents[offsets[startLine-1]:offsets[endLine-1]])
+		}
 		s.WriteString(repl.NewContent)
+		stats.add(finding.stats)
 
 		startLine = repl.Lines.End + 1
 	}
-	s.WriteString(strings.Join(lines[startLine-1:], "\n"))
+	s.WriteString(contents[min(offsets[startLine-1], len(contents)):])
 
-	return s.String(), false, warnings
+	fixed = strings.TrimSuffix(s.String(), missing)
+	return fixed, false, warnings, stats, nil
+}
+
+// lineOffsets returns the offset of every line of lines, which is the result
+// of splitting some contents on "\n", within those contents. There's one more
+// offset than there are lines, for where the line after the last one would
+// start.
+func lineOffsets(lines []string) []int {
+	offsets := make([]int, len(lines)+1)
+	for i, l := range lines {
+		offsets[i+1] = offsets[i] + len(l) + 1
+	}
+	return offsets
 }
 
 // Findings returns a slice of things that need to be addressed in the file to
@@ -99,7 +502,97 @@ func (f *Fixer) Fix(filename, contents string, modifiedLines []LineRange) (fixed
 // If modifiedLines is non-nil, we only report findings for issues within the
 // modified lines. Otherwise, we report all findings.
 func (f *Fixer) Findings(filename, contents string, modifiedLines []LineRange) []*Finding {
-	return f.findings(filename, strings.Split(contents, "\n"), modifiedLines)
+	// The background context is never canceled, so there's no error.
+	fs, _ := f.FindingsContext(context.Background(), filename, contents, modifiedLines)
+	return fs
+}
+
+// FindingsContext is like Findings, but stops early and returns ctx.Err()
+// once ctx is done.
+func (f *Fixer) FindingsContext(ctx context.Context, filename, contents string, modifiedLines []LineRange) ([]*Finding, error) {
+	return f.FindingsFile(ctx, File{Name: filename, Contents: contents, ModifiedLines: modifiedLines})
+}
+
+// HasBlocks reports whether file has any complete block of f or of one of its
+// aliases, whether or not it's sorted.
+func (f *Fixer) HasBlocks(file File) bool {
+	if !f.mayHaveDirectives(file.Contents) {
+		return false
+	}
+	f = f.forFile(file)
+	lines := strings.Split(file.Contents, "\n")
+	include := includeModifiedLines(file.ModifiedLines)
+	for _, g := range append([]*Fixer{f}, f.aliases...) {
+		if blocks, _, _ := g.newBlocks(file.Name, lines, 1, include); len(blocks) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// FindingsFile is like FindingsContext, but takes a File, which can override
+// the default options.
+func (f *Fixer) FindingsFile(ctx context.Context, file File) ([]*Finding, error) {
+	if !f.mayHaveDirectives(file.Contents) {
+		return nil, nil
+	}
+	f = f.forFile(file)
+	filename, modifiedLines := file.Name, file.ModifiedLines
+	lines := strings.Split(file.Contents, "\n")
+	var fs []*Finding
+	fixers := []*Fixer{f}
+	if f.rewriteAliases {
+		for _, i := range f.replaceAliases(lines) {
+			fix := replacement(i+1, i+1, lines[i]+"\n")
+			fix.automatic = f.fixes(FixAliases)
+			fs = append(fs, finding(filename, i+1, i+1, errorAlias(f.ID), fix))
+		}
+		if !f.fixes(FixAliases) {
+			fixers = knowEachOther(append(fixers, f.aliases...))
+		}
+	} else {
+		fixers = knowEachOther(append(fixers, f.aliases...))
+	}
+
+	if w := lineEndingsFinding(filename, file.Contents, fixers); w != nil {
+		fs = append(fs, w)
+	}
+	for _, fixer := range fixers {
+		more, err := fixer.findings(ctx, filename, lines, modifiedLines, file.NoFixes)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, more...)
+	}
+	slices.SortStableFunc(fs, func(a, b *Finding) int {
+		return cmp.Compare(startLine(a), startLine(b))
+	})
+	if file.NoFixes {
+		for _, finding := range fs {
+			finding.Fixes = nil
+		}
+	}
+	return fs, nil
+}
+
+// SortLines sorts lines like a keep-sorted block with opts would, without
+// needing any directives. It returns lines itself, and true, if they're
+// already sorted. Sticky comments need a comment_marker, since there's no
+// start directive to guess it from.
+func SortLines(lines []string, opts BlockOptions) (sorted []string, alreadySorted bool) {
+	o := opts.opts
+	if o.CommentMarker != "" {
+		o.setCommentMarker(o.CommentMarker)
+	}
+	b := block{
+		metadata: blockMetadata{opts: o},
+		// Sorting can change the lines in place before putting them back.
+		lines: slices.Clone(lines),
+	}
+	if sorted, alreadySorted = b.sorted(); alreadySorted {
+		return lines, true
+	}
+	return sorted, false
 }
 
 // Finding is something that keep-sorted thinks is wrong with a particular file.
@@ -115,8 +608,40 @@ type Finding struct {
 	// and should not all be applied.
 	// At most one of these Fixes may have Fix.automatic set to true.
 	Fixes []Fix `json:"fixes"`
+	// If this finding is about the options of a block, a structured form of
+	// the problem.
+	Warning *Warning `json:"warning,omitempty"`
+
+	// Whether this finding is only reported by Fixer.Findings. Fixer.Fix
+	// neither applies nor warns about it, typically because another finding's
+	// automatic fix already addresses the problem.
+	lintOnly bool
+	// What applying the automatic fix does.
+	stats FixStats
+	// What kind of fix the automatic fix is, if there is one.
+	kind FixKind
 }
 
+// FixKind is a kind of automatic fix. See Fixer.WithFixOnly.
+type FixKind string
+
+const (
+	// FixUnordered sorts the blocks that are out of order.
+	FixUnordered FixKind = "unordered"
+	// FixDuplicates removes the duplicates that are reported on their own with
+	// report_duplicates=yes.
+	FixDuplicates FixKind = "duplicates"
+	// FixNormalizeDirectives rewrites the options of start directives in
+	// canonical form, for canonicalize=yes.
+	FixNormalizeDirectives FixKind = "normalize-directives"
+	// FixAliases replaces the identifiers from Fixer.WithAliases, if they're
+	// rewritten.
+	FixAliases FixKind = "aliases"
+)
+
+// FixKinds are all kinds of automatic fixes.
+var FixKinds = []FixKind{FixUnordered, FixDuplicates, FixNormalizeDirectives, FixAliases}
+
 // LineRange is a 1-based range of continuous lines within a file.
 // Both start and end are inclusive.
 // You can designate a single line by setting start and end to the same line number.
@@ -142,7 +667,10 @@ type Replacement struct {
 	NewContent string    `json:"new_content"`
 }
 
-func (f *Fixer) findings(filename string, contents []string, modifiedLines []LineRange) []*Finding {
+// findings returns the findings for the blocks in contents. If noFixes is
+// true, the findings for blocks that are out of order don't have a fix, which
+// saves sorting them.
+func (f *Fixer) findings(ctx context.Context, filename string, contents []string, modifiedLines []LineRange, noFixes bool) ([]*Finding, error) {
 	blocks, incompleteBlocks, warns := f.newBlocks(filename, contents, 1, includeModifiedLines(modifiedLines))
 
 	var fs []*Finding
@@ -153,27 +681,309 @@ func (f *Fixer) findings(filename string, contents []string, modifiedLines []Lin
 		var msg string
 		switch ib.dir {
 		case startDirective:
-			msg = errorMissingDirective(f.ID, "end")
+			msg = errorMissingDirective(f.ID, f.endDirective)
 		case endDirective:
-			msg = errorMissingDirective(f.ID, "start")
+			msg = errorMissingDirective(f.ID, f.startDirective)
 		default:
 			panic(fmt.Errorf("unknown directive type: %v", ib.dir))
 		}
 		fs = append(fs, finding(filename, ib.line, ib.line, msg, replacement(ib.line, ib.line, "")))
 	}
 
-	for _, b := range blocks {
-		if s, alreadySorted := b.sorted(); !alreadySorted {
-			repl := replacement(b.start+1, b.end-1, linesToString(s))
-			// Only try to automatically sort things if there are no incomplete blocks.
-			repl.automatic = len(incompleteBlocks) == 0
-			fs = append(fs, finding(filename, b.start+1, b.end-1, errorUnordered, repl))
+	all := allBlocks(blocks)
+	for _, b := range all {
+		if b.metadata.opts.ReportTrivial && b.numElements() < 2 {
+			fs = append(fs, finding(filename, b.start, b.end, errorTrivialBlock))
+		}
+	}
+
+	named := make(map[string]block)
+	for _, b := range all {
+		if name := b.metadata.opts.Name; name != "" {
+			if _, ok := named[name]; ok {
+				fs = append(fs, finding(filename, b.start, b.start, errorDuplicateName(name)))
+				continue
+			}
+			named[name] = b
+		}
+	}
+
+	// Top-level blocks don't depend on each other, so they're sorted
+	// concurrently. Their findings are collected in order so that the result
+	// doesn't depend on which block finishes first.
+	perBlock := make([][]*Finding, len(blocks))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(runtime.GOMAXPROCS(0), len(blocks)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if ctx.Err() == nil {
+					perBlock[i] = blockFindings(filename, blocks[i], named, len(incompleteBlocks) == 0, noFixes)
+				}
+			}
+		}()
+	}
+	for i := range blocks {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, bfs := range perBlock {
+		fs = append(fs, bfs...)
+	}
+
+	for _, fd := range fs {
+		if fd.kind != "" && !f.fixes(fd.kind) {
+			for i := range fd.Fixes {
+				fd.Fixes[i].automatic = false
+			}
 		}
 	}
 
 	slices.SortFunc(fs, func(a, b *Finding) int {
 		return cmp.Compare(startLine(a), startLine(b))
 	})
+	return fs, nil
+}
+
+// lineEndingsFinding returns a finding about the line endings of contents if
+// they aren't all the same, or if they're CR line endings, as long as any of
+// fixers has directives in it.
+func lineEndingsFinding(filename, contents string, fixers []*Fixer) *Finding {
+	if !strings.Contains(contents, "\r") {
+		return nil
+	}
+	lines := strings.Split(contents, "\n")
+	msg, ok := lineEndingsMessage(lines)
+	if !ok || !slices.ContainsFunc(fixers, func(g *Fixer) bool { return len(g.directiveLines(lines)) > 0 }) {
+		return nil
+	}
+	return finding(filename, 1, 1, msg)
+}
+
+// lineEndingsMessage returns a message about the line endings of lines if
+// they aren't all the same, or if they're CR line endings, which aren't
+// recognized.
+func lineEndingsMessage(lines []string) (string, bool) {
+	var crlf, lf, cr int
+	for i, l := range lines {
+		if strings.IndexByte(l, '\r') < 0 {
+			if i < len(lines)-1 {
+				lf++
+			}
+			continue
+		}
+		n := strings.Count(l, "\r")
+		if i < len(lines)-1 && strings.HasSuffix(l, "\r") {
+			crlf++
+			n--
+		} else if i < len(lines)-1 {
+			lf++
+		}
+		cr += n
+	}
+	if cr > 0 && crlf == 0 && lf == 0 {
+		return errorCRLineEndings, true
+	}
+	var endings []string
+	for _, e := range []struct {
+		name string
+		n    int
+	}{{"CRLF", crlf}, {"LF", lf}, {"CR", cr}} {
+		if e.n > 0 {
+			endings = append(endings, fmt.Sprintf("%d %s", e.n, e.name))
+		}
+	}
+	if len(endings) < 2 {
+		return "", false
+	}
+	return errorMixedLineEndings(strings.Join(endings, ", ")), true
+}
+
+// blockFindings returns the findings for the top-level block b. named are the
+// blocks with a name, for same_order_as. If automatic is false, none of the
+// fixes are applied automatically. If noFixes is true, an out of order block
+// is reported without sorting it.
+func blockFindings(filename string, b block, named map[string]block, automatic, noFixes bool) []*Finding {
+	// Sorting b sorts the blocks nested in it, too.
+	for _, n := range allBlocks([]block{b}) {
+		if n.metadata.opts.regexCost(n.lines) > maxRegexCost {
+			return []*Finding{finding(filename, n.start, n.start, errorRegexTooExpensive(len(n.lines)))}
+		}
+	}
+
+	fs := oddIndentationFindings(filename, b)
+	fs = append(fs, regexCoverageFindings(filename, b)...)
+	fs = append(fs, commentDuplicateFindings(filename, b)...)
+	var s []string
+	var alreadySorted bool
+	stable := true
+	if name := b.metadata.opts.SameOrderAs; name != "" {
+		other, ok := named[name]
+		if !ok {
+			return []*Finding{finding(filename, b.start, b.start, errorUnknownName(name))}
+		}
+		order := other.order()
+		if n := b.numElements(); n != len(order) {
+			return []*Finding{finding(filename, b.start, b.end, errorDifferentElements(n, name, len(order)))}
+		}
+		s, alreadySorted = b.sortedLike(order)
+	} else if noFixes {
+		alreadySorted = b.isSorted()
+	} else {
+		s, alreadySorted, stable = b.sortedStable()
+	}
+
+	var dups, conflicts []*Finding
+	if b.metadata.opts.SameOrderAs == "" && (b.metadata.opts.ReportDuplicates || b.metadata.opts.DedupeKeys) {
+		// Keys with different values are always worth a warning, since
+		// removing them loses information. They're never removed
+		// automatically, so Fix reports them as warnings.
+		dups, conflicts = duplicateFindings(filename, b, !b.metadata.opts.ReportDuplicates)
+		fs = append(fs, conflicts...)
+	}
+	if len(dups) > 0 {
+		withDups := b
+		withDups.metadata.opts.RemoveDuplicates = false
+		if withDups.isSorted() {
+			// Duplicates are the only problem with this block. Report them
+			// instead of a finding for the entire block.
+			for _, dup := range dups {
+				dup.Fixes[0].automatic = automatic && b.metadata.opts.Enforce != enforceLint
+				dup.kind = FixDuplicates
+				dup.stats = FixStats{DuplicatesRemoved: 1}
+			}
+			alreadySorted = true
+		} else {
+			// The finding for the entire block removes the duplicates as well.
+			for _, dup := range dups {
+				dup.lintOnly = true
+			}
+		}
+		fs = append(fs, dups...)
+	}
+
+	msg := errorUnordered
+	torn := false
+	if !alreadySorted {
+		if suggestion, ok := b.tornApart(); ok {
+			msg = errorTornApart(suggestion)
+			torn = true
+		} else if s != nil && balanceOf(s, b.metadata.opts) != balanceOf(b.lines, b.metadata.opts) {
+			// The grouping probably misfired on some unusual syntax.
+			msg = errorUnbalancedSort
+			torn = true
+		} else if !stable {
+			// Applying the fix would make the next run want to fix it again.
+			msg = errorUnstableSort
+			torn = true
+		}
+	}
+	if !alreadySorted && noFixes {
+		fs = append(fs, finding(filename, b.start+1, b.end-1, msg))
+	} else if !alreadySorted {
+		repl := replacement(b.start+1, b.end-1, linesToString(s))
+		// Only try to automatically sort things if there are no incomplete blocks,
+		// the block wants to be fixed, and sorting it doesn't look destructive.
+		repl.automatic = automatic && b.metadata.opts.Enforce != enforceLint && !torn
+		uf := finding(filename, b.start+1, b.end-1, msg, repl)
+		uf.stats = b.fixStats(s)
+		uf.kind = FixUnordered
+		fs = append(fs, uf)
+	}
+	return fs
+}
+
+// oddIndentationFindings returns a finding for every line of b, or of the
+// blocks nested in it, that's indented with whitespace besides spaces and
+// tabs, if the block that it's in groups lines by their indentation.
+func oddIndentationFindings(filename string, b block) []*Finding {
+	var fs []*Finding
+	seen := make(map[int]bool)
+	for _, n := range allBlocks([]block{b}) {
+		if opts := n.metadata.opts; !opts.Group && !opts.YAML && !opts.Markdown {
+			continue
+		}
+		for i, l := range n.lines {
+			// +1 because block.start is the line number of the start directive.
+			line := n.start + 1 + i
+			if seen[line] {
+				continue
+			}
+			if r, ok := oddIndentation(l); ok {
+				seen[line] = true
+				fs = append(fs, finding(filename, line, line, errorOddIndentation(r)))
+			}
+		}
+	}
+	slices.SortFunc(fs, func(a, b *Finding) int { return cmp.Compare(a.Lines.Start, b.Lines.Start) })
+	return fs
+}
+
+// regexCoverageFindings returns a finding for every by_regex pattern of b, or
+// of the blocks nested in it, that doesn't match any of the block's groups.
+// Such a pattern is almost always a mistake.
+func regexCoverageFindings(filename string, b block) []*Finding {
+	var fs []*Finding
+	for _, n := range allBlocks([]block{b}) {
+		opts := n.metadata.opts
+		if len(opts.ByRegex) == 0 {
+			continue
+		}
+		var keys []string
+		for _, lg := range groupLines(n.lines, n.metadata) {
+			if isElement(lg) {
+				keys = append(keys, opts.regexInput(lg))
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		regexes, _ := opts.byRegex()
+		for i, re := range regexes {
+			if !slices.ContainsFunc(keys, re.MatchString) {
+				fs = append(fs, finding(filename, n.start, n.start, errorRegexMatchesNothing(opts.ByRegex[i])))
+			}
+		}
+	}
+	return fs
+}
+
+// duplicateFindings returns a finding for each duplicate in b. If
+// onlyDiffering is true, it skips the duplicates that have the same content as
+// their original.
+func duplicateFindings(filename string, b block, onlyDiffering bool) (dups, conflicts []*Finding) {
+	for _, dup := range b.duplicates() {
+		if onlyDiffering && !dup.differs {
+			continue
+		}
+		// +1 because block.start is the line number of the start directive.
+		start := b.start + 1 + dup.lines.start
+		end := b.start + dup.lines.end
+		if dup.differs {
+			conflicts = append(conflicts, finding(filename, start, end, errorDuplicateKey(b.start+1+dup.original), replacement(start, end, "")))
+			continue
+		}
+		dups = append(dups, finding(filename, start, end, errorDuplicate(b.start+1+dup.original), replacement(start, end, "")))
+	}
+	return dups, conflicts
+}
+
+// commentDuplicateFindings returns a finding for each lineGroup in b that's a
+// duplicate of an earlier one except for its comment.
+func commentDuplicateFindings(filename string, b block) []*Finding {
+	var fs []*Finding
+	for _, dup := range b.commentDuplicates() {
+		// +1 because block.start is the line number of the start directive.
+		start := b.start + 1 + dup.lines.start
+		end := b.start + dup.lines.end
+		fs = append(fs, finding(filename, start, end, errorCommentDuplicate(b.start+1+dup.original)))
+	}
 	return fs
 }
 
@@ -184,7 +994,7 @@ func includeModifiedLines(modifiedLines []LineRange) func(start, end int) bool {
 		}
 	}
 	t := augmentedtree.New(1)
-	for _, lr := range modifiedLines {
+	for _, lr := range mergeLineRanges(modifiedLines) {
 		t.Add(lr)
 	}
 	return func(start, end int) bool {
@@ -192,6 +1002,32 @@ func includeModifiedLines(modifiedLines []LineRange) func(start, end int) bool {
 	}
 }
 
+// mergeLineRanges returns lrs sorted by their start, with reversed ranges
+// turned around and with ranges that overlap or touch merged into one, since
+// the interval tree in includeModifiedLines expects neither.
+func mergeLineRanges(lrs []LineRange) []LineRange {
+	sorted := make([]LineRange, len(lrs))
+	for i, lr := range lrs {
+		if lr.Start > lr.End {
+			lr.Start, lr.End = lr.End, lr.Start
+		}
+		sorted[i] = lr
+	}
+	slices.SortFunc(sorted, func(a, b LineRange) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	var merged []LineRange
+	for _, lr := range sorted {
+		if n := len(merged); n > 0 && lr.Start <= merged[n-1].End+1 {
+			merged[n-1].End = max(merged[n-1].End, lr.End)
+			continue
+		}
+		merged = append(merged, lr)
+	}
+	return merged
+}
+
 // linesToString converts the string slice of lines into a single string.
 // This function assumes that every line should end with "\n", including the
 // last line.
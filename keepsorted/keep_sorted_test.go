@@ -15,8 +15,17 @@
 package keepsorted
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -36,6 +45,7 @@ func defaultMetadataWith(opts blockOptions) blockMetadata {
 	return blockMetadata{
 		startDirective: "keep-sorted-test start",
 		endDirective:   "keep-sorted-test end",
+		pinDirective:   "keep-sorted-test: pin",
 		opts:           opts,
 	}
 }
@@ -121,7 +131,7 @@ func TestFix(t *testing.T) {
 1
 3
 // keep-sorted-test end`,
-			wantWarnings: []string{errorMissingDirective("keep-sorted-test", "end"), errorUnordered},
+			wantWarnings: []string{errorMissingDirective("keep-sorted-test", "keep-sorted-test end"), errorUnordered},
 		},
 		{
 			name: "UnmatchedEnd",
@@ -141,908 +151,4021 @@ func TestFix(t *testing.T) {
 3
 // keep-sorted-test end
 // keep-sorted-test end`,
-			wantWarnings: []string{errorUnordered, errorMissingDirective("keep-sorted-test", "start")},
+			wantWarnings: []string{errorUnordered, errorMissingDirective("keep-sorted-test", "keep-sorted-test start")},
 		},
 		{
-			name: "MultipleFixes",
+			name: "ReportDuplicates_AlsoUnsorted",
 
 			in: `
-// keep-sorted-test start
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
 2
 1
-3
-// keep-sorted-test end
-// keep-sorted-test start
-foo
-bar
-baz
+2
 // keep-sorted-test end`,
 
 			want: `
-// keep-sorted-test start
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
 1
 2
-3
-// keep-sorted-test end
-// keep-sorted-test start
-bar
-baz
-foo
 // keep-sorted-test end`,
 		},
-	} {
-		t.Run(tc.name, func(t *testing.T) {
-			initZerolog(t)
-			got, gotAlreadyFixed, gotWarnings := New("keep-sorted-test", BlockOptions{}).Fix("unused-filename", tc.in, nil)
-			if diff := cmp.Diff(tc.want, got); diff != "" {
-				t.Errorf("Fix diff (-want +got):\n%s", diff)
-			}
-			if gotAlreadyFixed != tc.wantAlreadyFixed {
-				t.Errorf("alreadyFixed diff: got %t want %t", gotAlreadyFixed, tc.wantAlreadyFixed)
-			}
-			if diff := cmp.Diff(tc.wantWarnings, messages(gotWarnings)); diff != "" {
-				t.Errorf("warnings diff (-want +got):\n%s", diff)
-			}
-		})
-	}
-}
-
-func TestFindings(t *testing.T) {
-	filename := "test"
-	for _, tc := range []struct {
-		name string
+		{
+			name: "Canonicalize",
 
-		in            string
-		modifiedLines []int
+			in: `
+// keep-sorted-test start numeric=true  canonicalize=yes allow_yaml_lists=yes prefix_order=[b, a] group=false
+10
+9
+// keep-sorted-test end
+<!-- keep-sorted-test start case=no canonicalize=yes -->
+b
+// keep-sorted-test end
+# keep-sorted-test start canonicalize=yes # we need this
+# keep-sorted-test end`,
 
-		want []*Finding
-	}{
+			want: `
+// keep-sorted-test start allow_yaml_lists=yes canonicalize=yes group=no numeric=yes prefix_order=b,a
+9
+10
+// keep-sorted-test end
+<!-- keep-sorted-test start canonicalize=yes case=no -->
+b
+// keep-sorted-test end
+# keep-sorted-test start canonicalize=yes # we need this
+# keep-sorted-test end`,
+		},
 		{
-			name: "AlreadySorted",
+			name: "Canonicalize_Nested",
 
 			in: `
 // keep-sorted-test start
-1
-2
-3
+b
+a
+x // keep-sorted-test start after_code=yes numeric=yes canonicalize=yes
+y // keep-sorted-test end
 // keep-sorted-test end`,
 
-			want: nil,
+			want: `
+// keep-sorted-test start
+a
+b
+x // keep-sorted-test start after_code=yes numeric=yes canonicalize=yes
+y // keep-sorted-test end
+// keep-sorted-test end`,
+			wantWarnings: []string{errorNonCanonicalOptions},
 		},
 		{
-			name: "NotSorted",
+			name: "DirectiveAfterCode",
 
 			in: `
-// keep-sorted-test start
-2
-1
-3
+foo(); // keep-sorted-test start
+b
+a
 // keep-sorted-test end`,
 
-			want: []*Finding{finding(filename, 3, 5, errorUnordered, automaticReplacement(3, 5, "1\n2\n3\n"))},
+			want: `
+foo(); // keep-sorted-test start
+b
+a
+// keep-sorted-test end`,
+			wantAlreadyFixed: false,
+			wantWarnings:     []string{errorDirectiveAfterCode("keep-sorted-test")},
 		},
 		{
-			name: "SkipLines",
+			name: "DirectiveAfterCode_Nested",
 
 			in: `
-// keep-sorted-test start skip_lines=2
-5
-4
-3
-2
-1
+foo(); // keep-sorted-test start
+d
+c
+// keep-sorted-test start
+b
+a
+// keep-sorted-test end
 // keep-sorted-test end`,
 
-			want: []*Finding{finding(filename, 5, 7, errorUnordered, automaticReplacement(5, 7, "1\n2\n3\n"))},
+			want: `
+foo(); // keep-sorted-test start
+d
+c
+// keep-sorted-test start
+a
+b
+// keep-sorted-test end
+// keep-sorted-test end`,
+			wantWarnings: []string{errorDirectiveAfterCode("keep-sorted-test")},
 		},
 		{
-			name: "MismatchedStart",
+			name: "DirectiveAfterCode_End",
 
 			in: `
-// keep-sorted-test start`,
+// keep-sorted-test start
+b
+a
+foo(); // keep-sorted-test end`,
 
-			want: []*Finding{finding(filename, 2, 2, errorMissingDirective("keep-sorted-test", "end"), replacement(2, 2, ""))},
+			want: `
+// keep-sorted-test start
+b
+a
+foo(); // keep-sorted-test end`,
+			wantWarnings: []string{errorDirectiveAfterCode("keep-sorted-test")},
 		},
 		{
-			name: "MismatchedEnd",
+			name: "DirectiveAfterCode_TemplateDelimiters",
 
 			in: `
-// keep-sorted-test end`,
+{/* keep-sorted-test start */}
+b
+a
+{/* keep-sorted-test end */}
+{# keep-sorted-test start #}
+d
+c
+{# keep-sorted-test end #}
+<%# keep-sorted-test start %>
+f
+e
+<%# keep-sorted-test end %>
+{{/* keep-sorted-test start */}}
+h
+g
+{{/* keep-sorted-test end */}}`,
 
-			want: []*Finding{finding(filename, 2, 2, errorMissingDirective("keep-sorted-test", "start"), replacement(2, 2, ""))},
+			want: `
+{/* keep-sorted-test start */}
+a
+b
+{/* keep-sorted-test end */}
+{# keep-sorted-test start #}
+c
+d
+{# keep-sorted-test end #}
+<%# keep-sorted-test start %>
+e
+f
+<%# keep-sorted-test end %>
+{{/* keep-sorted-test start */}}
+g
+h
+{{/* keep-sorted-test end */}}`,
 		},
 		{
-			name: "MultipleFindings",
+			name: "NoFinalNewline",
 
 			in: `
-// keep-sorted-test end
-// keep-sorted-test start
-// keep-sorted-test start
+// keep-sorted-test next 2 lines
 2
+1`,
+
+			want: `
+// keep-sorted-test next 2 lines
 1
-3
-// keep-sorted-test end
-// keep-sorted-test start
-foo
-bar
-baz
-// keep-sorted-test end
-`,
+2`,
+		},
+		{
+			name: "NoFinalNewline_CRLF",
 
-			want: []*Finding{
-				finding(filename, 2, 2, errorMissingDirective("keep-sorted-test", "start"), replacement(2, 2, "")),
-				finding(filename, 3, 3, errorMissingDirective("keep-sorted-test", "end"), replacement(3, 3, "")),
-				finding(filename, 5, 7, errorUnordered, replacement(5, 7, "1\n2\n3\n")),
-				finding(filename, 10, 12, errorUnordered, replacement(10, 12, "bar\nbaz\nfoo\n")),
-			},
+			in: "\r\n// keep-sorted-test next 2 lines\r\n2\r\n1",
+
+			want: "\r\n// keep-sorted-test next 2 lines\r\n1\r\n2",
 		},
 		{
-			name: "ModifiedLines",
+			name: "DirectiveAfterCode_Allowed",
 
 			in: `
-// keep-sorted-test start
+foo(); // keep-sorted-test start after_code=yes
+b
+a
+// keep-sorted-test end`,
+
+			want: `
+foo(); // keep-sorted-test start after_code=yes
+a
+b
+// keep-sorted-test end`,
+		},
+		{
+			name: "EnforceLint",
+
+			in: `
+// keep-sorted-test start enforce=lint
 2
 1
-3
-// keep-sorted-test end
-// keep-sorted-test start
-foo
-bar
-baz
 // keep-sorted-test end`,
-			modifiedLines: []int{3},
 
-			want: []*Finding{finding(filename, 3, 5, errorUnordered, automaticReplacement(3, 5, "1\n2\n3\n"))},
+			want: `
+// keep-sorted-test start enforce=lint
+2
+1
+// keep-sorted-test end`,
+			wantAlreadyFixed: false,
+			wantWarnings:     []string{errorUnordered},
 		},
-	} {
-		t.Run(tc.name, func(t *testing.T) {
-			initZerolog(t)
-			var mod []LineRange
-			if tc.modifiedLines != nil {
-				for _, l := range tc.modifiedLines {
-					mod = append(mod, LineRange{l, l})
-				}
-			}
-			got := New("keep-sorted-test", BlockOptions{}).findings(filename, strings.Split(tc.in, "\n"), mod)
-			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(Fix{})); diff != "" {
-				t.Errorf("Findings diff (-want +got):\n%s", diff)
-			}
-		})
-	}
-}
-
-func TestCreatingBlocks(t *testing.T) {
-	for _, tc := range []struct {
-		name string
+		{
+			name: "OptionContinuation",
 
-		in      string
-		include func(start, end int) bool
+			in: `
+// keep-sorted-test start
+// keep-sorted-test option: numeric=yes
+10
+9
+// keep-sorted-test end`,
 
-		wantBlocks           []block
-		wantIncompleteBlocks []incompleteBlock
-		wantWarnings         []string
-	}{
+			want: `
+// keep-sorted-test start
+// keep-sorted-test option: numeric=yes
+9
+10
+// keep-sorted-test end`,
+		},
 		{
-			name: "MultipleBlocks",
+			name: "NextLines",
 
 			in: `
-foo
-bar
-// keep-sorted-test start
+// keep-sorted-test next 3 lines
 c
 b
 a
-// keep-sorted-test end
-baz
-// keep-sorted-test start
-1
-2
-3
-// keep-sorted-test end
-dog
-cat`,
+z
+y`,
 
-			wantBlocks: []block{
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    3,
-					end:      7,
-					lines: []string{
-						"c",
-						"b",
-						"a",
-					},
-				},
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    9,
-					end:      13,
-					lines: []string{
-						"1",
-						"2",
-						"3",
-					},
-				},
-			},
+			want: `
+// keep-sorted-test next 3 lines
+a
+b
+c
+z
+y`,
 		},
 		{
-			name: "IncompleteBlocks",
+			name: "UntilBlank",
 
 			in: `
-// keep-sorted-test end
-// keep-sorted-test start
-foo
-bar
-// keep-sorted-test start
-baz
-// keep-sorted-test end
-dog
-`,
+<!-- keep-sorted-test until-blank -->
+* c
+* a
 
-			wantBlocks: []block{
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    5,
-					end:      7,
-					lines: []string{
-						"baz",
-					},
-				},
-			},
-			wantIncompleteBlocks: []incompleteBlock{
-				{1, endDirective},
-				{2, startDirective},
-			},
+* b`,
+
+			want: `
+<!-- keep-sorted-test until-blank -->
+* a
+* c
+
+* b`,
 		},
 		{
-			name: "FilteredBlocks",
+			name: "UntilDedent",
 
 			in: `
-foo
-bar
-// keep-sorted-test start
-c
+class Foo:
+    # keep-sorted-test start until=dedent
+    c = 3
+    b = 2
+    a = 1
+bar = Foo()`,
+
+			want: `
+class Foo:
+    # keep-sorted-test start until=dedent
+    a = 1
+    b = 2
+    c = 3
+bar = Foo()`,
+		},
+		{
+			name: "File",
+
+			in: `# keep-sorted-test file
+/src/b/ @b-team
+/src/a/ @a-team
+/docs/ @docs-team
+`,
+
+			want: `# keep-sorted-test file
+/docs/ @docs-team
+/src/a/ @a-team
+/src/b/ @b-team
+`,
+		},
+		{
+			name: "File_Prose",
+
+			in: `# keep-sorted-test files are sorted from top to bottom
 b
 a
-// keep-sorted-test end
-baz
+`,
+
+			want: `# keep-sorted-test files are sorted from top to bottom
+b
+a
+`,
+			wantAlreadyFixed: true,
+		},
+		{
+			name: "Pin",
+
+			in: `
+// keep-sorted-test start sticky_comments=yes
+// keep-sorted-test: pin
+default
+c
+a
+// keep-sorted-test end`,
+
+			want: `
+// keep-sorted-test start sticky_comments=yes
+// keep-sorted-test: pin
+default
+a
+c
+// keep-sorted-test end`,
+		},
+		{
+			name: "SameOrderAs",
+
+			in: `
+enum Color {
+  // keep-sorted-test start name=colors
+  RED,
+  GREEN,
+  BLUE
+  // keep-sorted-test end
+}
+var colorNames = []string{
+  // keep-sorted-test start same_order_as=colors
+  "red",
+
+  "green",
+  "blue",
+  // keep-sorted-test end
+}`,
+
+			want: `
+enum Color {
+  // keep-sorted-test start name=colors
+  BLUE,
+  GREEN,
+  RED
+  // keep-sorted-test end
+}
+var colorNames = []string{
+  // keep-sorted-test start same_order_as=colors
+  "blue",
+
+  "green",
+  "red",
+  // keep-sorted-test end
+}`,
+		},
+		{
+			name: "FileOptions",
+
+			in: `
+# keep-sorted-test options: numeric=yes
+# keep-sorted-test start
+10
+9
+# keep-sorted-test end
+# keep-sorted-test start numeric=no
+10
+9
+# keep-sorted-test end`,
+
+			want: `
+# keep-sorted-test options: numeric=yes
+# keep-sorted-test start
+9
+10
+# keep-sorted-test end
+# keep-sorted-test start numeric=no
+10
+9
+# keep-sorted-test end`,
+		},
+		{
+			name: "DedupeKeys_DifferentValue",
+
+			in: `
+# keep-sorted-test start preset=dotenv remove_duplicates=yes dedupe_keys=yes
+A=1
+A=2
+B=1
+B=1
+# keep-sorted-test end`,
+
+			want: `
+# keep-sorted-test start preset=dotenv remove_duplicates=yes dedupe_keys=yes
+A=1
+A=2
+B=1
+# keep-sorted-test end`,
+			wantAlreadyFixed: false,
+			wantWarnings:     []string{errorDuplicateKey(3)},
+		},
+		{
+			name: "FileOptions_AfterBlock",
+
+			in: `
+# keep-sorted-test start
+10
+9
+# keep-sorted-test end
+# keep-sorted-test options: numeric=yes
+# keep-sorted-test start
+10
+9
+# keep-sorted-test end`,
+
+			want: `
+# keep-sorted-test start
+10
+9
+# keep-sorted-test end
+# keep-sorted-test options: numeric=yes
+# keep-sorted-test start
+10
+9
+# keep-sorted-test end`,
+			wantAlreadyFixed: false,
+			wantWarnings:     []string{errorLateFileOptions("keep-sorted-test")},
+		},
+		{
+			name: "DisableFile",
+
+			in: `
+// keep-sorted-test disable-file
 // keep-sorted-test start
-1
 2
-3
+1
 // keep-sorted-test end
-dog
-cat`,
-			include: func(start, end int) bool {
-				return start < 4 && 4 < end
-			},
+// keep-sorted-test end`,
 
-			wantBlocks: []block{
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    3,
-					end:      7,
-					lines: []string{
-						"c",
-						"b",
-						"a",
-					},
-				},
-			},
+			want: `
+// keep-sorted-test disable-file
+// keep-sorted-test start
+2
+1
+// keep-sorted-test end
+// keep-sorted-test end`,
+			wantAlreadyFixed: true,
 		},
 		{
-			name: "TrailingNewlines",
+			name: "MultipleFixes",
 
 			in: `
 // keep-sorted-test start
+2
+1
+3
+// keep-sorted-test end
+// keep-sorted-test start
+foo
+bar
+baz
+// keep-sorted-test end`,
 
+			want: `
+// keep-sorted-test start
 1
 2
 3
+// keep-sorted-test end
+// keep-sorted-test start
+bar
+baz
+foo
+// keep-sorted-test end`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			got, gotAlreadyFixed, gotWarnings := New("keep-sorted-test", BlockOptions{}).Fix("unused-filename", tc.in, nil)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Fix diff (-want +got):\n%s", diff)
+			}
+			if gotAlreadyFixed != tc.wantAlreadyFixed {
+				t.Errorf("alreadyFixed diff: got %t want %t", gotAlreadyFixed, tc.wantAlreadyFixed)
+			}
+			if diff := cmp.Diff(tc.wantWarnings, messages(gotWarnings)); diff != "" {
+				t.Errorf("warnings diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewFixer(t *testing.T) {
+	for _, id := range []string{"keep-sorted", "keep-sorted-test", "my_tool.v2", "ordenar"} {
+		if _, err := NewFixer(id, BlockOptions{}); err != nil {
+			t.Errorf("NewFixer(%q) = %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "keep sorted", "keep-sorted\n", "//keep-sorted", "-keep-sorted", "1sort", "keep(sorted)"} {
+		if _, err := NewFixer(id, BlockOptions{}); err == nil {
+			t.Errorf("NewFixer(%q) succeeded, want error", id)
+		}
+	}
+}
+
+func TestFix_Aliases(t *testing.T) {
+	for _, tc := range []struct {
+		name string
 
+		rewrite bool
+		in      string
 
+		want             string
+		wantAlreadyFixed bool
+	}{
+		{
+			name: "Recognized",
 
+			in: `
+// keep-sorted-test start
+2
+1
 // keep-sorted-test end
-`,
+// keep-ordered start
+b
+a
+// keep-ordered end`,
 
-			wantBlocks: []block{
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    1,
-					end:      6,
-					lines: []string{
-						"",
-						"1",
-						"2",
-						"3",
-					},
-				},
-			},
+			want: `
+// keep-sorted-test start
+1
+2
+// keep-sorted-test end
+// keep-ordered start
+a
+b
+// keep-ordered end`,
 		},
 		{
-			name: "NestedBlocks",
+			name: "NestedAlias",
 
 			in: `
-// keep-sorted-test start
+// keep-sorted-test start group=yes
+c
+// keep-ordered start
+b
+a
+// keep-ordered end
+1
+// keep-sorted-test end`,
+
+			want: `
+// keep-sorted-test start group=yes
+// keep-ordered start
 a
 b
+// keep-ordered end
+1
 c
-// keep-sorted-test start
-d
-e
-f
-// keep-sorted-test end
-g
-h
-i
-// keep-sorted-test end
-`,
+// keep-sorted-test end`,
+		},
+		{
+			name: "Rewritten",
 
-			wantBlocks: []block{
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    1,
-					end:      13,
-					lines: []string{
-						"a",
-						"b",
-						"c",
-						"// keep-sorted-test start",
-						"d",
-						"e",
-						"f",
-						"// keep-sorted-test end",
-						"g",
-						"h",
-						"i",
-					},
-					nestedBlocks: []block{
-						{
-							metadata: defaultMetadataWithCommentMarker("//"),
-							start:    5,
-							end:      9,
-							lines: []string{
-								"d",
-								"e",
-								"f",
-							},
-						},
-					},
-				},
-			},
+			rewrite: true,
+			in: `
+// keep-ordered start numeric=yes
+// keep-ordered option: group=no
+10
+9
+// keep-ordered end`,
+
+			want: `
+// keep-sorted-test start numeric=yes
+// keep-sorted-test option: group=no
+9
+10
+// keep-sorted-test end`,
 		},
 		{
-			name: "NestedBlocks_DeeplyNested",
+			name: "RewrittenWithoutSorting",
 
+			rewrite: true,
 			in: `
-// keep-sorted-test start
-0.1
-0.2
-0.3
-// keep-sorted-test start
-1.1
-1.2
-1.3
-// keep-sorted-test start
-2.1
-2.2
-2.3
-// keep-sorted-test start
-3.1
-3.2
-3.3
-// keep-sorted-test end // 0:1:2:3
-2.4
-2.5
-2.6
-// keep-sorted-test end // 0:1:2
-// keep-sorted-test start
-4.1
-4.2
-4.3
-// keep-sorted-test end // 0:1:4
-1.4
-1.5
-1.6
-// keep-sorted-test end // 0:1
-0.4
-0.5
-0.6
-// keep-sorted-test end // 0
-// keep-sorted-test start
-5.1
-5.2
-5.3
-// keep-sorted-test end // 5
-`,
+# keep-ordered start
+a
+# keep-ordered end
+# keep-ordered only looks at whole words`,
 
-			wantBlocks: []block{
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    1,
-					end:      34,
-					lines: []string{
-						"0.1",
-						"0.2",
-						"0.3",
-						"// keep-sorted-test start",
-						"1.1",
-						"1.2",
-						"1.3",
-						"// keep-sorted-test start",
-						"2.1",
-						"2.2",
-						"2.3",
-						"// keep-sorted-test start",
-						"3.1",
-						"3.2",
-						"3.3",
-						"// keep-sorted-test end // 0:1:2:3",
-						"2.4",
-						"2.5",
-						"2.6",
-						"// keep-sorted-test end // 0:1:2",
-						"// keep-sorted-test start",
-						"4.1",
-						"4.2",
-						"4.3",
-						"// keep-sorted-test end // 0:1:4",
-						"1.4",
-						"1.5",
-						"1.6",
-						"// keep-sorted-test end // 0:1",
-						"0.4",
-						"0.5",
-						"0.6",
-					},
-					nestedBlocks: []block{
-						{
-							metadata: defaultMetadataWithCommentMarker("//"),
-							start:    5,
-							end:      30,
-							lines: []string{
-								"1.1",
-								"1.2",
-								"1.3",
-								"// keep-sorted-test start",
-								"2.1",
-								"2.2",
-								"2.3",
-								"// keep-sorted-test start",
-								"3.1",
-								"3.2",
-								"3.3",
-								"// keep-sorted-test end // 0:1:2:3",
-								"2.4",
-								"2.5",
-								"2.6",
-								"// keep-sorted-test end // 0:1:2",
-								"// keep-sorted-test start",
-								"4.1",
-								"4.2",
-								"4.3",
-								"// keep-sorted-test end // 0:1:4",
-								"1.4",
-								"1.5",
-								"1.6",
-							},
-							nestedBlocks: []block{
-								{
-									metadata: defaultMetadataWithCommentMarker("//"),
-									start:    9,
-									end:      21,
-									lines: []string{
-										"2.1",
-										"2.2",
-										"2.3",
-										"// keep-sorted-test start",
-										"3.1",
-										"3.2",
-										"3.3",
-										"// keep-sorted-test end // 0:1:2:3",
-										"2.4",
-										"2.5",
-										"2.6",
-									},
-									nestedBlocks: []block{
-										{
-											metadata: defaultMetadataWithCommentMarker("//"),
-											start:    13,
-											end:      17,
-											lines: []string{
-												"3.1",
-												"3.2",
-												"3.3",
-											},
-										},
-									},
-								},
-								{
-									metadata: defaultMetadataWithCommentMarker("//"),
-									start:    22,
-									end:      26,
-									lines: []string{
-										"4.1",
-										"4.2",
-										"4.3",
-									},
-								},
-							},
-						},
-					},
-				},
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    35,
-					end:      39,
-					lines: []string{
-						"5.1",
-						"5.2",
-						"5.3",
-					},
-				},
-			},
+			want: `
+# keep-sorted-test start
+a
+# keep-sorted-test end
+# keep-ordered only looks at whole words`,
 		},
 		{
-			name: "NestedBlocks_MissingEnds",
-
-			in: `
-// keep-sorted-test start
-0
-// keep-sorted-test start
-1
-// keep-sorted-test start
-2
-// keep-sorted-test end
-`,
+			name: "AlreadyFixed",
 
-			wantBlocks: []block{
-				{
-					metadata: defaultMetadataWithCommentMarker("//"),
-					start:    5,
-					end:      7,
-					lines:    []string{"2"},
-				},
-			},
-			wantIncompleteBlocks: []incompleteBlock{
-				{1, startDirective},
-				{3, startDirective},
-			},
-		},
-		{
-			name: "BadOption",
 			in: `
-// keep-sorted-test start foo=bar block=yes
-0
-1
-2
-// keep-sorted-test end
-`,
+// keep-ordered start
+a
+b
+// keep-ordered end`,
 
-			wantBlocks: []block{
-				{
-					metadata: defaultMetadataWith(func() blockOptions {
-						var opts blockOptions
-						opts.Block = true
-						opts.setCommentMarker("//")
-						return opts
-					}()),
-					start: 1,
-					end:   5,
-					lines: []string{"0", "1", "2"},
-				},
-			},
-			wantWarnings: []string{`unrecognized option "foo"`},
+			want: `
+// keep-ordered start
+a
+b
+// keep-ordered end`,
+			wantAlreadyFixed: true,
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			initZerolog(t)
-			if tc.include == nil {
-				tc.include = func(start, end int) bool { return true }
-			}
-
-			gotBlocks, gotIncompleteBlocks, gotWarnings := New("keep-sorted-test", BlockOptions{}).newBlocks("unused-filename", strings.Split(tc.in, "\n"), 0, tc.include)
-			if diff := cmp.Diff(tc.wantBlocks, gotBlocks, cmp.AllowUnexported(block{}, blockMetadata{}, blockOptions{})); diff != "" {
-				t.Errorf("blocks diff (-want +got):\n%s", diff)
-			}
-			if diff := cmp.Diff(tc.wantIncompleteBlocks, gotIncompleteBlocks, cmp.AllowUnexported(incompleteBlock{})); diff != "" {
-				t.Errorf("incompleteBlocks diff (-want +got):\n%s", diff)
+			fixer := New("keep-sorted-test", BlockOptions{}).WithAliases([]string{"keep-ordered"}, tc.rewrite)
+			got, gotAlreadyFixed, _ := fixer.Fix("unused-filename", tc.in, nil)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Fix diff (-want +got):\n%s", diff)
 			}
-
-			if diff := cmp.Diff(tc.wantWarnings, messages(gotWarnings), cmpopts.EquateEmpty()); diff != "" {
-				t.Errorf("warnings diff (-want +got):\n%s", diff)
+			if gotAlreadyFixed != tc.wantAlreadyFixed {
+				t.Errorf("alreadyFixed diff: got %t want %t", gotAlreadyFixed, tc.wantAlreadyFixed)
 			}
 		})
 	}
 }
 
-func TestLineSorting(t *testing.T) {
+func TestFix_MarkdownFences(t *testing.T) {
+	const in = `# Example
+
+` + "````md" + `
+` + "```go" + `
+// keep-sorted-test start
+b
+a
+// keep-sorted-test end
+` + "```" + `
+` + "````" + `
+
+<!-- keep-ordered start -->
+* d
+* c
+<!-- keep-ordered end -->
+`
 	for _, tc := range []struct {
 		name string
 
-		opts blockOptions
-		in   []string
+		filename string
+		ignore   bool
 
-		want              []string
-		wantAlreadySorted bool
+		want string
 	}{
 		{
-			name: "NothingToSort",
+			name:     "Honored",
+			filename: "README.md",
 
-			in: []string{},
+			want: strings.NewReplacer("b\na\n", "a\nb\n", "* d\n* c\n", "* c\n* d\n").Replace(in),
+		},
+		{
+			name:     "Ignored",
+			filename: "README.md",
+			ignore:   true,
+
+			want: strings.Replace(in, "* d\n* c\n", "* c\n* d\n", 1),
+		},
+		{
+			name:     "NotMarkdown",
+			filename: "example.txt",
+			ignore:   true,
+
+			want: strings.NewReplacer("b\na\n", "a\nb\n", "* d\n* c\n", "* c\n* d\n").Replace(in),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			fixer := New("keep-sorted-test", BlockOptions{}).WithAliases([]string{"keep-ordered"}, false).WithMarkdownFences(tc.ignore)
+			got, _, _ := fixer.Fix(tc.filename, in, nil)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Fix diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFencedLines(t *testing.T) {
+	in := []string{
+		"text",
+		"```go",
+		"code",
+		"~~~",
+		"```",
+		"   ~~~~",
+		"```",
+		"~~~~~ ",
+		"``` not a fence`",
+		"    ```",
+		"```",
+	}
+	want := []bool{false, true, true, true, true, true, true, true, false, false, true}
+	if diff := cmp.Diff(want, fencedLines(in)); diff != "" {
+		t.Errorf("fencedLines diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFix_FixOnly(t *testing.T) {
+	const in = `
+// keep-ordered start
+b
+a
+// keep-ordered end
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
+c
+c
+d
+// keep-sorted-test end`
+	for _, tc := range []struct {
+		name string
+
+		kinds []FixKind
+
+		want         string
+		wantWarnings int
+	}{
+		{
+			name: "All",
+
+			kinds: FixKinds,
+			want: `
+// keep-sorted-test start
+a
+b
+// keep-sorted-test end
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
+c
+d
+// keep-sorted-test end`,
+		},
+		{
+			name: "Unordered",
+
+			kinds: []FixKind{FixUnordered},
+			want: `
+// keep-ordered start
+a
+b
+// keep-ordered end
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
+c
+c
+d
+// keep-sorted-test end`,
+			wantWarnings: 3,
+		},
+		{
+			name: "DuplicatesAndAliases",
+
+			kinds: []FixKind{FixDuplicates, FixAliases},
+			want: `
+// keep-sorted-test start
+b
+a
+// keep-sorted-test end
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
+c
+d
+// keep-sorted-test end`,
+			wantWarnings: 1,
+		},
+		{
+			name: "None",
+
+			want:         in,
+			wantWarnings: 4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			fixer, err := New("keep-sorted-test", BlockOptions{}).WithAliases([]string{"keep-ordered"}, true).WithFixOnly(tc.kinds)
+			if err != nil {
+				t.Fatalf("WithFixOnly(%q) = %v", tc.kinds, err)
+			}
+			got, _, warnings := fixer.Fix("unused-filename", in, nil)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Fix diff (-want +got):\n%s", diff)
+			}
+			if len(warnings) != tc.wantWarnings {
+				t.Errorf("Fix returned %d warnings, want %d: %v", len(warnings), tc.wantWarnings, warnings)
+			}
+		})
+	}
+}
+
+func TestWithFixOnly_Invalid(t *testing.T) {
+	if _, err := New("keep-sorted-test", BlockOptions{}).WithFixOnly([]FixKind{"unordered", "everything"}); err == nil {
+		t.Errorf("WithFixOnly(everything) succeeded, want error")
+	}
+}
+
+func TestFix_WithDirectives(t *testing.T) {
+	fixer, err := New("keep-sorted-test", BlockOptions{}).WithDirectives("sort-begin", "sort-finish")
+	if err != nil {
+		t.Fatalf("WithDirectives() failed: %v", err)
+	}
+
+	in := `
+# sort-begin numeric=yes
+10
+9
+# sort-finish
+# keep-sorted-test start
+b
+a
+# keep-sorted-test end`
+	want := `
+# sort-begin numeric=yes
+9
+10
+# sort-finish
+# keep-sorted-test start
+b
+a
+# keep-sorted-test end`
+	if got, _, _ := fixer.Fix("unused-filename", in, nil); got != want {
+		t.Errorf("Fix diff (-want +got):\n%s", cmp.Diff(want, got))
+	}
+
+	wantFindings := []string{errorMissingDirective("keep-sorted-test", "sort-finish")}
+	if diff := cmp.Diff(wantFindings, messages(fixer.Findings("unused-filename", "# sort-begin", nil))); diff != "" {
+		t.Errorf("Findings diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWithDirectives_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		start, end string
+	}{
+		{"", "end"},
+		{"start", ""},
+		{"sort", "sort-end"},
+	} {
+		if _, err := New("keep-sorted-test", BlockOptions{}).WithDirectives(tc.start, tc.end); err == nil {
+			t.Errorf("WithDirectives(%q, %q) succeeded, want error", tc.start, tc.end)
+		}
+	}
+}
+
+func TestFixer_MayHaveDirectives(t *testing.T) {
+	fixer := New("keep-sorted-test", BlockOptions{})
+	withAliases := fixer.WithAliases([]string{"old-sorted"}, false)
+	withDirectives, err := fixer.WithDirectives("sort-begin", "sort-finish")
+	if err != nil {
+		t.Fatalf("WithDirectives() failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+
+		fixer    *Fixer
+		contents string
+
+		want bool
+	}{
+		{
+			name: "NoDirectives",
+
+			fixer:    fixer,
+			contents: "a\nb\n",
+
+			want: false,
+		},
+		{
+			name: "Empty",
+
+			fixer: fixer,
+
+			want: false,
+		},
+		{
+			name: "StartDirective",
+
+			fixer:    fixer,
+			contents: "# keep-sorted-test start\nb\na\n# keep-sorted-test end\n",
+
+			want: true,
+		},
+		{
+			name: "OtherDirective",
+
+			fixer:    fixer,
+			contents: "# keep-sorted-test off\n",
+
+			want: true,
+		},
+		{
+			name: "Alias",
+
+			fixer:    withAliases,
+			contents: "# old-sorted start\nb\na\n# old-sorted end\n",
+
+			want: true,
+		},
+		{
+			name: "AliasNotConfigured",
+
+			fixer:    fixer,
+			contents: "# old-sorted start\nb\na\n# old-sorted end\n",
+
+			want: false,
+		},
+		{
+			name: "CustomDirectives",
+
+			fixer:    withDirectives,
+			contents: "# sort-begin\nb\na\n# sort-finish\n",
+
+			want: true,
+		},
+		{
+			name: "CustomEndDirective",
+
+			fixer:    withDirectives,
+			contents: "# sort-finish\n",
+
+			want: true,
+		},
+		{
+			name: "CustomDirectives_ID",
+
+			fixer:    withDirectives,
+			contents: "# keep-sorted-test skip_lines=1\n",
+
+			want: true,
+		},
+		{
+			name: "CustomDirectives_NoDirectives",
+
+			fixer:    withDirectives,
+			contents: "sort\nbegin\n",
+
+			want: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.fixer.mayHaveDirectives(tc.contents); got != tc.want {
+				t.Errorf("mayHaveDirectives(%q) = %t, want %t", tc.contents, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFixer_HasBlocks(t *testing.T) {
+	fixer := New("keep-sorted-test", BlockOptions{}).WithAliases([]string{"old-sorted"}, false)
+
+	for _, tc := range []struct {
+		name string
+
+		contents string
+
+		want bool
+	}{
+		{
+			name: "NoDirectives",
+
+			contents: "b\na\n",
+
+			want: false,
+		},
+		{
+			name: "Sorted",
+
+			contents: "# keep-sorted-test start\na\nb\n# keep-sorted-test end\n",
+
+			want: true,
+		},
+		{
+			name: "Unsorted",
+
+			contents: "# keep-sorted-test start\nb\na\n# keep-sorted-test end\n",
+
+			want: true,
+		},
+		{
+			name: "Alias",
+
+			contents: "# old-sorted start\nb\na\n# old-sorted end\n",
+
+			want: true,
+		},
+		{
+			name: "IncompleteBlock",
+
+			contents: "# keep-sorted-test start\nb\na\n",
+
+			want: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			if got := fixer.HasBlocks(File{Name: "file", Contents: tc.contents}); got != tc.want {
+				t.Errorf("HasBlocks(%q) = %t, want %t", tc.contents, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestContext_Canceled(t *testing.T) {
+	initZerolog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	in := `
+// keep-sorted-test start
+2
+1
+// keep-sorted-test end`
+	fixer := New("keep-sorted-test", BlockOptions{})
+	if _, _, _, err := fixer.FixContext(ctx, "unused-filename", in, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("FixContext() = %v, want %v", err, context.Canceled)
+	}
+	if _, err := fixer.FindingsContext(ctx, "unused-filename", in, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("FindingsContext() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestFix_SameOrderAs_Concurrent(t *testing.T) {
+	initZerolog(t)
+	// Top-level blocks are sorted concurrently, which only happens with more
+	// than one P. Run with -race to check that they don't share any state.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	var in, want strings.Builder
+	in.WriteString("// keep-sorted-test start name=colors\nRED,\nGREEN,\nBLUE\n// keep-sorted-test end\n")
+	want.WriteString("// keep-sorted-test start name=colors\nBLUE,\nGREEN,\nRED\n// keep-sorted-test end\n")
+	for range 20 {
+		in.WriteString("// keep-sorted-test start same_order_as=colors\nred\ngreen\nblue\n// keep-sorted-test end\n")
+		want.WriteString("// keep-sorted-test start same_order_as=colors\nblue\ngreen\nred\n// keep-sorted-test end\n")
+	}
+
+	fixer := New("keep-sorted-test", BlockOptions{})
+	for range 10 {
+		got, _, warnings := fixer.Fix("unused-filename", in.String(), nil)
+		if diff := cmp.Diff(want.String(), got); diff != "" {
+			t.Fatalf("Fix diff (-want +got):\n%s", diff)
+		}
+		if len(warnings) > 0 {
+			t.Fatalf("Fix warnings = %v, want none", messages(warnings))
+		}
+	}
+}
+
+func TestFixer_FixFiles(t *testing.T) {
+	initZerolog(t)
+	// Options that are shared by every block, to make sure that sorting blocks
+	// concurrently doesn't modify them.
+	opts, err := ParseBlockOptions("sticky_comments=yes sticky_prefixes=@ ignore_prefixes=a,ab")
+	if err != nil {
+		t.Fatalf("ParseBlockOptions() = %v", err)
+	}
+	fixer := New("keep-sorted-test", opts)
+
+	var files []File
+	var want []FileResult
+	for i := range 20 {
+		if i%2 == 0 {
+			files = append(files, File{Name: fmt.Sprint(i), Contents: "// keep-sorted-test start\n2\n// c\n1\n// keep-sorted-test end\n"})
+			want = append(want, FileResult{Fixed: "// keep-sorted-test start\n// c\n1\n2\n// keep-sorted-test end\n", Stats: FixStats{BlocksSorted: 1, GroupsMoved: 1}})
+		} else {
+			files = append(files, File{Name: fmt.Sprint(i), Contents: "# keep-sorted-test start\n1\n2\n# keep-sorted-test end\n"})
+			want = append(want, FileResult{Fixed: "# keep-sorted-test start\n1\n2\n# keep-sorted-test end\n", AlreadyCorrect: true})
+		}
+	}
+	got := fixer.FixFiles(context.Background(), files, 4)
+	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("FixFiles() mismatch (-want +got):\n%s", diff)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i, r := range fixer.FixFiles(ctx, files, 0) {
+		if !errors.Is(r.Err, context.Canceled) {
+			t.Errorf("FixFiles(canceled)[%d].Err = %v, want %v", i, r.Err, context.Canceled)
+		}
+	}
+}
+
+func TestFixer_OptionsOverride(t *testing.T) {
+	initZerolog(t)
+	defaults, err := ParseBlockOptions("remove_duplicates=yes")
+	if err != nil {
+		t.Fatalf("ParseBlockOptions() = %v", err)
+	}
+	fixer := New("keep-sorted-test", defaults).WithAliases([]string{"old-id"}, false)
+	numeric, err := ParseBlockOptions("numeric=yes")
+	if err != nil {
+		t.Fatalf("ParseBlockOptions() = %v", err)
+	}
+	in := `
+// keep-sorted-test start
+10
+9
+9
+// keep-sorted-test end
+// old-id start
+10
+9
+9
+// old-id end`
+
+	// The defaults that the override doesn't mention still apply.
+	got := fixer.FixFile(context.Background(), File{Name: "unused-filename", Contents: in, Options: &numeric})
+	want := `
+// keep-sorted-test start
+9
+10
+// keep-sorted-test end
+// old-id start
+9
+10
+// old-id end`
+	if diff := cmp.Diff(want, got.Fixed); diff != "" {
+		t.Errorf("FixFile() with override diff (-want +got):\n%s", diff)
+	}
+	if fs, err := fixer.FindingsFile(context.Background(), File{Name: "unused-filename", Contents: want, Options: &numeric}); err != nil || len(fs) != 0 {
+		t.Errorf("FindingsFile() with override = %v, %v, want no findings", fs, err)
+	}
+
+	// The Fixer itself is unchanged.
+	want = `
+// keep-sorted-test start
+10
+9
+// keep-sorted-test end
+// old-id start
+10
+9
+// old-id end`
+	if got, _, _ := fixer.Fix("unused-filename", in, nil); got != want {
+		t.Errorf("Fix() without override diff (-want +got):\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestFixer_FindingsFile_NoFixes(t *testing.T) {
+	initZerolog(t)
+	in := `
+// keep-sorted-test start
+2
+1
+// keep-sorted-test end
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
+a
+a
+b
+// keep-sorted-test end
+// keep-sorted-test start group=yes
+x
+// keep-sorted-test start
+d
+c
+// keep-sorted-test end
+// keep-sorted-test end
+// keep-sorted-test start
+sorted
+// keep-sorted-test end`
+	fixer := New("keep-sorted-test", BlockOptions{})
+
+	want, err := fixer.FindingsFile(context.Background(), File{Name: "unused-filename", Contents: in})
+	if err != nil {
+		t.Fatalf("FindingsFile() = %v", err)
+	}
+	for _, f := range want {
+		f.Fixes = nil
+	}
+	got, err := fixer.FindingsFile(context.Background(), File{Name: "unused-filename", Contents: in, NoFixes: true})
+	if err != nil {
+		t.Fatalf("FindingsFile(NoFixes) = %v", err)
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(Finding{}), cmpopts.IgnoreFields(Finding{}, "stats", "kind")); diff != "" {
+		t.Errorf("FindingsFile(NoFixes) diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFixer_FindingsFile_LineEndings(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		in string
+
+		want []string
+	}{
+		{
+			name: "LF",
+			in:   "// keep-sorted-test start\na\nb\n// keep-sorted-test end\n",
+		},
+		{
+			name: "CRLF",
+			in:   "// keep-sorted-test start\r\na\r\nb\r\n// keep-sorted-test end\r\n",
+		},
+		{
+			name: "Mixed",
+			in:   "// keep-sorted-test start\r\na\r\nb\n// keep-sorted-test end\r\n",
+			want: []string{errorMixedLineEndings("3 CRLF, 1 LF")},
+		},
+		{
+			name: "CR",
+			in:   "// keep-sorted-test start\rb\ra\r// keep-sorted-test end\r",
+			want: []string{errorCRLineEndings, errorMissingDirective("keep-sorted-test", "keep-sorted-test end")},
+		},
+		{
+			name: "NoDirectives",
+			in:   "a\r\nb\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			fixer := New("keep-sorted-test", BlockOptions{})
+			fs, err := fixer.FindingsFile(context.Background(), File{Name: "unused-filename", Contents: tc.in})
+			if err != nil {
+				t.Fatalf("FindingsFile() = %v", err)
+			}
+			if diff := cmp.Diff(tc.want, messages(fs)); diff != "" {
+				t.Errorf("FindingsFile() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFixer_FixFile_MixedLineEndings(t *testing.T) {
+	initZerolog(t)
+	const in = "// keep-sorted-test start\r\na\r\nb\n// keep-sorted-test end\r\n"
+	r := New("keep-sorted-test", BlockOptions{}).FixFile(context.Background(), File{Name: "unused-filename", Contents: in})
+	if r.Err != nil {
+		t.Fatalf("FixFile() = %v", r.Err)
+	}
+	// The warning alone doesn't make the file incorrect, so it isn't rewritten.
+	if !r.AlreadyCorrect || r.Fixed != in {
+		t.Errorf("FixFile() = %q, AlreadyCorrect %t, want %q, true", r.Fixed, r.AlreadyCorrect, in)
+	}
+	if diff := cmp.Diff([]string{errorMixedLineEndings("3 CRLF, 1 LF")}, messages(r.Warnings)); diff != "" {
+		t.Errorf("FixFile() warnings diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFindings_RegexTooExpensive(t *testing.T) {
+	initZerolog(t)
+	defer func(old int) { maxRegexCost = old }(maxRegexCost)
+	maxRegexCost = 100
+
+	in := `
+// keep-sorted-test start
+b
+a
+// keep-sorted-test end
+// keep-sorted-test start by_regex=(\w+)\s*=
+z = 1
+y = 2
+x = 3
+// keep-sorted-test end`
+	fixer := New("keep-sorted-test", BlockOptions{})
+	got, _, _ := fixer.Fix("unused-filename", in, nil)
+	want := strings.Replace(in, "b\na", "a\nb", 1)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Fix() diff (-want +got):\n%s", diff)
+	}
+	fs := fixer.Findings("unused-filename", want, nil)
+	if len(fs) != 1 || fs[0].Lines.Start != 6 || !strings.Contains(fs[0].Message, "would take too long") {
+		t.Errorf("Findings() = %v, want one finding that by_regex is too expensive", fs)
+	}
+}
+
+func TestFixer_FixFile_Stats(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		in string
+
+		want FixStats
+	}{
+		{
+			name: "AlreadySorted",
+
+			in: `
+// keep-sorted-test start
+a
+b
+// keep-sorted-test end`,
+
+			want: FixStats{},
+		},
+		{
+			name: "OneMoved",
+
+			in: `
+// keep-sorted-test start
+b
+c
+d
+a
+// keep-sorted-test end`,
+
+			want: FixStats{BlocksSorted: 1, GroupsMoved: 1},
+		},
+		{
+			name: "Reversed",
+
+			in: `
+// keep-sorted-test start
+c
+b
+a
+// keep-sorted-test end`,
+
+			want: FixStats{BlocksSorted: 1, GroupsMoved: 2},
+		},
+		{
+			name: "Duplicates",
+
+			in: `
+// keep-sorted-test start remove_duplicates=yes
+b
+a
+b
+c
+// keep-sorted-test end`,
+
+			want: FixStats{BlocksSorted: 1, GroupsMoved: 1, DuplicatesRemoved: 1},
+		},
+		{
+			name: "ReportedDuplicates",
+
+			in: `
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
+a
+a
+b
+b
+// keep-sorted-test end`,
+
+			want: FixStats{DuplicatesRemoved: 2},
+		},
+		{
+			name: "MultipleBlocks",
+
+			in: `
+// keep-sorted-test start
+b
+a
+// keep-sorted-test end
+// keep-sorted-test start
+d
+c
+// keep-sorted-test end`,
+
+			want: FixStats{BlocksSorted: 2, GroupsMoved: 2},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			got := New("keep-sorted-test", BlockOptions{}).FixFile(context.Background(), File{Name: "unused-filename", Contents: tc.in})
+			if got.Err != nil {
+				t.Fatalf("FixFile() = %v", got.Err)
+			}
+			if diff := cmp.Diff(tc.want, got.Stats); diff != "" {
+				t.Errorf("FixFile() stats diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFix_Scaling(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+	oldLevel := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	t.Cleanup(func() { zerolog.SetGlobalLevel(oldLevel) })
+
+	for _, tc := range []struct {
+		name     string
+		generate func(n int) string
+		n        int
+		// How much slower Fix may get with 4 times the input. Linear scaling
+		// would be 4 times slower, quadratic 16 times.
+		maxRatio float64
+	}{
+		{
+			// Every level has to look at the lines of all the levels below it, so
+			// this is quadratic at best. Make sure it doesn't get any worse.
+			name: "DeeplyNested",
+			generate: func(n int) string {
+				var s strings.Builder
+				for range n {
+					s.WriteString("// keep-sorted-test start group=yes\nb\na\n")
+				}
+				for range n {
+					s.WriteString("// keep-sorted-test end\n")
+				}
+				return s.String()
+			},
+			n:        100,
+			maxRatio: 24,
+		},
+		{
+			name: "ManyNestedBlocks",
+			generate: func(n int) string {
+				var s strings.Builder
+				s.WriteString("// keep-sorted-test start block=yes\n")
+				for i := range n {
+					fmt.Fprintf(&s, "x%d {\n  // keep-sorted-test start\n  b\n  a\n  // keep-sorted-test end\n}\n", n-i)
+				}
+				s.WriteString("// keep-sorted-test end\n")
+				return s.String()
+			},
+			n:        500,
+			maxRatio: 8,
+		},
+		{
+			name: "LargeNestedBlocks",
+			generate: func(n int) string {
+				var s strings.Builder
+				s.WriteString("// keep-sorted-test start block=yes\n")
+				for i := range 10 {
+					fmt.Fprintf(&s, "x%d {\n  // keep-sorted-test start\n", 10-i)
+					for j := range n {
+						fmt.Fprintf(&s, "  %d\n", (j*7919)%n)
+					}
+					s.WriteString("  // keep-sorted-test end\n}\n")
+				}
+				s.WriteString("// keep-sorted-test end\n")
+				return s.String()
+			},
+			n:        300,
+			maxRatio: 8,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fixer := New("keep-sorted-test", BlockOptions{})
+			// The fastest of a few runs, to be less sensitive to noise.
+			timeFix := func(in string) time.Duration {
+				best := time.Duration(math.MaxInt64)
+				for range 3 {
+					start := time.Now()
+					got, _, _ := fixer.Fix("unused-filename", in, nil)
+					best = min(best, time.Since(start))
+					if _, alreadyFixed, _ := fixer.Fix("unused-filename", got, nil); !alreadyFixed {
+						t.Fatalf("Fix() didn't fix everything in one go")
+					}
+				}
+				return best
+			}
+			small, large := timeFix(tc.generate(tc.n)), timeFix(tc.generate(4*tc.n))
+			if ratio := float64(large) / float64(small); ratio > tc.maxRatio {
+				t.Errorf("Fix() is %.1f times slower with 4 times the input (%v vs. %v)", ratio, large, small)
+			}
+		})
+	}
+}
+
+func BenchmarkFix(b *testing.B) {
+	var in strings.Builder
+	in.WriteString("// keep-sorted-test start block=yes\n")
+	for i := range 10000 {
+		fmt.Fprintf(&in, "entry(\n  name = \"%d\",\n)\n", (i*7919)%10000)
+	}
+	in.WriteString("// keep-sorted-test end\n")
+	// Like in the CLI, debug logs are off unless they're asked for.
+	oldLevel := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	b.Cleanup(func() { zerolog.SetGlobalLevel(oldLevel) })
+	fixer := New("keep-sorted-test", BlockOptions{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		fixer.Fix("unused-filename", in.String(), nil)
+	}
+}
+
+func BenchmarkFix_LargeFile(b *testing.B) {
+	var in strings.Builder
+	in.WriteString("// keep-sorted-test start\nb\na\n// keep-sorted-test end\n")
+	for i := range 200000 {
+		fmt.Fprintf(&in, "unrelated line %d\n", i)
+	}
+	oldLevel := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	b.Cleanup(func() { zerolog.SetGlobalLevel(oldLevel) })
+	fixer := New("keep-sorted-test", BlockOptions{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		fixer.Fix("unused-filename", in.String(), nil)
+	}
+}
+
+func TestFix_OrderFrom(t *testing.T) {
+	files := fstest.MapFS{
+		"dir/order.txt": {Data: []byte("prod\nstaging\n\ndev\n")},
+	}
+	fixer := New("keep-sorted-test", BlockOptions{}).WithReadFile(func(name string) ([]byte, error) {
+		return fs.ReadFile(files, name)
+	})
+
+	for _, tc := range []struct {
+		name string
+
+		in string
+
+		want         string
+		wantWarnings []string
+	}{
+		{
+			name: "Listed",
+
+			in: `
+# keep-sorted-test start order_from=order.txt
+dev
+local
+staging
+prod
+# keep-sorted-test end`,
+
+			want: `
+# keep-sorted-test start order_from=order.txt
+prod
+staging
+dev
+local
+# keep-sorted-test end`,
+		},
+		{
+			name: "MissingFile",
+
+			in: `
+# keep-sorted-test start order_from=missing.txt
+b
+a
+# keep-sorted-test end`,
+
+			want: `
+# keep-sorted-test start order_from=missing.txt
+a
+b
+# keep-sorted-test end`,
+			wantWarnings: []string{"order_from could not be read: open dir/missing.txt: file does not exist"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			got, _, gotWarnings := fixer.Fix("dir/file.txt", tc.in, nil)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Fix diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantWarnings, messages(gotWarnings)); diff != "" {
+				t.Errorf("warnings diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFix_SortHooks(t *testing.T) {
+	opts := BlockOptions{}
+	// Drops trailing semicolons before sorting.
+	opts.AddSortHooks(SortHooks{
+		BeforeSort: func(groups []LineGroup) []LineGroup {
+			for _, g := range groups {
+				for i, l := range g.Lines {
+					g.Lines[i] = strings.TrimRight(l, ";")
+				}
+			}
+			return groups
+		},
+	})
+	// Drops the groups that say "remove", after sorting.
+	var sorted [][]string
+	opts.AddSortHooks(SortHooks{
+		AfterSort: func(groups []LineGroup) []LineGroup {
+			var lines []string
+			for _, g := range groups {
+				lines = append(lines, g.Lines...)
+			}
+			sorted = append(sorted, lines)
+			return slices.DeleteFunc(groups, func(g LineGroup) bool { return g.Lines[0] == "remove" })
+		},
+	})
+	fixer := New("keep-sorted-test", opts)
+
+	for _, tc := range []struct {
+		name string
+
+		in string
+
+		want              string
+		wantAlreadyFixed  bool
+		wantSortedByHooks []string
+	}{
+		{
+			name: "Unsorted",
+
+			in: `
+// keep-sorted-test start
+c
+remove
+a;
+// keep-sorted-test end`,
+
+			want: `
+// keep-sorted-test start
+a
+c
+// keep-sorted-test end`,
+			wantSortedByHooks: []string{"a", "c", "remove"},
+		},
+		{
+			name: "SortedButChangedByHook",
+
+			in: `
+// keep-sorted-test start
+a;
+b
+// keep-sorted-test end`,
+
+			want: `
+// keep-sorted-test start
+a
+b
+// keep-sorted-test end`,
+			wantSortedByHooks: []string{"a", "b"},
+		},
+		{
+			name: "AlreadySorted",
+
+			in: `
+// keep-sorted-test start
+a
+b
+// keep-sorted-test end`,
+
+			want: `
+// keep-sorted-test start
+a
+b
+// keep-sorted-test end`,
+			wantAlreadyFixed:  true,
+			wantSortedByHooks: []string{"a", "b"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			sorted = nil
+			got, alreadyFixed, _ := fixer.Fix("unused-filename", tc.in, nil)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Fix diff (-want +got):\n%s", diff)
+			}
+			if alreadyFixed != tc.wantAlreadyFixed {
+				t.Errorf("alreadyFixed = %t, want %t", alreadyFixed, tc.wantAlreadyFixed)
+			}
+			if len(sorted) == 0 {
+				t.Fatalf("AfterSort wasn't called")
+			}
+			if diff := cmp.Diff(tc.wantSortedByHooks, sorted[0]); diff != "" {
+				t.Errorf("AfterSort groups diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFix_UnstableSort(t *testing.T) {
+	opts := BlockOptions{}
+	// Adds another group every time the block is sorted, so sorting it never
+	// settles down.
+	opts.AddSortHooks(SortHooks{
+		AfterSort: func(groups []LineGroup) []LineGroup {
+			return append(groups, LineGroup{Lines: []string{"z"}})
+		},
+	})
+	fixer := New("keep-sorted-test", opts)
+	in := `
+// keep-sorted-test start
+b
+a
+// keep-sorted-test end`
+
+	got, alreadyFixed, _ := fixer.Fix("unused-filename", in, nil)
+	if diff := cmp.Diff(in, got); diff != "" {
+		t.Errorf("Fix diff (-want +got):\n%s", diff)
+	}
+	if alreadyFixed {
+		t.Errorf("alreadyFixed = true, want false")
+	}
+	fs, err := fixer.findings(context.Background(), "unused-filename", strings.Split(in, "\n"), nil, false)
+	if err != nil {
+		t.Fatalf("findings: %v", err)
+	}
+	if diff := cmp.Diff([]string{errorUnstableSort}, messages(fs)); diff != "" {
+		t.Errorf("findings diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFindings_Warning(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		in string
+
+		want []*Warning
+	}{
+		{
+			name: "UnknownOption",
+
+			in: `
+// keep-sorted-test start block=yes
+// keep-sorted-test option: foo=bar
+// keep-sorted-test end`,
+
+			want: []*Warning{{Code: UnknownOption, Key: "foo", Line: 3, Column: 29}},
+		},
+		{
+			name: "InvalidValue",
+
+			in: `
+// keep-sorted-test start skip_lines=-1
+// keep-sorted-test end`,
+
+			want: []*Warning{{Code: InvalidValue, Key: "skip_lines", Line: 2, Column: 27}},
+		},
+		{
+			name: "ConflictingOptions",
+
+			in: `
+// keep-sorted-test start group=no group_prefixes=a
+// keep-sorted-test end`,
+
+			want: []*Warning{{Code: ConflictingOptions, Key: "group_prefixes", Line: 2, Column: 36}},
+		},
+		{
+			name: "ConflictingWithCSV",
+
+			in: `
+# keep-sorted-test start csv=no delimiter=;
+# keep-sorted-test end`,
+
+			want: []*Warning{{Code: ConflictingOptions, Key: "csv", Line: 2, Column: 26}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			var got []*Warning
+			for _, f := range New("keep-sorted-test", BlockOptions{}).Findings("unused-filename", tc.in, nil) {
+				got = append(got, f.Warning)
+			}
+			if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreUnexported(Warning{})); diff != "" {
+				t.Errorf("warnings diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFindings(t *testing.T) {
+	filename := "test"
+	for _, tc := range []struct {
+		name string
+
+		in            string
+		modifiedLines []int
+
+		want []*Finding
+	}{
+		{
+			name: "AlreadySorted",
+
+			in: `
+// keep-sorted-test start
+1
+2
+3
+// keep-sorted-test end`,
+
+			want: nil,
+		},
+		{
+			name: "NotSorted",
+
+			in: `
+// keep-sorted-test start
+2
+1
+3
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 3, 5, errorUnordered, automaticReplacement(3, 5, "1\n2\n3\n"))},
+		},
+		{
+			name: "SkipLines",
+
+			in: `
+// keep-sorted-test start skip_lines=2
+5
+4
+3
+2
+1
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 5, 7, errorUnordered, automaticReplacement(5, 7, "1\n2\n3\n"))},
+		},
+		{
+			name: "OddIndentation",
+
+			in: "\n// keep-sorted-test start group=yes\na\n\u00a0 b\nc\n// keep-sorted-test end",
+
+			want: []*Finding{finding(filename, 4, 4, errorOddIndentation('\u00a0'))},
+		},
+		{
+			name: "CommentDuplicate",
+
+			in: `
+// keep-sorted-test start remove_duplicates=yes sticky_comments=yes
+// about a
+a
+b
+// more about a
+a
+// about a
+a
+// keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 3, 9, errorUnordered, automaticReplacement(3, 9, "// about a\na\n// more about a\na\nb\n")),
+				finding(filename, 6, 7, errorCommentDuplicate(3)),
+			},
+		},
+		{
+			name: "RegexMatchesNothing",
+
+			in: `
+// keep-sorted-test start by_regex=^x_(\w+),(\d+)
+b 1
+a 2
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 2, 2, errorRegexMatchesNothing(`^x_(\w+)`))},
+		},
+		{
+			name: "RegexMatchesNothing_Nested",
+
+			in: `
+// keep-sorted-test start block=yes
+b = [
+  // keep-sorted-test start by_regex=z
+  1,
+  2,
+  // keep-sorted-test end
+]
+a = 1
+// keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 3, 9, errorUnordered, automaticReplacement(3, 9, "a = 1\nb = [\n  // keep-sorted-test start by_regex=z\n  1,\n  2,\n  // keep-sorted-test end\n]\n")),
+				finding(filename, 4, 4, errorRegexMatchesNothing("z")),
+			},
+		},
+		{
+			name: "SkipLines_SplitsStickyComment",
+
+			in: `
+// keep-sorted-test start skip_lines=2 sticky_comments=yes
+header
+// about 2
+2
+1
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 2, 2, errorSkipLinesSplitsGroup(2))},
+		},
+		{
+			name: "SkipLines_WholeGroups",
+
+			in: `
+// keep-sorted-test start skip_lines=1 sticky_comments=yes
+header
+// about 2
+2
+1
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 4, 6, errorUnordered, automaticReplacement(4, 6, "1\n// about 2\n2\n"))},
+		},
+		{
+			name: "TornApart",
+
+			in: `
+// keep-sorted-test start sticky_comments=yes
+foo {
+  a
+}
+bar {
+  b
+}
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 3, 8, errorTornApart("block=yes"), replacement(3, 8, "  a\n  b\nbar {\nfoo {\n}\n}\n"))},
+		},
+		{
+			name: "TornApart_StickyComments",
+
+			in: `
+// keep-sorted-test start
+f(
+  a)
+e(
+  b)
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 3, 6, errorTornApart("block=yes sticky_comments=yes"), replacement(3, 6, "  a)\n  b)\ne(\nf(\n"))},
+		},
+		{
+			name: "TornApart_Prose",
+
+			in: `
+// keep-sorted-test start
+- won't do Y
+- don't do X
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 3, 4, errorUnordered, automaticReplacement(3, 4, "- don't do X\n- won't do Y\n"))},
+		},
+		{
+			name: "TornApart_Lang",
+
+			in: `
+# keep-sorted-test start lang=python
+b = """
+text
+"""
+a = 1
+# keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 3, 6, errorTornApart("block=yes sticky_comments=yes"), replacement(3, 6, "\"\"\"\na = 1\nb = \"\"\"\ntext\n"))},
+		},
+		{
+			name: "TornApart_AlreadyBlock",
+
+			in: `
+// keep-sorted-test start block=yes
+foo {
+  a
+}
+bar {
+  b
+}
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 3, 8, errorUnordered, automaticReplacement(3, 8, "bar {\n  b\n}\nfoo {\n  a\n}\n"))},
+		},
+		{
+			name: "UnbalancedSort",
+
+			in: `
+// keep-sorted-test start paired_lines=#if:#endif
+z {
+a }
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 3, 4, errorUnbalancedSort, replacement(3, 4, "a }\nz {\n"))},
+		},
+		{
+			name: "MismatchedStart",
+
+			in: `
+// keep-sorted-test start`,
+
+			want: []*Finding{finding(filename, 2, 2, errorMissingDirective("keep-sorted-test", "keep-sorted-test end"), replacement(2, 2, ""))},
+		},
+		{
+			name: "MismatchedEnd",
+
+			in: `
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 2, 2, errorMissingDirective("keep-sorted-test", "keep-sorted-test start"), replacement(2, 2, ""))},
+		},
+		{
+			name: "MultipleFindings",
+
+			in: `
+// keep-sorted-test end
+// keep-sorted-test start
+// keep-sorted-test start
+2
+1
+3
+// keep-sorted-test end
+// keep-sorted-test start
+foo
+bar
+baz
+// keep-sorted-test end
+`,
+
+			want: []*Finding{
+				finding(filename, 2, 2, errorMissingDirective("keep-sorted-test", "keep-sorted-test start"), replacement(2, 2, "")),
+				finding(filename, 3, 3, errorMissingDirective("keep-sorted-test", "keep-sorted-test end"), replacement(3, 3, "")),
+				finding(filename, 5, 7, errorUnordered, replacement(5, 7, "1\n2\n3\n")),
+				finding(filename, 10, 12, errorUnordered, replacement(10, 12, "bar\nbaz\nfoo\n")),
+			},
+		},
+		{
+			name: "ModifiedLines",
+
+			in: `
+// keep-sorted-test start
+2
+1
+3
+// keep-sorted-test end
+// keep-sorted-test start
+foo
+bar
+baz
+// keep-sorted-test end`,
+			modifiedLines: []int{3},
+
+			want: []*Finding{finding(filename, 3, 5, errorUnordered, automaticReplacement(3, 5, "1\n2\n3\n"))},
+		},
+		{
+			name: "ReportDuplicates",
+
+			in: `
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
+1
+1
+2
+3
+3
+// keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 4, 4, errorDuplicate(3), automaticReplacement(4, 4, "")),
+				finding(filename, 7, 7, errorDuplicate(6), automaticReplacement(7, 7, "")),
+			},
+		},
+		{
+			name: "ReportDuplicates_AlsoUnsorted",
+
+			in: `
+// keep-sorted-test start remove_duplicates=yes report_duplicates=yes
+2
+1
+2
+// keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 3, 5, errorUnordered, automaticReplacement(3, 5, "1\n2\n")),
+				func() *Finding {
+					f := finding(filename, 5, 5, errorDuplicate(3), replacement(5, 5, ""))
+					f.lintOnly = true
+					return f
+				}(),
+			},
+		},
+		{
+			name: "EnforceLint",
+
+			in: `
+// keep-sorted-test start enforce=lint
+2
+1
+// keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 3, 4, errorUnordered, replacement(3, 4, "1\n2\n")),
+			},
+		},
+		{
+			name: "ReportTrivial",
+
+			in: `
+// keep-sorted-test start report_trivial=yes
+// keep-sorted-test end
+// keep-sorted-test start report_trivial=yes
+
+foo
+
+// keep-sorted-test end
+// keep-sorted-test start report_trivial=yes
+foo
+bar
+// keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 2, 3, errorTrivialBlock),
+				finding(filename, 4, 7, errorTrivialBlock),
+				finding(filename, 10, 11, errorUnordered, automaticReplacement(10, 11, "bar\nfoo\n")),
+			},
+		},
+		{
+			name: "DedupeKeys",
+
+			in: `
+# keep-sorted-test start preset=dotenv remove_duplicates=yes dedupe_keys=yes
+A=1
+B=2
+export A=1
+B=3
+# keep-sorted-test end`,
+
+			want: []*Finding{
+				// export A=1 sets the same value as A=1, but B=3 is kept.
+				finding(filename, 3, 6, errorUnordered, automaticReplacement(3, 6, "A=1\nB=2\nB=3\n")),
+				finding(filename, 6, 6, errorDuplicateKey(4), replacement(6, 6, "")),
+			},
+		},
+		{
+			name: "DedupeKeys_OnlyDifferingValues",
+
+			in: `
+# keep-sorted-test start preset=dotenv remove_duplicates=yes dedupe_keys=yes
+A=1
+A=1
+A=2
+# keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 3, 5, errorUnordered, automaticReplacement(3, 5, "A=1\nA=2\n")),
+				finding(filename, 5, 5, errorDuplicateKey(3), replacement(5, 5, "")),
+			},
+		},
+		{
+			name: "DedupeKeys_SameValue",
+
+			in: `
+# keep-sorted-test start preset=dotenv remove_duplicates=yes dedupe_keys=yes
+A=1
+A="1"
+export A = '1'
+# keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 3, 5, errorUnordered, automaticReplacement(3, 5, "A=1\n")),
+			},
+		},
+		{
+			name: "OptionsOnEndDirective",
+
+			in: `
+// keep-sorted-test start
+1
+2
+// keep-sorted-test end numeric=yes`,
+
+			want: []*Finding{finding(filename, 5, 5, errorEndDirectiveOptions("keep-sorted-test"), Fix{
+				Replacements: []Replacement{
+					{Lines: lineRange(2, 2), NewContent: "// keep-sorted-test start numeric=yes\n"},
+					{Lines: lineRange(5, 5), NewContent: "// keep-sorted-test end\n"},
+				},
+			})},
+		},
+		{
+			name: "OptionsOnEndDirective_BlockComment",
+
+			in: `
+<!-- keep-sorted-test start -->
+* a
+<!-- keep-sorted-test end case=no -->`,
+
+			want: []*Finding{finding(filename, 4, 4, errorEndDirectiveOptions("keep-sorted-test"), Fix{
+				Replacements: []Replacement{
+					{Lines: lineRange(2, 2), NewContent: "<!-- keep-sorted-test start case=no -->\n"},
+					{Lines: lineRange(4, 4), NewContent: "<!-- keep-sorted-test end -->\n"},
+				},
+			})},
+		},
+		{
+			name: "EndDirectiveIndentation",
+
+			in: `
+  // keep-sorted-test start
+  1
+  2
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 5, 5, errorDirectiveIndentation(2), replacement(5, 5, "  // keep-sorted-test end\n"))},
+		},
+		{
+			name: "CommentOnEndDirective",
+
+			in: `
+// keep-sorted-test start
+1
+2
+// keep-sorted-test end // with a comment`,
+
+			want: nil,
+		},
+		{
+			name: "DisableFile",
+
+			in: `
+# keep-sorted-test start
+2
+1
+# keep-sorted-test end
+# Golden file for tests. keep-sorted-test disable-file`,
+
+			want: nil,
+		},
+		{
+			name: "SameOrderAs_UnknownName",
+
+			in: `
+// keep-sorted-test start same_order_as=colors
+b
+a
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 2, 2, errorUnknownName("colors"))},
+		},
+		{
+			name: "SameOrderAs_DifferentElements",
+
+			in: `
+// keep-sorted-test start name=colors
+RED
+GREEN
+// keep-sorted-test end
+// keep-sorted-test start same_order_as=colors
+"red"
+"green"
+"blue"
+// keep-sorted-test end`,
+
+			want: []*Finding{
+				finding(filename, 3, 4, errorUnordered, automaticReplacement(3, 4, "GREEN\nRED\n")),
+				finding(filename, 6, 10, errorDifferentElements(3, "colors", 2)),
+			},
+		},
+		{
+			name: "DuplicateName",
+
+			in: `
+// keep-sorted-test start name=colors
+a
+// keep-sorted-test end
+// keep-sorted-test start name=colors
+a
+// keep-sorted-test end`,
+
+			want: []*Finding{finding(filename, 5, 5, errorDuplicateName("colors"))},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			var mod []LineRange
+			if tc.modifiedLines != nil {
+				for _, l := range tc.modifiedLines {
+					mod = append(mod, LineRange{l, l})
+				}
+			}
+			got, err := New("keep-sorted-test", BlockOptions{}).findings(context.Background(), filename, strings.Split(tc.in, "\n"), mod, false)
+			if err != nil {
+				t.Fatalf("findings() failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(Finding{}, Fix{}), cmpopts.IgnoreFields(Finding{}, "stats", "kind")); diff != "" {
+				t.Errorf("Findings diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSortLines(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		in      []string
+		options string
+
+		want              []string
+		wantAlreadySorted bool
+	}{
+		{
+			name: "Sorted",
+
+			in: []string{"a", "b"},
+
+			want:              []string{"a", "b"},
+			wantAlreadySorted: true,
+		},
+		{
+			name: "Unsorted",
+
+			in:      []string{"c", "a", "b"},
+			options: "case=yes",
+
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "Options",
+
+			in:      []string{"10", "9", "9"},
+			options: "numeric=yes remove_duplicates=yes",
+
+			want: []string{"9", "10"},
+		},
+		{
+			name: "TrailingSeparator",
+
+			in:      []string{"b,", "a"},
+			options: "case=yes",
+
+			want: []string{"a,", "b"},
+		},
+		{
+			name: "StickyComments",
+
+			in:      []string{"# about b", "b", "a"},
+			options: "sticky_comments=yes comment_marker=#",
+
+			want: []string{"a", "# about b", "b"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			opts, err := ParseBlockOptions(tc.options)
+			if err != nil {
+				t.Fatalf("ParseBlockOptions(%q) = %v", tc.options, err)
+			}
+			in := slices.Clone(tc.in)
+			got, alreadySorted := SortLines(in, opts)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("SortLines(%q) mismatch (-want +got):\n%s", tc.in, diff)
+			}
+			if alreadySorted != tc.wantAlreadySorted {
+				t.Errorf("SortLines(%q) alreadySorted = %t, want %t", tc.in, alreadySorted, tc.wantAlreadySorted)
+			}
+			if diff := cmp.Diff(tc.in, in); diff != "" {
+				t.Errorf("SortLines(%q) modified its input (-want +got):\n%s", tc.in, diff)
+			}
+		})
+	}
+}
+
+func TestCreatingBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		in      string
+		include func(start, end int) bool
+
+		wantBlocks           []block
+		wantIncompleteBlocks []incompleteBlock
+		wantWarnings         []string
+	}{
+		{
+			name: "MultipleBlocks",
+
+			in: `
+foo
+bar
+// keep-sorted-test start
+c
+b
+a
+// keep-sorted-test end
+baz
+// keep-sorted-test start
+1
+2
+3
+// keep-sorted-test end
+dog
+cat`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    3,
+					end:      7,
+					lines: []string{
+						"c",
+						"b",
+						"a",
+					},
+				},
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    9,
+					end:      13,
+					lines: []string{
+						"1",
+						"2",
+						"3",
+					},
+				},
+			},
+		},
+		{
+			name: "IncompleteBlocks",
+
+			in: `
+// keep-sorted-test end
+// keep-sorted-test start
+foo
+bar
+// keep-sorted-test start
+baz
+// keep-sorted-test end
+dog
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    5,
+					end:      7,
+					lines: []string{
+						"baz",
+					},
+				},
+			},
+			wantIncompleteBlocks: []incompleteBlock{
+				{1, endDirective},
+				{2, startDirective},
+			},
+		},
+		{
+			name: "FilteredBlocks",
+
+			in: `
+foo
+bar
+// keep-sorted-test start
+c
+b
+a
+// keep-sorted-test end
+baz
+// keep-sorted-test start
+1
+2
+3
+// keep-sorted-test end
+dog
+cat`,
+			include: func(start, end int) bool {
+				return start < 4 && 4 < end
+			},
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    3,
+					end:      7,
+					lines: []string{
+						"c",
+						"b",
+						"a",
+					},
+				},
+			},
+		},
+		{
+			name: "TrailingNewlines",
+
+			in: `
+// keep-sorted-test start
+
+1
+2
+3
+
+
+
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    1,
+					end:      6,
+					lines: []string{
+						"",
+						"1",
+						"2",
+						"3",
+					},
+				},
+			},
+		},
+		{
+			name: "NestedBlocks",
+
+			in: `
+// keep-sorted-test start
+a
+b
+c
+// keep-sorted-test start
+d
+e
+f
+// keep-sorted-test end
+g
+h
+i
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    1,
+					end:      13,
+					lines: []string{
+						"a",
+						"b",
+						"c",
+						"// keep-sorted-test start",
+						"d",
+						"e",
+						"f",
+						"// keep-sorted-test end",
+						"g",
+						"h",
+						"i",
+					},
+					nestedBlocks: []block{
+						{
+							metadata: defaultMetadataWithCommentMarker("//"),
+							start:    5,
+							end:      9,
+							lines: []string{
+								"d",
+								"e",
+								"f",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "NestedBlocks_DeeplyNested",
+
+			in: `
+// keep-sorted-test start
+0.1
+0.2
+0.3
+// keep-sorted-test start
+1.1
+1.2
+1.3
+// keep-sorted-test start
+2.1
+2.2
+2.3
+// keep-sorted-test start
+3.1
+3.2
+3.3
+// keep-sorted-test end // 0:1:2:3
+2.4
+2.5
+2.6
+// keep-sorted-test end // 0:1:2
+// keep-sorted-test start
+4.1
+4.2
+4.3
+// keep-sorted-test end // 0:1:4
+1.4
+1.5
+1.6
+// keep-sorted-test end // 0:1
+0.4
+0.5
+0.6
+// keep-sorted-test end // 0
+// keep-sorted-test start
+5.1
+5.2
+5.3
+// keep-sorted-test end // 5
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    1,
+					end:      34,
+					lines: []string{
+						"0.1",
+						"0.2",
+						"0.3",
+						"// keep-sorted-test start",
+						"1.1",
+						"1.2",
+						"1.3",
+						"// keep-sorted-test start",
+						"2.1",
+						"2.2",
+						"2.3",
+						"// keep-sorted-test start",
+						"3.1",
+						"3.2",
+						"3.3",
+						"// keep-sorted-test end // 0:1:2:3",
+						"2.4",
+						"2.5",
+						"2.6",
+						"// keep-sorted-test end // 0:1:2",
+						"// keep-sorted-test start",
+						"4.1",
+						"4.2",
+						"4.3",
+						"// keep-sorted-test end // 0:1:4",
+						"1.4",
+						"1.5",
+						"1.6",
+						"// keep-sorted-test end // 0:1",
+						"0.4",
+						"0.5",
+						"0.6",
+					},
+					nestedBlocks: []block{
+						{
+							metadata: defaultMetadataWithCommentMarker("//"),
+							start:    5,
+							end:      30,
+							lines: []string{
+								"1.1",
+								"1.2",
+								"1.3",
+								"// keep-sorted-test start",
+								"2.1",
+								"2.2",
+								"2.3",
+								"// keep-sorted-test start",
+								"3.1",
+								"3.2",
+								"3.3",
+								"// keep-sorted-test end // 0:1:2:3",
+								"2.4",
+								"2.5",
+								"2.6",
+								"// keep-sorted-test end // 0:1:2",
+								"// keep-sorted-test start",
+								"4.1",
+								"4.2",
+								"4.3",
+								"// keep-sorted-test end // 0:1:4",
+								"1.4",
+								"1.5",
+								"1.6",
+							},
+							nestedBlocks: []block{
+								{
+									metadata: defaultMetadataWithCommentMarker("//"),
+									start:    9,
+									end:      21,
+									lines: []string{
+										"2.1",
+										"2.2",
+										"2.3",
+										"// keep-sorted-test start",
+										"3.1",
+										"3.2",
+										"3.3",
+										"// keep-sorted-test end // 0:1:2:3",
+										"2.4",
+										"2.5",
+										"2.6",
+									},
+									nestedBlocks: []block{
+										{
+											metadata: defaultMetadataWithCommentMarker("//"),
+											start:    13,
+											end:      17,
+											lines: []string{
+												"3.1",
+												"3.2",
+												"3.3",
+											},
+										},
+									},
+								},
+								{
+									metadata: defaultMetadataWithCommentMarker("//"),
+									start:    22,
+									end:      26,
+									lines: []string{
+										"4.1",
+										"4.2",
+										"4.3",
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    35,
+					end:      39,
+					lines: []string{
+						"5.1",
+						"5.2",
+						"5.3",
+					},
+				},
+			},
+		},
+		{
+			name: "NestedBlocks_MissingEnds",
+
+			in: `
+// keep-sorted-test start
+0
+// keep-sorted-test start
+1
+// keep-sorted-test start
+2
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    5,
+					end:      7,
+					lines:    []string{"2"},
+				},
+			},
+			wantIncompleteBlocks: []incompleteBlock{
+				{1, startDirective},
+				{3, startDirective},
+			},
+		},
+		{
+			name: "BadOption",
+			in: `
+// keep-sorted-test start foo=bar block=yes
+0
+1
+2
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.Block = true
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 1,
+					end:   5,
+					lines: []string{"0", "1", "2"},
+				},
+			},
+			wantWarnings: []string{`unrecognized option "foo"`},
+		},
+		{
+			name: "OptionContinuation",
+			in: `
+// keep-sorted-test start block=yes
+// keep-sorted-test option: numeric=yes
+//   keep-sorted-test option: foo=bar
+0
+1
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.Block = true
+						opts.Numeric = true
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 3,
+					end:   6,
+					lines: []string{"0", "1"},
+				},
+			},
+			wantWarnings: []string{`unrecognized option "foo"`},
+		},
+		{
+			name: "NextLines",
+			in: `
+// keep-sorted-test next 2 lines numeric=yes
+10
+9
+8
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.Numeric = true
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 1,
+					end:   4,
+					lines: []string{"10", "9"},
+				},
+			},
+		},
+		{
+			name: "UntilBlank",
+			in: `
+// keep-sorted-test until-blank
+b
+a
+
+c
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 1,
+					end:   4,
+					lines: []string{"b", "a"},
+				},
+			},
+		},
+		{
+			name: "OneShotStopsAtNextDirective",
+			in: `
+// keep-sorted-test next 5 lines
+b
+a
+// keep-sorted-test until-blank
+d
+c
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 1,
+					end:   4,
+					lines: []string{"b", "a"},
+				},
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 4,
+					end:   7,
+					lines: []string{"d", "c"},
+				},
+			},
+		},
+		{
+			name: "OneShotInsideBlock",
+			in: `
+// keep-sorted-test start
+// keep-sorted-test next 1 lines
+b
+a
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 1,
+					end:   5,
+					lines: []string{"// keep-sorted-test next 1 lines", "b", "a"},
+				},
+			},
+		},
+		{
+			name: "UntilDedent",
+			in: `
+class Foo:
+  # keep-sorted-test start until=dedent
+  b = 2
+  a = [
+    1,
+  ]
+
+def bar():
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.Until = untilDedent
+						opts.setCommentMarker("#")
+						return opts
+					}()),
+					start: 2,
+					end:   7,
+					lines: []string{"  b = 2", "  a = [", "    1,", "  ]"},
+				},
+			},
+		},
+		{
+			name: "UntilDedentInsideBlock",
+			in: `
+// keep-sorted-test start
+  // keep-sorted-test start until=dedent
+  b
+  a
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 1,
+					end:   5,
+					lines: []string{"  // keep-sorted-test start until=dedent", "  b", "  a"},
+				},
+			},
+			wantWarnings: []string{errorNestedUntilDedent},
+		},
+		{
+			name: "File",
+			in: `# Allowlist
+# keep-sorted-test file case=no
+b
+A
+
+c
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.setCommentMarker("#")
+						return opts
+					}()),
+					start: 1,
+					end:   6,
+					lines: []string{"b", "A", "", "c"},
+				},
+			},
+		},
+		{
+			name: "Off",
+			in: `
+// keep-sorted-test off
+// keep-sorted-test start
+b
+a
+// keep-sorted-test end
+// keep-sorted-test on
+// keep-sorted-test start
+2
+1
+// keep-sorted-test end
+// keep-sorted-test off
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWithCommentMarker("//"),
+					start:    7,
+					end:      10,
+					lines:    []string{"2", "1"},
+				},
+			},
+		},
+		{
+			name: "OnIsAWholeWord",
+			in: `
+// keep-sorted-test off
+// keep-sorted-test only applies to real code
+// keep-sorted-test start
+a
+// keep-sorted-test end
+`,
+		},
+		{
+			name: "FileOptions",
+			in: `
+// keep-sorted-test options: block=yes foo=bar
+// keep-sorted-test start numeric=yes
+0
+// keep-sorted-test end
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.Block = true
+						opts.Numeric = true
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 2,
+					end:   4,
+					lines: []string{"0"},
+				},
+			},
+			wantWarnings: []string{`unrecognized option "foo"`},
+		},
+		{
+			name: "FileOptions_AfterBlock",
+			in: `
+// keep-sorted-test start
+0
+// keep-sorted-test end
+// keep-sorted-test options: numeric=yes
+`,
+
+			wantBlocks: []block{
+				{
+					metadata: defaultMetadataWith(func() blockOptions {
+						var opts blockOptions
+						opts.setCommentMarker("//")
+						return opts
+					}()),
+					start: 1,
+					end:   3,
+					lines: []string{"0"},
+				},
+			},
+			wantWarnings: []string{errorLateFileOptions("keep-sorted-test")},
+		},
+		{
+			name: "NextWithoutLineCount",
+			in: `
+// keep-sorted-test next steps are in the design doc
+b
+a
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			initZerolog(t)
+			if tc.include == nil {
+				tc.include = func(start, end int) bool { return true }
+			}
+
+			gotBlocks, gotIncompleteBlocks, gotWarnings := New("keep-sorted-test", BlockOptions{}).newBlocks("unused-filename", strings.Split(tc.in, "\n"), 0, tc.include)
+			if diff := cmp.Diff(tc.wantBlocks, gotBlocks, cmp.AllowUnexported(block{}, blockMetadata{}, blockOptions{})); diff != "" {
+				t.Errorf("blocks diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantIncompleteBlocks, gotIncompleteBlocks, cmp.AllowUnexported(incompleteBlock{})); diff != "" {
+				t.Errorf("incompleteBlocks diff (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tc.wantWarnings, messages(gotWarnings), cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("warnings diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLineSorting(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		opts blockOptions
+		in   []string
+
+		want              []string
+		wantAlreadySorted bool
+	}{
+		{
+			name: "NothingToSort",
+
+			in: []string{},
+
+			want:              []string{},
+			wantAlreadySorted: true,
+		},
+		{
+			name: "AlreadySorted",
+
+			in: []string{
+				"Bar",
+				"Baz",
+				"Foo",
+				"Qux",
+			},
+
+			want: []string{
+				"Bar",
+				"Baz",
+				"Foo",
+				"Qux",
+			},
+			wantAlreadySorted: true,
+		},
+		{
+			name: "AlreadySorted_ExceptForDuplicate",
+
+			opts: blockOptions{
+				RemoveDuplicates: true,
+			},
+			in: []string{
+				"Bar",
+				"Bar",
+				"Foo",
+			},
+
+			want: []string{
+				"Bar",
+				"Foo",
+			},
+			wantAlreadySorted: false,
+		},
+		{
+			name: "AlreadySorted_NewlineSeparated",
+
+			opts: blockOptions{
+				NewlineSeparated: NewlineSeparationYes,
+			},
+			in: []string{
+				"Bar",
+				"",
+				"Baz",
+				"",
+				"Foo",
+			},
+
+			want: []string{
+				"Bar",
+				"",
+				"Baz",
+				"",
+				"Foo",
+			},
+			wantAlreadySorted: true,
+		},
+		{
+			name: "AlreadySorted_ExceptForNewlineSorted",
+
+			opts: blockOptions{
+				NewlineSeparated: NewlineSeparationYes,
+			},
+			in: []string{
+				"Bar",
+				"Baz",
+				"Foo",
+			},
+
+			want: []string{
+				"Bar",
+				"",
+				"Baz",
+				"",
+				"Foo",
+			},
+			wantAlreadySorted: false,
+		},
+		{
+			name: "SimpleSorting",
+
+			in: []string{
+				"Baz",
+				"Foo",
+				"Bar",
+				"Qux",
+			},
+
+			want: []string{
+				"Bar",
+				"Baz",
+				"Foo",
+				"Qux",
+			},
+		},
+		{
+			name: "CommentOnlyBlock",
+
+			opts: func() blockOptions {
+				opts := blockOptions{
+					StickyComments: true,
+				}
+				opts.setCommentMarker("//")
+				return opts
+			}(),
+			in: []string{
+				"2",
+				"1",
+				"// trailing comment",
+			},
+
+			want: []string{
+				"1",
+				"2",
+				"// trailing comment",
+			},
+		},
+		{
+			name: "Prefix",
+
+			opts: blockOptions{
+				PrefixOrder: []string{"INIT_", "", "FINAL_"},
+			},
+			in: []string{
+				// keep-sorted start prefix_order=
+				"DO_SOMETHING_WITH_BAR",
+				"DO_SOMETHING_WITH_FOO",
+				"FINAL_BAR",
+				"FINAL_FOO",
+				"INIT_BAR",
+				"INIT_FOO",
+				// keep-sorted end
+			},
+
+			want: []string{
+				"INIT_BAR",
+				"INIT_FOO",
+				"DO_SOMETHING_WITH_BAR",
+				"DO_SOMETHING_WITH_FOO",
+				"FINAL_BAR",
+				"FINAL_FOO",
+			},
+		},
+		{
+			name: "Prefix_ExplicitWeights",
+
+			opts: blockOptions{
+				PrefixOrder: []string{"INIT_=(-10)", "SETUP_=(-10)", "FINAL_=(10)"},
+			},
+			in: []string{
+				"FINAL_FOO",
+				"SETUP_BAR",
+				"DO_SOMETHING",
+				"INIT_FOO",
+				"INIT_BAR",
+			},
+
+			want: []string{
+				"INIT_BAR",
+				"INIT_FOO",
+				"SETUP_BAR",
+				"DO_SOMETHING",
+				"FINAL_FOO",
+			},
+		},
+		{
+			name: "RemoveDuplicates_ByDefault",
+
+			opts: defaultOptions,
+			in: []string{
+				"foo",
+				"foo",
+				"bar",
+			},
+
+			want: []string{
+				"bar",
+				"foo",
+			},
+		},
+		{
+			name: "RemoveDuplicates_ConsidersComments",
+
+			opts: func() blockOptions {
+				opts := blockOptions{
+					RemoveDuplicates: true,
+					StickyComments:   true,
+				}
+				opts.setCommentMarker("//")
+				return opts
+			}(),
+			in: []string{
+				"// comment 1",
+				"foo",
+				"// comment 2",
+				"foo",
+				"// comment 1",
+				"foo",
+				"bar",
+			},
+
+			want: []string{
+				"bar",
+				"// comment 1",
+				"foo",
+				"// comment 2",
+				"foo",
+			},
+		},
+		{
+			name: "RemoveDuplicates_IgnoresTraliningCommas",
+
+			opts: blockOptions{
+				RemoveDuplicates: true,
+			},
+			in: []string{
+				"foo,",
+				"bar,",
+				"bar",
+			},
+
+			want: []string{
+				"bar,",
+				"foo",
+			},
+		},
+		{
+			name: "RemoveDuplicates_IgnoresTrailingCommas_RemovesCommaIfLastElement",
+
+			opts: blockOptions{
+				RemoveDuplicates: true,
+			},
+			in: []string{
+				"foo,",
+				"foo,",
+				"bar",
+			},
+
+			want: []string{
+				"bar,",
+				"foo",
+			},
+		},
+		{
+			name: "RemoveDuplicates_IgnoresTrailingCommas_RemovesCommaIfOnlyElement",
+
+			opts: blockOptions{
+				RemoveDuplicates: true,
+			},
+			in: []string{
+				"foo,",
+				"foo",
+			},
+
+			want: []string{
+				"foo",
+			},
+		},
+		{
+			name: "RemoveDuplicates_Keep",
+
+			opts: blockOptions{
+				RemoveDuplicates: false,
+			},
+			in: []string{
+				"foo",
+				"foo",
+				"bar",
+			},
+
+			want: []string{
+				"bar",
+				"foo",
+				"foo",
+			},
+		},
+		{
+			name: "TrailingCommas",
+
+			in: []string{
+				"foo,",
+				"baz,",
+				"bar",
+			},
+
+			want: []string{
+				"bar,",
+				"baz,",
+				"foo",
+			},
+		},
+		{
+			name: "TrailingSeparator",
+
+			opts: blockOptions{
+				Separator: " +",
+			},
+			in: []string{
+				"'foo' +",
+				"'baz' +",
+				"'bar'",
+			},
+
+			want: []string{
+				"'bar' +",
+				"'baz' +",
+				"'foo'",
+			},
+		},
+		{
+			name: "JSON",
+
+			opts: blockOptions{
+				JSON: true,
+			},
+			in: []string{
+				`"a b": 1,`,
+				`"a": {`,
+				`  "z": 2`,
+				`},`,
+				`'a\'c': 3,`,
+				`ab: 4`,
+			},
+
+			want: []string{
+				`"a": {`,
+				`  "z": 2`,
+				`},`,
+				`"a b": 1,`,
+				`'a\'c': 3,`,
+				`ab: 4`,
+			},
+		},
+		{
+			name: "Markdown",
+
+			opts: blockOptions{
+				Markdown: true,
+			},
+			in: []string{
+				"1. foo",
+				"2. [bar](bar.md)",
+				"3. baz",
+			},
+
+			want: []string{
+				"2. [bar](bar.md)",
+				"3. baz",
+				"1. foo",
+			},
+		},
+		{
+			name: "Sections",
+
+			opts: blockOptions{
+				Sections: true,
+			},
+			in: []string{
+				"",
+				"c",
+				"a",
+				"",
+				"",
+				"b",
+				"a",
+				"",
+			},
+
+			want: []string{
+				"",
+				"a",
+				"c",
+				"",
+				"",
+				"a",
+				"b",
+				"",
+			},
+		},
+		{
+			name: "Sections_RemoveDuplicates",
+
+			opts: blockOptions{
+				Sections:         true,
+				RemoveDuplicates: true,
+			},
+			in: []string{
+				"b",
+				"a",
+				"",
+				"b",
+				"",
+				"d",
+				"c",
+			},
+
+			want: []string{
+				"a",
+				"b",
+				"",
+				"c",
+				"d",
+			},
+		},
+		{
+			name: "PinFirst_PinLast",
+
+			opts: blockOptions{
+				PinFirst: 2,
+				PinLast:  1,
+			},
+			in: []string{
+				"default",
+				"zz",
+				"c",
+				"a",
+				"b",
+				"fallback",
+			},
+
+			want: []string{
+				"default",
+				"zz",
+				"a",
+				"b",
+				"c",
+				"fallback",
+			},
+		},
+		{
+			name: "PinFirst_Comments",
+
+			opts: blockOptions{
+				PinFirst:       1,
+				StickyComments: true,
+				StickyPrefixes: map[string]bool{"//": true},
+			},
+			in: []string{
+				"// The default",
+				"// must stay first.",
+				"z",
+				"b",
+				"a",
+			},
+
+			want: []string{
+				"// The default",
+				"// must stay first.",
+				"z",
+				"a",
+				"b",
+			},
+		},
+		{
+			name: "PinFirst_AlreadySorted",
+
+			opts: blockOptions{
+				PinFirst: 1,
+			},
+			in: []string{
+				"z",
+				"a",
+				"b",
+			},
+
+			want: []string{
+				"z",
+				"a",
+				"b",
+			},
+			wantAlreadySorted: true,
+		},
+		{
+			name: "NormalizeIndent",
+
+			opts: blockOptions{
+				Block:           true,
+				NormalizeIndent: true,
+			},
+			in: []string{
+				"foo(",
+				"  x)",
+				"  bar(",
+				"    y)",
+				"\tbaz",
+			},
+
+			want: []string{
+				"  bar(",
+				"    y)",
+				"  baz",
+				"  foo(",
+				"    x)",
+			},
+		},
+		{
+			name: "NormalizeIndent_AlreadyNormal",
+
+			opts: blockOptions{
+				NormalizeIndent: true,
+			},
+			in: []string{
+				"  a",
+				"  b",
+			},
 
-			want:              []string{},
+			want: []string{
+				"  a",
+				"  b",
+			},
 			wantAlreadySorted: true,
 		},
 		{
-			name: "AlreadySorted",
+			name: "NormalizeIndent_SortedButMisindented",
 
+			opts: blockOptions{
+				NormalizeIndent: true,
+			},
 			in: []string{
-				"Bar",
-				"Baz",
-				"Foo",
-				"Qux",
+				"  a",
+				"    b",
 			},
 
 			want: []string{
-				"Bar",
-				"Baz",
-				"Foo",
-				"Qux",
+				"  a",
+				"  b",
 			},
-			wantAlreadySorted: true,
 		},
 		{
-			name: "AlreadySorted_ExceptForDuplicate",
+			name: "Preset_GoImports",
 
 			opts: blockOptions{
-				RemoveDuplicates: true,
+				Preset:   "go-imports",
+				Sections: true,
 			},
 			in: []string{
-				"Bar",
-				"Bar",
-				"Foo",
+				`"strings"`,
+				`"fmt"`,
+				"",
+				`yaml "gopkg.in/yaml.v3"`,
+				`_ "embed"`,
+				`"github.com/google/go-cmp/cmp"`,
 			},
 
 			want: []string{
-				"Bar",
-				"Foo",
+				`"fmt"`,
+				`"strings"`,
+				"",
+				`_ "embed"`,
+				`"github.com/google/go-cmp/cmp"`,
+				`yaml "gopkg.in/yaml.v3"`,
 			},
-			wantAlreadySorted: false,
 		},
 		{
-			name: "AlreadySorted_NewlineSeparated",
+			name: "GroupByBlankLines",
 
 			opts: blockOptions{
-				NewlineSeparated: true,
+				GroupBy: "blank_lines",
 			},
 			in: []string{
-				"Bar",
+				"[zebra]",
+				"  stripes = yes",
 				"",
-				"Baz",
 				"",
-				"Foo",
+				"[aardvark]",
+				"snout = long",
+				"",
+				"[bison]",
 			},
 
 			want: []string{
-				"Bar",
+				"[aardvark]",
+				"snout = long",
 				"",
-				"Baz",
 				"",
-				"Foo",
+				"[bison]",
+				"",
+				"[zebra]",
+				"  stripes = yes",
 			},
-			wantAlreadySorted: true,
 		},
 		{
-			name: "AlreadySorted_ExceptForNewlineSorted",
+			name: "GroupByBlankLines_NewlineSeparated",
 
 			opts: blockOptions{
-				NewlineSeparated: true,
+				GroupBy:          "blank_lines",
+				NewlineSeparated: NewlineSeparationYes,
 			},
 			in: []string{
-				"Bar",
-				"Baz",
-				"Foo",
+				"b",
+				"b2",
+				"",
+				"",
+				"a",
 			},
 
 			want: []string{
-				"Bar",
-				"",
-				"Baz",
+				"a",
 				"",
-				"Foo",
+				"b",
+				"b2",
 			},
-			wantAlreadySorted: false,
 		},
 		{
-			name: "SimpleSorting",
+			name: "PairedLines",
 
+			opts: blockOptions{
+				PairedLines: []string{"#if:#endif", "BEGIN:END"},
+			},
 			in: []string{
-				"Baz",
-				"Foo",
-				"Bar",
-				"Qux",
+				"zebra",
+				"#ifdef HAVE_YAK",
+				"yak",
+				"#if WINDOWS",
+				"gnu",
+				"#endif",
+				"#endif",
+				"BEGIN",
+				"mouse",
+				"END",
+				"aardvark",
 			},
 
 			want: []string{
-				"Bar",
-				"Baz",
-				"Foo",
-				"Qux",
+				"#ifdef HAVE_YAK",
+				"yak",
+				"#if WINDOWS",
+				"gnu",
+				"#endif",
+				"#endif",
+				"aardvark",
+				"BEGIN",
+				"mouse",
+				"END",
+				"zebra",
 			},
 		},
 		{
-			name: "CommentOnlyBlock",
+			name: "ByRegex",
 
-			opts: func() blockOptions {
-				opts := blockOptions{
-					StickyComments: true,
-				}
-				opts.setCommentMarker("//")
-				return opts
-			}(),
+			opts: blockOptions{
+				ByRegex: []string{`\w+\(`},
+			},
 			in: []string{
-				"2",
-				"1",
-				"// trailing comment",
+				"return qux(1)",
+				"var x = bar(2)",
+				"baz",
+				"foo(3)",
 			},
 
 			want: []string{
-				"1",
-				"2",
-				"// trailing comment",
+				"var x = bar(2)",
+				"baz",
+				"foo(3)",
+				"return qux(1)",
 			},
 		},
 		{
-			name: "Prefix",
+			name: "ByRegex_CaptureGroups",
 
 			opts: blockOptions{
-				PrefixOrder: []string{"INIT_", "", "FINAL_"},
+				ByRegex: []string{`(\w+)-(\w+)-(\d+)`},
+				Numeric: true,
 			},
 			in: []string{
-				// keep-sorted start prefix_order=
-				"DO_SOMETHING_WITH_BAR",
-				"DO_SOMETHING_WITH_FOO",
-				"FINAL_BAR",
-				"FINAL_FOO",
-				"INIT_BAR",
-				"INIT_FOO",
-				// keep-sorted end
+				"us-west-2",
+				"eu-west-10",
+				"us-east-1",
+				"eu-west-9",
 			},
 
 			want: []string{
-				"INIT_BAR",
-				"INIT_FOO",
-				"DO_SOMETHING_WITH_BAR",
-				"DO_SOMETHING_WITH_FOO",
-				"FINAL_BAR",
-				"FINAL_FOO",
+				"eu-west-9",
+				"eu-west-10",
+				"us-east-1",
+				"us-west-2",
 			},
 		},
 		{
-			name: "RemoveDuplicates_ByDefault",
+			name: "ByRegexPriority",
 
-			opts: defaultOptions,
+			opts: blockOptions{
+				ByRegex:         []string{`(\w+)-(\w+)-(\d+)`},
+				ByRegexPriority: []string{"3", "1"},
+				Numeric:         true,
+			},
 			in: []string{
-				"foo",
-				"foo",
-				"bar",
+				"us-west-2",
+				"eu-west-10",
+				"us-east-1",
+				"eu-west-1",
+				"us-central-1",
 			},
 
 			want: []string{
-				"bar",
-				"foo",
+				"eu-west-1",
+				"us-central-1",
+				"us-east-1",
+				"us-west-2",
+				"eu-west-10",
 			},
 		},
 		{
-			name: "RemoveDuplicates_ConsidersComments",
+			name: "ByComment",
 
 			opts: func() blockOptions {
-				opts := blockOptions{
-					RemoveDuplicates: true,
-					StickyComments:   true,
-				}
+				opts := blockOptions{ByComment: true, Numeric: true}
 				opts.setCommentMarker("//")
 				return opts
 			}(),
 			in: []string{
-				"// comment 1",
-				"foo",
-				"// comment 2",
-				"foo",
-				"// comment 1",
-				"foo",
-				"bar",
+				`foo("http://a"), // priority: 10`,
+				"bar(), // priority: 2",
+				"baz(),",
 			},
 
 			want: []string{
-				"bar",
-				"// comment 1",
-				"foo",
-				"// comment 2",
-				"foo",
+				"baz(),",
+				"bar(), // priority: 2",
+				`foo("http://a"), // priority: 10`,
 			},
 		},
 		{
-			name: "RemoveDuplicates_IgnoresTraliningCommas",
+			name: "ByComment_MarkerInQuotes",
+
+			opts: func() blockOptions {
+				opts := blockOptions{ByComment: true}
+				opts.setCommentMarker("//")
+				return opts
+			}(),
+			in: []string{
+				`a("http://c"),`,
+				`b("http://a"), // b`,
+				`c('//'), // a`,
+				`d("\"//"), // c`,
+			},
+
+			want: []string{
+				`a("http://c"),`,
+				`c('//'), // a`,
+				`b("http://a"), // b`,
+				`d("\"//"), // c`,
+			},
+		},
+		{
+			name: "FoldAccents",
 
 			opts: blockOptions{
-				RemoveDuplicates: true,
+				FoldAccents: true,
 			},
 			in: []string{
-				"foo,",
-				"bar,",
-				"bar",
+				"Zoë",
+				"Émile",
+				"Zoe",
+				"Ethan",
+				"Éva",
+				"Ángel",
 			},
 
 			want: []string{
-				"bar,",
-				"foo",
+				"Ángel",
+				"Émile",
+				"Ethan",
+				"Éva",
+				"Zoe",
+				"Zoë",
 			},
 		},
 		{
-			name: "RemoveDuplicates_IgnoresTrailingCommas_RemovesCommaIfLastElement",
+			name: "FoldAccents_CombiningMarks",
 
 			opts: blockOptions{
-				RemoveDuplicates: true,
+				FoldAccents: true,
 			},
 			in: []string{
-				"foo,",
-				"foo,",
-				"bar",
+				"etui",
+				"e\u0301tude",
 			},
 
 			want: []string{
-				"bar,",
-				"foo",
+				"e\u0301tude",
+				"etui",
 			},
 		},
 		{
-			name: "RemoveDuplicates_IgnoresTrailingCommas_RemovesCommaIfOnlyElement",
+			name: "Preset_Dotenv",
 
 			opts: blockOptions{
-				RemoveDuplicates: true,
+				Preset:         "dotenv",
+				StickyComments: true,
+				StickyPrefixes: map[string]bool{"#": true},
 			},
 			in: []string{
-				"foo,",
-				"foo",
+				"export PATH=/usr/bin",
+				"# Where to listen.",
+				"PORT=8080",
+				"HOST = localhost",
 			},
 
 			want: []string{
-				"foo",
+				"HOST = localhost",
+				"export PATH=/usr/bin",
+				"# Where to listen.",
+				"PORT=8080",
 			},
 		},
 		{
-			name: "RemoveDuplicates_Keep",
+			name: "Preset_Terraform",
 
 			opts: blockOptions{
-				RemoveDuplicates: false,
+				Preset:           "terraform",
+				Block:            true,
+				StickyComments:   true,
+				StickyPrefixes:   map[string]bool{"#": true},
+				NewlineSeparated: NewlineSeparationYes,
 			},
 			in: []string{
-				"foo",
-				"foo",
-				"bar",
+				`resource "aws_s3_bucket" "logs" {`,
+				`  bucket = "logs"`,
+				`}`,
+				``,
+				`# The web server.`,
+				`resource "aws_instance" "web" {`,
+				`  tags = {`,
+				`    Name = "web"`,
+				`  }`,
+				`}`,
+				``,
+				`data "aws_ami" "ubuntu" {`,
+				`  most_recent = true`,
+				`}`,
+				`resource "aws_instance" "db" {`,
+				`}`,
 			},
 
 			want: []string{
-				"bar",
-				"foo",
-				"foo",
+				`data "aws_ami" "ubuntu" {`,
+				`  most_recent = true`,
+				`}`,
+				``,
+				`resource "aws_instance" "db" {`,
+				`}`,
+				``,
+				`# The web server.`,
+				`resource "aws_instance" "web" {`,
+				`  tags = {`,
+				`    Name = "web"`,
+				`  }`,
+				`}`,
+				``,
+				`resource "aws_s3_bucket" "logs" {`,
+				`  bucket = "logs"`,
+				`}`,
 			},
 		},
 		{
-			name: "TrailingCommas",
+			name: "Preset_PipRequirements",
 
+			opts: blockOptions{
+				Preset:         "pip-requirements",
+				StickySuffixes: map[string]bool{`\`: true},
+			},
 			in: []string{
-				"foo,",
-				"baz,",
-				"bar",
+				`zope.interface>=5`,
+				`requests[socks]==2.31.0 ; python_version >= "3.8"`,
+				`Django==4.2 \`,
+				`    --hash=sha256:abc`,
+				`-r base.txt`,
+				`python_dateutil`,
+				`python-dateutil-stubs`,
 			},
 
 			want: []string{
-				"bar,",
-				"baz,",
-				"foo",
+				`-r base.txt`,
+				`Django==4.2 \`,
+				`    --hash=sha256:abc`,
+				`python_dateutil`,
+				`python-dateutil-stubs`,
+				`requests[socks]==2.31.0 ; python_version >= "3.8"`,
+				`zope.interface>=5`,
+			},
+		},
+		{
+			name: "CSV",
+
+			opts: blockOptions{
+				CSV:    true,
+				Column: 2,
+			},
+			in: []string{
+				`1,"Smith, Jane",c`,
+				`2,Doe,b`,
+				`3,"Multi`,
+				`line",a`,
+				`4`,
+			},
+
+			want: []string{
+				`4`,
+				`2,Doe,b`,
+				`3,"Multi`,
+				`line",a`,
+				`1,"Smith, Jane",c`,
 			},
 		},
 		{
@@ -1129,41 +4252,142 @@ func TestLineSorting(t *testing.T) {
 			},
 
 			want: []string{
-				"C3PO_ARM_L",
-				"C3PO_ARM_R",
-				"R2D2_BOLTS_5_MM",
-				"R2D2_BOLTS_10_MM",
-				"C3PO_HEAD",
-				"R4_MOTIVATOR",
-				"R2D2_PROJECTOR",
+				"C3PO_ARM_L",
+				"C3PO_ARM_R",
+				"R2D2_BOLTS_5_MM",
+				"R2D2_BOLTS_10_MM",
+				"C3PO_HEAD",
+				"R4_MOTIVATOR",
+				"R2D2_PROJECTOR",
+			},
+		},
+		{
+			name: "NewlineSeparated",
+
+			opts: blockOptions{
+				NewlineSeparated: NewlineSeparationYes,
+			},
+			in: []string{
+				"B",
+				"",
+				"C",
+				"A",
+			},
+
+			want: []string{
+				"A",
+				"",
+				"B",
+				"",
+				"C",
+			},
+		},
+		{
+			name: "NewlineSeparated_Preserve",
+
+			opts: blockOptions{
+				NewlineSeparated: NewlineSeparationPreserve,
+			},
+			in: []string{
+				"C",
+				"",
+				"",
+				"B",
+				"A",
+				"",
+				"D",
+			},
+
+			want: []string{
+				"A",
+				"",
+				"",
+				"B",
+				"C",
+				"",
+				"D",
+			},
+		},
+		{
+			name: "NewlineSeparated_Preserve_RemovesDuplicates",
+
+			opts: blockOptions{
+				NewlineSeparated: NewlineSeparationPreserve,
+				RemoveDuplicates: true,
+			},
+			in: []string{
+				"B",
+				"",
+				"A",
+				"",
+				"",
+				"B",
+			},
+
+			want: []string{
+				"A",
+				"",
+				"B",
+			},
+		},
+		{
+			name: "OrderFrom",
+
+			opts: blockOptions{
+				manifest: map[string]int{"c": 0, "a": 1},
+			},
+			in: []string{
+				"b,",
+				"a,",
+				"d,",
+				"c",
+			},
+
+			want: []string{
+				"c,",
+				"a,",
+				"b,",
+				"d",
 			},
 		},
 		{
-			name: "NewlineSeparated",
+			name: "Pinned",
 
-			opts: blockOptions{
-				NewlineSeparated: true,
+			in: []string{
+				"c",
+				"default // keep-sorted-test: pin",
+				"b",
+				"a",
+			},
+
+			want: []string{
+				"a",
+				"default // keep-sorted-test: pin",
+				"b",
+				"c",
 			},
+		},
+		{
+			name: "Pinned_AlreadySorted",
+
 			in: []string{
-				"B",
-				"",
-				"C",
-				"A",
+				"a",
+				"z // keep-sorted-test: pin",
+				"b",
 			},
 
 			want: []string{
-				"A",
-				"",
-				"B",
-				"",
-				"C",
+				"a",
+				"z // keep-sorted-test: pin",
+				"b",
 			},
+			wantAlreadySorted: true,
 		},
 		{
 			name: "NewlineSeparated_Empty",
 
 			opts: blockOptions{
-				NewlineSeparated: true,
+				NewlineSeparated: NewlineSeparationYes,
 			},
 			in: []string{},
 
@@ -1196,8 +4420,8 @@ func TestLineGrouping(t *testing.T) {
 			name: "Simple",
 
 			want: []lineGroup{
-				{nil, []string{"foo"}},
-				{nil, []string{"bar"}},
+				{lines: []string{"foo"}},
+				{lines: []string{"bar"}},
 			},
 		},
 		{
@@ -1212,23 +4436,87 @@ func TestLineGrouping(t *testing.T) {
 
 			want: []lineGroup{
 				{
-					[]string{
+					comment: []string{
 						"// comment 1",
 						"// comment 2",
 					},
-					[]string{
+					lines: []string{
 						"foo",
 					},
 				},
 				{
-					[]string{
+					comment: []string{
 						"// comment 3",
-					}, []string{
+					}, lines: []string{
+						"bar",
+					},
+				},
+			},
+		},
+		{
+			name: "StickyComments_MultiLine",
+			opts: func() blockOptions {
+				opts := blockOptions{
+					StickyComments: true,
+				}
+				opts.setCommentMarker("/*")
+				return opts
+			}(),
+
+			want: []lineGroup{
+				{
+					comment: []string{
+						"/* comment 1",
+						" * comment 2",
+						" */",
+					},
+					lines: []string{
+						"foo",
+					},
+				},
+				{
+					comment: []string{
+						"/* comment 3 */",
+					}, lines: []string{
 						"bar",
 					},
 				},
 			},
 		},
+		{
+			name: "StickySuffixes",
+			opts: blockOptions{
+				StickySuffixes: map[string]bool{`\`: true, "&&": true},
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					`foo \`,
+					"  --bar &&",
+					"baz",
+				}},
+				{lines: []string{
+					"qux",
+				}},
+			},
+		},
+		{
+			name: "Group_TabWidth",
+			opts: blockOptions{
+				Group:    true,
+				TabWidth: 4,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"    foo(",
+					"\t\tbar)",
+				}},
+				{lines: []string{
+					"\tbaz",
+				}},
+			},
+		},
 		{
 			name: "CommentOnlyGroup",
 			opts: func() blockOptions {
@@ -1241,18 +4529,18 @@ func TestLineGrouping(t *testing.T) {
 
 			want: []lineGroup{
 				{
-					[]string{
+					comment: []string{
 						"// comment 1",
 					},
-					[]string{
+					lines: []string{
 						"foo",
 					},
 				},
 				{
-					[]string{
+					comment: []string{
 						"// trailing comment",
 					},
-					nil,
+					lines: nil,
 				},
 			},
 		},
@@ -1263,11 +4551,11 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					"  foo",
 					"    bar",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"  baz",
 				}},
 			},
@@ -1280,21 +4568,21 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					"peanut butter",
 					"and jelly",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"spaghetti",
 					"with meatballs",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"hamburger",
 					"  with lettuce",
 					" and tomatoes",
 					"and cheese",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"dogs and cats",
 				}},
 			},
@@ -1306,18 +4594,18 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					"  foo",
 					"", // Since the next non-empty line has the correct indent.
 					"    bar",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"", // Next non-empty line has the wrong indent.
 				}},
-				{nil, []string{
+				{lines: []string{
 					"  baz",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"", // There is no next non-empty line.
 				}},
 			},
@@ -1334,19 +4622,19 @@ func TestLineGrouping(t *testing.T) {
 			}(),
 
 			want: []lineGroup{
-				{[]string{
+				{comment: []string{
 					"// def",
 					"// keep-sorted-test start",
-				}, []string{
+				}, lines: []string{
 					"3",
 					"1",
 					"2",
 					"// keep-sorted-test end",
 				}},
-				{[]string{
+				{comment: []string{
 					"// abc",
 					"// keep-sorted-test start",
-				}, []string{
+				}, lines: []string{
 					"b",
 					"c",
 					"a",
@@ -1361,16 +4649,16 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					"foo(",
 					"abcd",
 					"efgh",
 					")",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"bar()",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"baz",
 				}},
 			},
@@ -1382,16 +4670,16 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					`foo"`,
 					"abcd",
 					"efgh",
 					`"`,
 				}},
-				{nil, []string{
+				{lines: []string{
 					`bar""`,
 				}},
-				{nil, []string{
+				{lines: []string{
 					"baz",
 				}},
 			},
@@ -1403,16 +4691,16 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					`foo"`,
 					`\"abcd`,
 					`efgh\"`,
 					`"`,
 				}},
-				{nil, []string{
+				{lines: []string{
 					`bar""`,
 				}},
-				{nil, []string{
+				{lines: []string{
 					"baz",
 				}},
 			},
@@ -1424,16 +4712,16 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					`foo"`,
 					`ab'cd`,
 					`efgh`,
 					`"`,
 				}},
-				{nil, []string{
+				{lines: []string{
 					"bar'`'",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"baz",
 				}},
 			},
@@ -1445,13 +4733,13 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					`foo"`,
 					`ab(cd`,
 					`ef[gh`,
 					`"`,
 				}},
-				{nil, []string{
+				{lines: []string{
 					`foo"`,
 					`ab)cd`,
 					`ef]gh`,
@@ -1470,18 +4758,18 @@ func TestLineGrouping(t *testing.T) {
 			}(),
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					"foo(",
 					"// ignores quotes in a comment '",
 					"// ignores parenthesis in a comment )",
 					"abcd",
 					")",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"'string literal",
 					"// does not ignore quotes here '",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"abcd'",
 				}},
 			},
@@ -1497,20 +4785,20 @@ func TestLineGrouping(t *testing.T) {
 			}(),
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					"foo(// ignores quotes in a comment '",
 					"abcd // ignores parenthesis in a comment )",
 					")",
 				}},
-				{nil, []string{
+				{lines: []string{
 					"'string literal",
 					"with line break // does not ignore quotes here '",
 				}},
-				{nil, []string{
+				{lines: []string{
 					`"another string literal`,
 					`with line break // does not ignore quote " here`,
 				}},
-				{nil, []string{
+				{lines: []string{
 					`"abcd"`,
 				}},
 			},
@@ -1522,7 +4810,7 @@ func TestLineGrouping(t *testing.T) {
 			},
 
 			want: []lineGroup{
-				{nil, []string{
+				{lines: []string{
 					`"""documentation`,
 					"ab'cd",
 					"efgh",
@@ -1530,6 +4818,326 @@ func TestLineGrouping(t *testing.T) {
 					`"""`}},
 			},
 		},
+		{
+			name: "Block_Heredoc",
+			opts: blockOptions{
+				Block: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"cat <<-EOF > foo.txt",
+					"  unbalanced (",
+					"  EOF",
+				}},
+				{lines: []string{
+					"echo $((1<<FOO))",
+				}},
+				{lines: []string{
+					"cat <<'A' <<B",
+					"a",
+					"A",
+					"b",
+					"B",
+				}},
+			},
+		},
+		{
+			name: "Block_BackslashContinuation",
+			opts: blockOptions{
+				Block: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					`#define MAX(a, b) \`,
+					`  ((a) > (b) ? \`,
+					"   (a) : (b))",
+				}},
+				{lines: []string{
+					"#define MIN(a, b) ((a) < (b) ? (a) : (b))",
+				}},
+			},
+		},
+		{
+			name: "Block_AngleBrackets",
+			opts: blockOptions{
+				Block:         true,
+				AngleBrackets: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"Map<String,",
+					"    List<Integer>> foo;",
+				}},
+				{lines: []string{
+					"boolean bar = a < b;",
+				}},
+				{lines: []string{
+					"boolean qux = a<b;",
+				}},
+				{lines: []string{
+					"if (a<b) {",
+					"}",
+				}},
+				{lines: []string{
+					"boolean quux = a<b && c>d;",
+				}},
+				{lines: []string{
+					"List<Map<String, Integer>> corge = new ArrayList<>();",
+				}},
+				{lines: []string{
+					"Function<?, ?> baz = x -> x;",
+				}},
+			},
+		},
+		{
+			name: "XML",
+			opts: blockOptions{
+				XML: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"<dependency>",
+					"  <artifactId>foo</artifactId>",
+					"  <!-- <unclosed> -->",
+					"</dependency>",
+				}},
+				{lines: []string{
+					"<dependency",
+					`    optional="true">`,
+					"  <artifactId>bar</artifactId>",
+					"</dependency>",
+				}},
+				{lines: []string{
+					"<li>Don't break on quotes<br></li>",
+				}},
+				{lines: []string{
+					`<img alt="a > b"`,
+					`     title='c>d' src="e.png">`,
+				}},
+				{lines: []string{
+					"<dependency/>",
+				}},
+			},
+		},
+		{
+			name: "YAML_Mapping",
+			opts: blockOptions{
+				YAML: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"foo:",
+					"- a",
+					"- b",
+				}},
+				{lines: []string{
+					"bar: |",
+					"  first line",
+					"",
+					"  after a blank line",
+				}},
+				{lines: []string{
+					"baz:",
+					"  qux: 1",
+				}},
+			},
+		},
+		{
+			name: "YAML_Sequence",
+			opts: blockOptions{
+				YAML: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"- name: a",
+					"  value: 1",
+				}},
+				{lines: []string{
+					"- name: b",
+				}},
+			},
+		},
+		{
+			name: "Markdown",
+			opts: blockOptions{
+				Markdown: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"- [ ] foo",
+					"  - sub-item",
+					"",
+					"  another paragraph",
+				}},
+				{lines: []string{
+					"- [x] bar",
+					"lazy continuation",
+				}},
+				{lines: []string{
+					"",
+				}},
+				{lines: []string{
+					"1. baz",
+				}},
+			},
+		},
+		{
+			name: "Block_Group",
+			opts: blockOptions{
+				Block: true,
+				Group: true,
+				Lang:  "python",
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"def b(",
+					"x, y):",
+					"    return call(",
+					"x,",
+					"    )",
+				}},
+				{lines: []string{
+					"def a():",
+					`    s = """`,
+					`not indented`,
+					`"""`,
+					"    return s",
+				}},
+			},
+		},
+		{
+			name: "Preprocessor",
+			opts: blockOptions{
+				Preprocessor: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"#ifdef HAVE_YAK",
+					"#  if YAK_VERSION > 2",
+					"yak2();",
+					"#  else",
+					"yak();",
+					"#  endif",
+					"# endif",
+				}},
+				{lines: []string{
+					"#include <aardvark.h>",
+				}},
+				{lines: []string{
+					"  #ifndef NO_BISON",
+					"  bison();",
+					"  #endif",
+				}},
+				{lines: []string{
+					"zebra();",
+				}},
+			},
+		},
+		{
+			name: "Block_Lang_Rust",
+			opts: blockOptions{
+				Block: true,
+				Lang:  "rust",
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					`fn foo<'a>(x: &'a str) -> &'a str {`,
+					"  x",
+					"}",
+				}},
+				{lines: []string{
+					`r#"raw "string"`,
+					`with a line break"#`,
+				}},
+				{lines: []string{
+					`br##"raw "#string"##`,
+				}},
+				{lines: []string{
+					`"escaped backslash \\"`,
+				}},
+			},
+		},
+		{
+			name: "Block_BacktickWithoutLang",
+			opts: blockOptions{
+				Block: true,
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"foo(`C:\\`)",
+				}},
+				{lines: []string{
+					"bar(`escaped \\` backtick`)",
+				}},
+				{lines: []string{
+					"baz(`raw",
+					"string`)",
+				}},
+			},
+		},
+		{
+			name: "Block_Lang_Go",
+			opts: blockOptions{
+				Block: true,
+				Lang:  "go",
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					"foo(`C:\\`)",
+				}},
+				{lines: []string{
+					"bar(`raw",
+					"string`)",
+				}},
+			},
+		},
+		{
+			name: "Block_Lang_Python",
+			opts: blockOptions{
+				Block: true,
+				Lang:  "python",
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					`foo(r"C:\\")`,
+				}},
+				{lines: []string{
+					`bar("\\\"", (`,
+					"  1,",
+					`))`,
+				}},
+			},
+		},
+		{
+			name: "Block_Lang_Shell",
+			opts: blockOptions{
+				Block: true,
+				Lang:  "shell",
+			},
+
+			want: []lineGroup{
+				{lines: []string{
+					`echo 'no escapes\'`,
+				}},
+				{lines: []string{
+					`echo "escaped \"`,
+					`quote"`,
+				}},
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			initZerolog(t)
@@ -1547,6 +5155,26 @@ func TestLineGrouping(t *testing.T) {
 	}
 }
 
+func TestDedupSet_HashCollisions(t *testing.T) {
+	s := newDedupSet(func(lg lineGroup) string { return lg.joinedLines() })
+	// Every key has the same hash, so only the keys themselves tell the groups
+	// apart.
+	s.hash = func(string) uint64 { return 0 }
+
+	for i, l := range []string{"foo", "bar", "baz"} {
+		if _, found := s.addOrFind(lineGroup{lines: []string{l}}, i); found {
+			t.Errorf("addOrFind(%q) found a group, want none", l)
+		}
+	}
+	e, found := s.addOrFind(lineGroup{lines: []string{"bar"}}, 3)
+	if !found || e.value != 1 {
+		t.Errorf("addOrFind(%q) = %d, %t, want 1, true", "bar", e.value, found)
+	}
+	if got, want := s.len(), 3; got != want {
+		t.Errorf("len() = %d, want %d", got, want)
+	}
+}
+
 func messages(fs []*Finding) []string {
 	var ret []string
 	for _, f := range fs {
@@ -1560,3 +5188,53 @@ func automaticReplacement(start, end int, s string) Fix {
 	repl.automatic = true
 	return repl
 }
+
+func TestMergeLineRanges(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+
+		in []LineRange
+
+		want []LineRange
+	}{
+		{
+			name: "Empty",
+		},
+		{
+			name: "Disjoint",
+			in:   []LineRange{{7, 9}, {1, 3}},
+			want: []LineRange{{1, 3}, {7, 9}},
+		},
+		{
+			name: "Overlapping",
+			in:   []LineRange{{1, 5}, {3, 8}, {2, 4}},
+			want: []LineRange{{1, 8}},
+		},
+		{
+			name: "Adjacent",
+			in:   []LineRange{{1, 3}, {4, 6}},
+			want: []LineRange{{1, 6}},
+		},
+		{
+			name: "Reversed",
+			in:   []LineRange{{9, 7}, {2, 2}},
+			want: []LineRange{{2, 2}, {7, 9}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, mergeLineRanges(tc.in)); diff != "" {
+				t.Errorf("mergeLineRanges(%v) mismatch (-want +got):\n%s", tc.in, diff)
+			}
+		})
+	}
+}
+
+func TestIncludeModifiedLines_Reversed(t *testing.T) {
+	include := includeModifiedLines([]LineRange{{10, 5}})
+	if !include(6, 8) {
+		t.Errorf("includeModifiedLines(10:5)(6, 8) = false, want true")
+	}
+	if include(11, 12) {
+		t.Errorf("includeModifiedLines(10:5)(11, 12) = true, want false")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"maps"
+	"slices"
+)
+
+// language describes the syntax of a programming language, so that block=yes
+// doesn't have to rely on heuristics that work reasonably well for most
+// languages.
+type language struct {
+	commentMarker string
+	// quotes are checked in order, so longer delimiters should come first.
+	quotes []quote
+	// Whether the language has heredocs (<<EOF).
+	heredocs bool
+}
+
+var languages = map[string]language{
+	"go": {
+		commentMarker: "//",
+		quotes: []quote{
+			{start: "`", end: "`"},
+			{start: `"`, end: `"`, escapable: true},
+			{start: `'`, end: `'`, escapable: true},
+		},
+	},
+	"python": {
+		commentMarker: "#",
+		quotes: []quote{
+			{start: `"""`, end: `"""`},
+			{start: `'''`, end: `'''`},
+			{start: `"`, end: `"`, escapable: true},
+			{start: `'`, end: `'`, escapable: true},
+		},
+	},
+	"rust": {
+		commentMarker: "//",
+		// Single quotes are left out since they're also used for lifetimes.
+		quotes: []quote{
+			{start: `r"`, end: `"`, hashes: true},
+			{start: `"`, end: `"`, escapable: true},
+		},
+	},
+	"shell": {
+		commentMarker: "#",
+		quotes: []quote{
+			{start: `"`, end: `"`, escapable: true},
+			{start: `'`, end: `'`},
+			{start: "`", end: "`", escapable: true},
+		},
+		heredocs: true,
+	},
+	"sql": {
+		commentMarker: "--",
+		// SQL escapes quotes by doubling them, which naturally keeps them
+		// balanced.
+		quotes: []quote{
+			{start: `'`, end: `'`},
+			{start: `"`, end: `"`},
+		},
+	},
+}
+
+func knownLanguages() []string {
+	return slices.Sorted(maps.Keys(languages))
+}
@@ -18,6 +18,7 @@ import (
 	"cmp"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 	"unicode"
 
@@ -29,10 +30,27 @@ import (
 type lineGroup struct {
 	comment []string
 	lines   []string
+	// If non-nil, the precomputed sort keys of this group. See withSortKeys.
+	keys *sortKeys
+	// Whether this group is one of the first or last groups of its block that
+	// pin_first or pin_last keep in place. See pinEnds.
+	pinnedEnd bool
+}
+
+// sortKeys are the parts of the sort key of a lineGroup that are expensive to
+// compute. Sorting compares every group many times, so they're computed once
+// per group up front instead of on every comparison.
+type sortKeys struct {
+	joined string
+	tokens []numericTokens
 }
 
 // groupLines splits lines into one or more lineGroups based on the provided options.
 func groupLines(lines []string, metadata blockMetadata) []lineGroup {
+	if metadata.opts.GroupBy == groupByBlankLines {
+		return groupParagraphs(lines)
+	}
+
 	var groups []lineGroup
 	// Tracks which subsection of lines contains the comments for the current lineGroup.
 	var commentRange indexRange
@@ -54,15 +72,31 @@ func groupLines(lines []string, metadata blockMetadata) []lineGroup {
 
 	// block=yes: The code block that we're constructing until we have matched braces and quotations.
 	var block codeBlock
+	// xml=yes: The elements that we're constructing until we have matched tags.
+	var elements xmlElements
+	// yaml=yes: The mapping entry or sequence item that we're constructing.
+	var entry yamlEntry
+	// markdown=yes: The list item that we're constructing.
+	var item markdownItem
+	// paired_lines: The pairs of lines that we haven't seen the end of yet.
+	var paired pairedLines
+	pairs := metadata.opts.pairedLines()
+	// csv=yes: The number of double quotes in the record that we're
+	// constructing. Quoted fields may contain line breaks.
+	var csvQuotes int
 
-	if metadata.opts.Group {
-		indents = calculateIndents(lines)
+	// The marker that ends the multi-line sticky comment we're in the middle of
+	// (e.g. "*/"), if any.
+	var commentEnd string
+
+	if metadata.opts.Group || metadata.opts.YAML || metadata.opts.Markdown {
+		indents = calculateIndents(lines, metadata.opts.TabWidth)
 	}
 
 	countStartDirectives := func(l string) {
-		if strings.Contains(l, metadata.startDirective) {
+		if metadata.startsBlock(l) {
 			numUnmatchedStartDirectives++
-		} else if strings.Contains(l, metadata.endDirective) {
+		} else if metadata.endsBlock(l) {
 			numUnmatchedStartDirectives--
 		}
 	}
@@ -70,9 +104,27 @@ func groupLines(lines []string, metadata blockMetadata) []lineGroup {
 	// append a line to both lineRange, and block, if necessary.
 	appendLine := func(i int, l string) {
 		lineRange.append(i)
-		if metadata.opts.Block {
+		if metadata.opts.Block || metadata.opts.JSON {
 			block.append(l, metadata.opts)
 		}
+		if metadata.opts.XML {
+			elements.append(l)
+		}
+		if metadata.opts.YAML {
+			entry.append(l, indents[i])
+		}
+		if metadata.opts.Markdown {
+			item.append(l, indents[i])
+		}
+		if metadata.opts.CSV {
+			csvQuotes += strings.Count(l, `"`)
+		}
+		if len(pairs) > 0 {
+			if metadata.opts.Preprocessor {
+				l = compactDirective(l)
+			}
+			paired.append(l, pairs)
+		}
 		if metadata.opts.Group {
 			countStartDirectives(l)
 		}
@@ -88,10 +140,34 @@ func groupLines(lines []string, metadata blockMetadata) []lineGroup {
 		commentRange = indexRange{}
 		lineRange = indexRange{}
 		block = codeBlock{}
-		log.Printf("%#v", groups[len(groups)-1])
+		elements = xmlElements{}
+		entry = yamlEntry{}
+		item = markdownItem{}
+		csvQuotes = 0
+		paired = pairedLines{}
+		if log.Debug().Enabled() {
+			log.Printf("%#v", groups[len(groups)-1])
+		}
 	}
 	for i, l := range lines {
-		if metadata.opts.Block && !lineRange.empty() && block.expectsContinuation() {
+		if commentEnd != "" {
+			commentRange.append(i)
+			if strings.Contains(l, commentEnd) {
+				commentEnd = ""
+			}
+		} else if (metadata.opts.Block || metadata.opts.JSON) && !lineRange.empty() && block.expectsContinuation() {
+			appendLine(i, l)
+		} else if metadata.opts.XML && !lineRange.empty() && elements.expectsContinuation() {
+			appendLine(i, l)
+		} else if metadata.opts.YAML && !lineRange.empty() && entry.continuesWith(l, indents[i]) {
+			appendLine(i, l)
+		} else if metadata.opts.Markdown && !lineRange.empty() && item.continuesWith(l, indents[i]) {
+			appendLine(i, l)
+		} else if metadata.opts.CSV && !lineRange.empty() && csvQuotes%2 == 1 {
+			appendLine(i, l)
+		} else if !lineRange.empty() && paired.expectsContinuation() {
+			appendLine(i, l)
+		} else if !lineRange.empty() && metadata.opts.hasStickySuffix(lines[lineRange.end-1]) {
 			appendLine(i, l)
 		} else if metadata.opts.Group && (!lineRange.empty() && initialIndent != nil && indents[i] > *initialIndent || numUnmatchedStartDirectives > 0) {
 			appendLine(i, l)
@@ -102,7 +178,7 @@ func groupLines(lines []string, metadata blockMetadata) []lineGroup {
 				finishGroup()
 			}
 
-			if metadata.opts.Group && strings.Contains(l, metadata.startDirective) {
+			if metadata.opts.Group && metadata.startsBlock(l) {
 				// We don't need to check for end directives here because this makes
 				// numUnmatchedStartDirectives > 0, so we'll take the code path above through appendLine.
 				if lineRange.empty() {
@@ -113,6 +189,7 @@ func groupLines(lines []string, metadata blockMetadata) []lineGroup {
 				}
 			} else {
 				commentRange.append(i)
+				commentEnd = unterminatedMultiLineComment(l)
 			}
 		} else {
 			if !lineRange.empty() {
@@ -127,13 +204,35 @@ func groupLines(lines []string, metadata blockMetadata) []lineGroup {
 	return groups
 }
 
+// groupParagraphs makes a lineGroup out of every paragraph in lines. Each blank
+// line between the paragraphs is a lineGroup of its own.
+func groupParagraphs(lines []string) []lineGroup {
+	var groups []lineGroup
+	var paragraph indexRange
+	for i, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			paragraph.append(i)
+			continue
+		}
+		if !paragraph.empty() {
+			groups = append(groups, lineGroup{lines: slice(lines, paragraph)})
+			paragraph = indexRange{}
+		}
+		groups = append(groups, lineGroup{lines: lines[i : i+1]})
+	}
+	if !paragraph.empty() {
+		groups = append(groups, lineGroup{lines: slice(lines, paragraph)})
+	}
+	return groups
+}
+
 // calculateIndents precalculates the indentation for each line.
 // We do this precalculation so that we don't get bad worst-case behavior if
 // someone had a bunch of newlines in a group=yes block.
-func calculateIndents(lines []string) []int {
+func calculateIndents(lines []string, tabWidth int) []int {
 	ret := make([]int, len(lines))
 	for i, l := range lines {
-		indent, ok := countIndent(l)
+		indent, ok := countIndent(l, tabWidth)
 		if !ok {
 			indent = -1
 		}
@@ -158,19 +257,90 @@ func calculateIndents(lines []string) []int {
 }
 
 // countIndent counts how many space characters occur at the beginning of s.
-func countIndent(s string) (indent int, hasNonSpaceCharacter bool) {
+// If tabWidth is positive, a tab advances the indent to the next multiple of
+// tabWidth instead of counting as a single space.
+func countIndent(s string, tabWidth int) (indent int, hasNonSpaceCharacter bool) {
 	c := 0
 	for _, ch := range s {
-		if unicode.IsSpace(ch) {
+		if !unicode.IsSpace(ch) {
+			return c, true
+		}
+		if ch == '\t' && tabWidth > 0 {
+			c = (c/tabWidth + 1) * tabWidth
+		} else {
 			c++
-			continue
 		}
-		break
 	}
-	if c == len(s) {
-		return 0, false
+	return 0, false
+}
+
+// oddIndentation returns the first whitespace character in the indentation
+// of s that isn't a space or a tab, e.g. a non-breaking space or a form feed.
+// countIndent counts those as a single space, which probably isn't how they
+// look.
+func oddIndentation(s string) (rune, bool) {
+	for _, ch := range s {
+		if !unicode.IsSpace(ch) {
+			break
+		}
+		if ch != ' ' && ch != '\t' && ch != '\r' && ch != '\n' {
+			return ch, true
+		}
 	}
-	return c, true
+	return 0, false
+}
+
+// normalizeIndent re-indents every group in groups like the first one: the
+// leading whitespace of each group's first line is replaced with the leading
+// whitespace of the first group's first line, and the group's other lines are
+// shifted along with it. Blank lines, and lines that are indented less than the
+// first line of their group, are left alone. It reports whether anything
+// changed. groups itself is never modified.
+func normalizeIndent(groups []lineGroup) (normalized []lineGroup, changed bool) {
+	indent := func(lg lineGroup) (string, bool) {
+		for _, l := range lg.allLines() {
+			if rest := strings.TrimLeftFunc(l, unicode.IsSpace); rest != "" {
+				return l[:len(l)-len(rest)], true
+			}
+		}
+		return "", false
+	}
+	var want string
+	found := false
+	for _, lg := range groups {
+		if want, found = indent(lg); found {
+			break
+		}
+	}
+	if !found {
+		return groups, false
+	}
+
+	reindent := func(lines []string, from string) []string {
+		if lines == nil {
+			return nil
+		}
+		out := make([]string, len(lines))
+		for i, l := range lines {
+			if strings.TrimSpace(l) != "" && strings.HasPrefix(l, from) {
+				l = want + l[len(from):]
+			}
+			out[i] = l
+		}
+		return out
+	}
+	normalized = make([]lineGroup, len(groups))
+	for i, lg := range groups {
+		normalized[i] = lg
+		have, ok := indent(lg)
+		if !ok || have == want {
+			continue
+		}
+		changed = true
+		normalized[i].comment = reindent(lg.comment, have)
+		normalized[i].lines = reindent(lg.lines, have)
+	}
+	return normalized, changed
 }
 
 // indexRange is a helper struct that let us gradually figure out how big a
@@ -206,7 +376,7 @@ func slice(s []string, r indexRange) []string {
 }
 
 var (
-	braces = []struct {
+	braces = [...]struct {
 		open  string
 		close string
 	}{
@@ -214,25 +384,123 @@ var (
 		{"[", "]"},
 		{"(", ")"},
 	}
-	quotes = []string{
-		`"""`, `'''`, "```",
-		`"`, `'`, "`",
+	defaultQuotes = []quote{
+		{start: `"""`, end: `"""`}, {start: `'''`, end: `'''`}, {start: "```", end: "```"},
+		{start: `"`, end: `"`, escapable: true}, {start: `'`, end: `'`, escapable: true}, {start: "`", end: "`", escapable: true, lastEndUnescaped: true},
+	}
+	multiLineComments = []struct {
+		start string
+		end   string
+	}{
+		{"/*", "*/"},
+		{"<!--", "-->"},
 	}
 )
 
+// unterminatedMultiLineComment determines whether s starts a multi-line
+// comment that isn't terminated on the same line. If so, it returns the marker
+// that terminates the comment.
+func unterminatedMultiLineComment(s string) string {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	for _, c := range multiLineComments {
+		if rest, ok := strings.CutPrefix(s, c.start); ok && !strings.Contains(rest, c.end) {
+			return c.end
+		}
+	}
+	return ""
+}
+
+// quote describes the delimiters of a string literal.
+type quote struct {
+	start, end string
+	// Whether a backslash in front of a delimiter makes it part of the string
+	// literal instead. Backslashes can escape themselves, so only an odd number
+	// of them does.
+	escapable bool
+	// Whether any number of # may follow the first character of start, in which
+	// case end has to be followed by just as many, like Rust's r#"..."#.
+	hashes bool
+	// Whether an escaped end still ends the string literal if it's the last one
+	// on the line. Without a lang, that's how `C:\` is read as a Go raw string
+	// while \` can still escape a backtick in a shell command.
+	lastEndUnescaped bool
+}
+
+// endsAt reports whether the string literal that q starts ends at position i
+// of s.
+func (q *quote) endsAt(s string, i int) bool {
+	if !strings.HasPrefix(s[i:], q.end) {
+		return false
+	}
+	if !q.escapable || !isEscaped(s, i) {
+		return true
+	}
+	return q.lastEndUnescaped && !strings.Contains(s[i+len(q.end):], q.end)
+}
+
 // codeBlock is a helper struct that let us try to understand if a section of
 // code expects more lines to be "complete".
 type codeBlock struct {
-	braceCounts   map[string]int
-	expectedQuote string
+	// The number of opening minus the number of closing braces, for each of
+	// braces.
+	braceCounts   [len(braces)]int
+	expectedQuote *quote
+	// The heredocs that were started but haven't been terminated yet, in the
+	// order their content appears.
+	heredocs []heredoc
+	// Whether the last line ended with a backslash.
+	lineContinuation bool
+	// The number of unmatched angle brackets if AngleBrackets is enabled.
+	angleBrackets int
+	// Whether quotes are treated like any other character, e.g. for prose
+	// where an apostrophe doesn't start a string.
+	ignoreQuotes bool
+}
+
+// balance summarizes how the braces and quotes of a sequence of lines match
+// up, according to codeBlock. Sorting lines shouldn't change their balance.
+type balance struct {
+	braceCounts [len(braces)]int
+	// Whether a brace was ever closed before it was opened.
+	unopened     bool
+	openQuote    bool
+	openHeredocs int
+}
+
+func balanceOf(lines []string, opts blockOptions) balance {
+	var cb codeBlock
+	var unopened bool
+	for _, l := range lines {
+		cb.append(l, opts)
+		for _, n := range cb.braceCounts {
+			unopened = unopened || n < 0
+		}
+	}
+	return balance{
+		braceCounts:  cb.braceCounts,
+		unopened:     unopened,
+		openQuote:    cb.expectedQuote != nil,
+		openHeredocs: len(cb.heredocs),
+	}
 }
 
+// heredoc is a here document (e.g. <<EOF) in shell, Ruby, or Perl.
+type heredoc struct {
+	delimiter string
+	// Whether the terminating delimiter may be indented (e.g. <<-EOF or <<~EOF).
+	indented bool
+}
+
+// heredocStart matches the start of a heredoc.
+var heredocStart = regexp.MustCompile(`^<<([-~]?)["']?([A-Za-z_][A-Za-z0-9_]*)["']?`)
+
 // expectsContinuation determines whether it seems like the lines seen so far
 // expect a continuation of characters.
 //
 // Current naive definition of this is to just see if the typically balanced
-// symbols (parenthesis, square brackets, braces, and quotes) are balanced. If
-// not, we'll assume the next line is a continuation. Quotation marks within
+// symbols (parenthesis, square brackets, braces, and quotes) are balanced,
+// every heredoc is terminated, and the last line doesn't end with a backslash.
+// If not, we'll assume the next line is a continuation. Quotation marks within
 // strings are ignored. This could be extended in the future (and possibly
 // controlled by further options).
 //
@@ -240,69 +508,430 @@ type codeBlock struct {
 // - Parenthesis, square brackets, and braces could appear in any order
 // - Parenthesis, square brackets, and braces within strings aren't ignored
 func (cb *codeBlock) expectsContinuation() bool {
-	for _, b := range braces {
-		if cb.braceCounts[b.open] != cb.braceCounts[b.close] {
+	for _, n := range cb.braceCounts {
+		if n != 0 {
 			return true
 		}
 	}
 
-	return cb.expectedQuote != ""
+	return cb.expectedQuote != nil || len(cb.heredocs) > 0 || cb.lineContinuation || cb.angleBrackets > 0
 }
 
 // append the given line to this codeblock, and update expectsContinuation appropriately.
 func (cb *codeBlock) append(s string, opts blockOptions) {
-	if cb.braceCounts == nil {
-		cb.braceCounts = make(map[string]int)
+	cb.lineContinuation = false
+	if len(cb.heredocs) > 0 {
+		// The entire line is part of a heredoc.
+		h := cb.heredocs[0]
+		if h.indented {
+			s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		}
+		if s == h.delimiter {
+			cb.heredocs = cb.heredocs[1:]
+		}
+		return
 	}
 
+	quotes := opts.quotes()
+	if cb.ignoreQuotes {
+		quotes = nil
+	}
 	// TODO(jfalgout): Does this need to handle runes more correctly?
 	for i := 0; i < len(s); {
-		if cb.expectedQuote == "" {
+		if cb.expectedQuote == nil {
 			// We do not appear to be inside a string literal.
 			// Treat braces as part of the syntax.
-			for _, b := range braces {
+			for j, b := range braces {
 				if s[i:i+1] == b.open {
-					cb.braceCounts[b.open]++
+					cb.braceCounts[j]++
 				}
 				if s[i:i+1] == b.close {
-					cb.braceCounts[b.close]++
+					cb.braceCounts[j]--
 				}
 			}
 			// Ignore trailing comments (rest of the line).
 			if cm := opts.commentMarker; cm != "" && len(s[i:]) >= len(cm) && s[i:i+len(cm)] == cm {
 				break
 			}
-		}
-		if q := findQuote(s, i); cb.expectedQuote == "" && q != "" {
-			cb.expectedQuote = q
-			i += len(q)
-			continue
-		} else if cb.expectedQuote != "" && q == cb.expectedQuote {
-			cb.expectedQuote = ""
-			i += len(q)
+			if opts.AngleBrackets {
+				cb.angleBrackets += angleBracket(s, i, cb.angleBrackets)
+			}
+			if h, n := findHeredoc(s, i, opts); n > 0 {
+				cb.heredocs = append(cb.heredocs, h)
+				i += n
+				continue
+			}
+			if q := findQuote(s, i, quotes); q != nil {
+				cb.expectedQuote = q
+				i += len(q.start)
+				continue
+			}
+		} else if q := cb.expectedQuote; q.endsAt(s, i) {
+			cb.expectedQuote = nil
+			i += len(q.end)
 			continue
 		}
 
 		i++
 	}
+
+	cb.lineContinuation = strings.HasSuffix(strings.TrimRightFunc(s, unicode.IsSpace), `\`)
+}
+
+// angleBracket determines whether the character in s at position i is an
+// angle bracket that opens (+1) or closes (-1) a list of type parameters.
+//
+// Since angle brackets are also comparison operators, we use some heuristics:
+//   - An opening angle bracket must immediately follow an identifier, and
+//     must not be followed by a space (e.g. List<String>, but not a < b)
+//   - What follows an opening angle bracket must look like type parameters
+//     until the matching closing angle bracket, or until the end of a line
+//     that ends with a comma (e.g. not a<b; or if (a<b) {)
+//   - A closing angle bracket must match an earlier opening angle bracket, and
+//     must not be part of an arrow (-> or =>)
+func angleBracket(s string, i, depth int) int {
+	switch s[i] {
+	case '<':
+		if i == 0 || i+1 == len(s) || !isIdentifierChar(s[i-1]) {
+			return 0
+		}
+		if next := s[i+1]; (isIdentifierChar(next) || strings.IndexByte(">?:", next) >= 0) && looksLikeTypeParameters(s[i+1:]) {
+			return 1
+		}
+	case '>':
+		if depth > 0 && (i == 0 || (s[i-1] != '-' && s[i-1] != '=')) {
+			return -1
+		}
+	}
+	return 0
 }
 
-// findQuote looks for one of the quotes in s at position i, returning which
-// quote was found if one was found.
-func findQuote(s string, i int) string {
-	for _, q := range quotes {
-		if len(s[i:]) < len(q) {
+// looksLikeTypeParameters determines whether s, the rest of a line after an
+// opening angle bracket, could be a list of type parameters.
+func looksLikeTypeParameters(s string) bool {
+	depth := 1
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '<':
+			depth++
+		case ch == '>':
+			if depth--; depth == 0 {
+				return true
+			}
+		case strings.HasPrefix(s[i:], "&&"):
+			return false
+		case !isIdentifierChar(ch) && !unicode.IsSpace(rune(ch)) && strings.IndexByte(",.?:[]()*&", ch) < 0:
+			return false
+		}
+	}
+	// Type parameters may continue on the next line.
+	return strings.HasSuffix(strings.TrimRightFunc(s, unicode.IsSpace), ",")
+}
+
+func isIdentifierChar(ch byte) bool {
+	return ch == '_' || '0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z'
+}
+
+// findQuote looks for the start of one of the quotes in s at position i,
+// returning which quote was found if one was found.
+func findQuote(s string, i int, quotes []quote) *quote {
+	for j, q := range quotes {
+		if q.hashes {
+			if h := findHashedQuote(s, i, q); h != nil {
+				return h
+			}
+			continue
+		}
+		if !strings.HasPrefix(s[i:], q.start) {
 			continue
 		}
-		if len(q) == 1 && i > 0 && string(s[i-1]) == `\` {
+		if q.escapable && isEscaped(s, i) {
 			// Ignore quote literals (\", \', \`)
 			continue
 		}
-		if s[i:i+len(q)] == q {
-			return q
+		return &quotes[j]
+	}
+	return nil
+}
+
+// findHashedQuote looks for the start of q in s at position i, with any
+// number of # after its first character (see quote.hashes). If there is one,
+// it returns a quote with the exact delimiters of that string literal.
+func findHashedQuote(s string, i int, q quote) *quote {
+	if !strings.HasPrefix(s[i:], q.start[:1]) {
+		return nil
+	}
+	rest := s[i+1:]
+	hashes := strings.Repeat("#", len(rest)-len(strings.TrimLeft(rest, "#")))
+	if !strings.HasPrefix(rest[len(hashes):], q.start[1:]) {
+		return nil
+	}
+	return &quote{start: q.start[:1] + hashes + q.start[1:], end: q.end + hashes}
+}
+
+// findHeredoc looks for the start of a heredoc in s at position i, returning
+// the heredoc and the length of its start if one was found.
+func findHeredoc(s string, i int, opts blockOptions) (heredoc, int) {
+	if !opts.heredocs() || !strings.HasPrefix(s[i:], "<<") {
+		return heredoc{}, 0
+	}
+	if i > 0 {
+		// Avoid mistaking bit shifts like 1<<FOO for heredocs.
+		if prev := rune(s[i-1]); unicode.IsLetter(prev) || unicode.IsDigit(prev) || prev == '<' || prev == ')' || prev == ']' {
+			return heredoc{}, 0
 		}
 	}
-	return ""
+	m := heredocStart.FindStringSubmatch(s[i:])
+	if m == nil {
+		return heredoc{}, 0
+	}
+	return heredoc{delimiter: m[2], indented: m[1] != ""}, len(m[0])
+}
+
+// isEscaped determines whether the character at position i in s is escaped by
+// the backslashes in front of it.
+func isEscaped(s string, i int) bool {
+	n := 0
+	for i > 0 && s[i-1] == '\\' {
+		n++
+		i--
+	}
+	return n%2 == 1
+}
+
+// xmlElements is a helper struct that lets us try to understand if a section
+// of XML or HTML expects more lines to be "complete".
+type xmlElements struct {
+	// The number of elements that were opened but not closed yet.
+	depth int
+	// Whether we're in the middle of a tag, e.g. a tag with one attribute per
+	// line.
+	inTag bool
+	// The kind of tag we're in the middle of, if inTag is true.
+	tag tagKind
+	// The quote of the attribute value we're in the middle of, if any, since
+	// attribute values may contain a '>'.
+	quote byte
+	// Whether we're in the middle of a comment.
+	inComment bool
+}
+
+type tagKind int
+
+const (
+	openingTag tagKind = iota
+	closingTag
+	// e.g. <?xml ...?> or <!DOCTYPE ...>
+	declarationTag
+)
+
+// voidElements are the HTML elements that never have a closing tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+// expectsContinuation determines whether there are elements or tags that
+// haven't been closed yet.
+func (e *xmlElements) expectsContinuation() bool {
+	return e.depth > 0 || e.inTag || e.inComment
+}
+
+// append the given line to these elements, and update expectsContinuation appropriately.
+func (e *xmlElements) append(s string) {
+	for i := 0; i < len(s); {
+		switch {
+		case e.inComment:
+			if strings.HasPrefix(s[i:], "-->") {
+				e.inComment = false
+				i += len("-->")
+				continue
+			}
+		case e.inTag && e.quote != 0:
+			if s[i] == e.quote {
+				e.quote = 0
+			}
+		case e.inTag:
+			if s[i] == '"' || s[i] == '\'' {
+				e.quote = s[i]
+			} else if s[i] == '>' {
+				e.inTag = false
+				switch {
+				case e.tag == openingTag && (i == 0 || s[i-1] != '/'):
+					e.depth++
+				case e.tag == closingTag && e.depth > 0:
+					e.depth--
+				}
+			}
+		case strings.HasPrefix(s[i:], "<!--"):
+			e.inComment = true
+			i += len("<!--")
+			continue
+		case strings.HasPrefix(s[i:], "</"):
+			e.inTag = true
+			e.tag = closingTag
+			i += len("</")
+			continue
+		case strings.HasPrefix(s[i:], "<?"), strings.HasPrefix(s[i:], "<!"):
+			e.inTag = true
+			e.tag = declarationTag
+			i += len("<?")
+			continue
+		case s[i] == '<' && i+1 < len(s) && isIdentifierChar(s[i+1]):
+			e.inTag = true
+			e.tag = openingTag
+			name := s[i+1:]
+			if end := strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || r == '>' || r == '/' }); end >= 0 {
+				name = name[:end]
+			}
+			if voidElements[strings.ToLower(name)] {
+				e.tag = declarationTag
+			}
+			i += 1 + len(name)
+			continue
+		}
+
+		i++
+	}
+}
+
+// yamlEntry is a helper struct that lets us try to understand which lines
+// belong to a single YAML mapping entry or sequence item.
+type yamlEntry struct {
+	init bool
+	// The indentation of the first line.
+	indent int
+	// Whether the first line is a key without a value, in which case a sequence
+	// may follow at the same indentation.
+	// e.g.
+	//   key:
+	//   - item
+	compactSequence bool
+	// The indentation of the line that started a block scalar (| or >) or -1 if
+	// we're not in a block scalar.
+	scalarIndent int
+}
+
+var (
+	yamlKeyWithoutValue = regexp.MustCompile(`:(\s+#.*)?$`)
+	yamlBlockScalar     = regexp.MustCompile(`(^|:\s|-\s)\s*[|>][-+0-9]*(\s+#.*)?$`)
+)
+
+// continuesWith determines whether s (with the given indentation) belongs to
+// this entry.
+func (e *yamlEntry) continuesWith(s string, indent int) bool {
+	if !e.init {
+		return false
+	}
+	if e.scalarIndent >= 0 && (strings.TrimSpace(s) == "" || indent > e.scalarIndent) {
+		return true
+	}
+	if indent > e.indent {
+		return true
+	}
+	if indent == e.indent && e.compactSequence {
+		t := strings.TrimLeftFunc(s, unicode.IsSpace)
+		return t == "-" || strings.HasPrefix(t, "- ")
+	}
+	return false
+}
+
+// append the given line (with the given indentation) to this entry.
+func (e *yamlEntry) append(s string, indent int) {
+	if !e.init {
+		e.init = true
+		e.indent = indent
+		e.compactSequence = yamlKeyWithoutValue.MatchString(s)
+		e.scalarIndent = -1
+	}
+	if e.scalarIndent >= 0 && strings.TrimSpace(s) != "" && indent <= e.scalarIndent {
+		e.scalarIndent = -1
+	}
+	if e.scalarIndent < 0 && yamlBlockScalar.MatchString(strings.TrimSpace(s)) {
+		e.scalarIndent = indent
+	}
+}
+
+// markdownItem is a helper struct that lets us try to understand which lines
+// belong to a single Markdown list item.
+type markdownItem struct {
+	init bool
+	// The indentation of the list marker.
+	indent int
+	// Whether the last line was blank.
+	afterBlankLine bool
+}
+
+// markdownListMarker matches the list marker at the start of a Markdown list
+// item, including the checkbox of a task list item.
+var markdownListMarker = regexp.MustCompile(`^\s*(?:[-*+]|[0-9]+[.)])(?:\s+\[[ xX]\])?(?:\s+|$)`)
+
+// continuesWith determines whether s (with the given indentation) belongs to
+// this list item.
+func (it *markdownItem) continuesWith(s string, indent int) bool {
+	if !it.init {
+		return false
+	}
+	if strings.TrimSpace(s) == "" || indent > it.indent {
+		// Blank lines get the indentation of the next non-blank line, so this
+		// includes blank lines between the paragraphs of a list item.
+		return indent > it.indent
+	}
+	// Lazy continuation lines are part of the paragraph above them.
+	return !it.afterBlankLine && !markdownListMarker.MatchString(s)
+}
+
+// append the given line (with the given indentation) to this list item.
+func (it *markdownItem) append(s string, indent int) {
+	if !it.init {
+		it.init = true
+		it.indent = indent
+	}
+	it.afterBlankLine = strings.TrimSpace(s) == ""
+}
+
+// linePair is one of the open:close markers of paired_lines.
+type linePair struct {
+	open, close string
+}
+
+// pairedLines is a helper struct that lets us keep everything between paired
+// lines (e.g. #if and #endif) together.
+type pairedLines struct {
+	// The close markers of the pairs that are still open, innermost last.
+	unclosed []string
+}
+
+// expectsContinuation determines whether a pair is still open.
+func (p *pairedLines) expectsContinuation() bool {
+	return len(p.unclosed) > 0
+}
+
+// append the given line to this group of paired lines.
+func (p *pairedLines) append(s string, pairs []linePair) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	if n := len(p.unclosed); n > 0 && strings.HasPrefix(s, p.unclosed[n-1]) {
+		p.unclosed = p.unclosed[:n-1]
+		return
+	}
+	for _, pair := range pairs {
+		if strings.HasPrefix(s, pair.open) {
+			p.unclosed = append(p.unclosed, pair.close)
+			return
+		}
+	}
+}
+
+// compactDirective removes the whitespace in front of s and between the # and
+// the name of a C preprocessor directive, e.g. "  #  ifdef X" becomes
+// "#ifdef X".
+func compactDirective(s string) string {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	if rest, ok := strings.CutPrefix(s, "#"); ok {
+		return "#" + strings.TrimLeftFunc(rest, unicode.IsSpace)
+	}
+	return s
 }
 
 func (lg lineGroup) append(s string) {
@@ -322,20 +951,29 @@ func (lg lineGroup) trimSuffix(s string) {
 }
 
 func (lg lineGroup) joinedLines() string {
-	// TODO(jfalgout): This is a good candidate for caching. Make sure we
-	// invalidate it if this line group gets modified, though (like it does when
-	// we handle trailing commas correctly).
-	if len(lg.lines) == 0 {
+	if lg.keys != nil {
+		return lg.keys.joined
+	}
+	switch len(lg.lines) {
+	case 0:
 		return ""
+	case 1:
+		// By far the most common case, which doesn't need to allocate.
+		return strings.TrimLeftFunc(lg.lines[0], unicode.IsSpace)
 	}
 
-	endsWithWordChar := regexp.MustCompile(`\w$`)
-	startsWithWordChar := regexp.MustCompile(`^\w`)
+	var n int
+	for _, l := range lg.lines {
+		n += len(l) + 1
+	}
 	var s strings.Builder
+	s.Grow(n)
 	var last string
 	for _, l := range lg.lines {
 		l := strings.TrimLeftFunc(l, unicode.IsSpace)
-		if len(last) > 0 && len(l) > 0 && endsWithWordChar.MatchString(last) && startsWithWordChar.MatchString(l) {
+		// Lines that would otherwise run into each other are separated by a
+		// space. \w is ASCII-only, so comparing single bytes is enough.
+		if len(last) > 0 && len(l) > 0 && isIdentifierChar(last[len(last)-1]) && isIdentifierChar(l[0]) {
 			s.WriteString(" ")
 		}
 		s.WriteString(l)
@@ -344,10 +982,20 @@ func (lg lineGroup) joinedLines() string {
 	return s.String()
 }
 
+// dedupKey returns a string that is equal for two lineGroups if and only if
+// one is a duplicate of the other.
+func (lg lineGroup) dedupKey() string {
+	return lg.joinedLines() + "\n" + strings.Join(lg.comment, "\n")
+}
+
 func (lg lineGroup) less(other lineGroup) int {
 	if c := strings.Compare(lg.joinedLines(), other.joinedLines()); c != 0 {
 		return c
 	}
+	if slices.Equal(lg.comment, other.comment) {
+		// Skip joining the comments, which are usually the same (and empty).
+		return 0
+	}
 	return cmp.Compare(strings.Join(lg.comment, "\n"), strings.Join(other.comment, "\n"))
 }
 
@@ -364,10 +1012,13 @@ func (lg lineGroup) GoString() string {
 }
 
 func (lg lineGroup) allLines() []string {
-	var all []string
+	return lg.appendLines(make([]string, 0, len(lg.comment)+len(lg.lines)))
+}
+
+// appendLines appends the comment and the lines of lg to all.
+func (lg lineGroup) appendLines(all []string) []string {
 	all = append(all, lg.comment...)
-	all = append(all, lg.lines...)
-	return all
+	return append(all, lg.lines...)
 }
 
 func (lg lineGroup) String() string {
@@ -16,16 +16,21 @@ package keepsorted
 
 import (
 	"cmp"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"maps"
 	"math/big"
+	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"regexp/syntax"
 	"slices"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	yaml "gopkg.in/yaml.v3"
 )
@@ -50,13 +55,114 @@ func (opts BlockOptions) String() string {
 	return opts.opts.String()
 }
 
+// AddPreset defines a preset that blocks can use with preset=name. The options
+// of a preset are applied before the rest of the options on the start
+// directive.
+func (opts *BlockOptions) AddPreset(name, options string) error {
+	if _, ok := presets[name]; ok {
+		return fmt.Errorf("preset %q is already built in", name)
+	}
+	// Blocks apply the preset on top of the defaults, so that's what it's
+	// checked against too, e.g. for allow_yaml_lists.
+	parsed := opts.opts
+	parsed.Preset = ""
+	warns := parsed.set(options)
+	if parsed.Preset != "" {
+		return fmt.Errorf("preset %q may not refer to another preset", name)
+	}
+	warns = append(warns, validate(&parsed)...)
+	if err := errors.Join(warns...); err != nil {
+		return fmt.Errorf("preset %q has invalid options: %w", name, err)
+	}
+	opts.opts.userPresets = maps.Clone(opts.opts.userPresets)
+	if opts.opts.userPresets == nil {
+		opts.opts.userPresets = make(map[string]preset)
+	}
+	opts.opts.userPresets[name] = preset{options: options}
+	return nil
+}
+
+// AddFileDefaults makes options the defaults for the blocks in files whose
+// name matches pattern, on top of the other defaults. pattern uses the syntax
+// of path.Match. If it doesn't contain a slash, it's matched against the base
+// name of the file, e.g. "*.py". When several patterns match a file, their
+// options are applied in the order in which they were added.
+func (opts *BlockOptions) AddFileDefaults(pattern, options string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid file pattern %q: %w", pattern, err)
+	}
+	if _, warns := parseBlockOptions("", options, opts.opts); len(warns) > 0 {
+		return fmt.Errorf("file pattern %q has invalid options: %w", pattern, errors.Join(warns...))
+	}
+	opts.opts.fileDefaults = append(slices.Clip(opts.opts.fileDefaults), fileDefault{pattern, options})
+	return nil
+}
+
+// fileDefault is a set of default options for the files that match pattern.
+type fileDefault struct {
+	pattern string
+	options string
+}
+
+// forFile returns the options that the blocks in filename start from, and
+// whether they're any different from opts.
+func (opts blockOptions) forFile(filename string) (blockOptions, bool) {
+	filename = filepath.ToSlash(filename)
+	ret := opts
+	var changed bool
+	for _, fd := range opts.fileDefaults {
+		name := filename
+		if !strings.Contains(fd.pattern, "/") {
+			name = path.Base(filename)
+		}
+		if ok, _ := path.Match(fd.pattern, name); !ok {
+			continue
+		}
+		// The options were validated by AddFileDefaults.
+		ret, _ = parseBlockOptions("", fd.options, ret)
+		changed = true
+	}
+	return ret, changed
+}
+
+// override returns the options that are set in o applied on top of opts, the
+// way the options of a start directive are applied on top of the defaults.
+// The presets, option extensions, sort hooks, and file defaults that were
+// added to o are added to those of opts.
+func (opts blockOptions) override(o blockOptions) blockOptions {
+	ret := opts
+	ret.userPresets = mergeMaps(opts.userPresets, o.userPresets)
+	ret.extensions = mergeMaps(opts.extensions, o.extensions)
+	ret.hooks = append(slices.Clip(opts.hooks), o.hooks...)
+	ret.fileDefaults = append(slices.Clip(opts.fileDefaults), o.fileDefaults...)
+	// Both opts and o were validated when they were created.
+	ret, _ = parseBlockOptions("", o.String(), ret)
+	return ret
+}
+
+// mergeMaps returns the entries of both a and b, preferring those of b,
+// without modifying either of them.
+func mergeMaps[M ~map[K]V, K comparable, V any](a, b M) M {
+	if len(b) == 0 {
+		return a
+	}
+	ret := maps.Clone(a)
+	if ret == nil {
+		ret = make(M)
+	}
+	maps.Copy(ret, b)
+	return ret
+}
+
 // blockOptions enable/disable extra features that control how a block of lines is sorted.
 //
-// Currently, only four types are supported:
-//  1. bool:            key=yes, key=true, key=no, key=false
-//  2. []string:        key=a,b,c,d
-//  3. map[string]bool: key=a,b,c,d
-//  4. int:             key=123
+// Currently, only six types are supported:
+//  1. bool:              key=yes, key=true, key=no, key=false
+//  2. []string:          key=a,b,c,d
+//  3. map[string]bool:   key=a,b,c,d
+//  4. int:               key=123
+//  5. NewlineSeparation: key=yes, key=no, key=preserve
+//  6. string:            key=abc, key="a b c"
 type blockOptions struct {
 	// AllowYAMLLists determines whether list.set valued options are allowed to be specified by YAML.
 	AllowYAMLLists bool `key:"allow_yaml_lists"`
@@ -67,16 +173,57 @@ type blockOptions struct {
 
 	// SkipLines is the number of lines to ignore before sorting.
 	SkipLines int `key:"skip_lines"`
+	// Until is the only way to end the block besides an end directive. The only
+	// supported value is dedent: the block ends at the first line that's
+	// indented less than the start directive.
+	Until string `key:"until"`
 	// Group determines whether we group lines together based on increasing indentation.
 	Group bool
+	// TabWidth is the number of columns between tab stops when counting
+	// indentation for Group. If zero, a tab counts as a single space.
+	TabWidth int `key:"tab_width"`
 	// GroupPrefixes tells us about other types of lines that should be added to a group.
 	GroupPrefixes map[string]bool `key:"group_prefixes"`
+	// PairedLines is a list of open:close markers, e.g. #if:#endif. Everything
+	// from a line that starts with the open marker to the matching line that
+	// starts with the close marker is grouped together.
+	PairedLines []string `key:"paired_lines"`
+	// Preprocessor is like PairedLines with #if:#endif, but also recognizes C
+	// preprocessor directives with whitespace after the #, e.g. "#  ifdef".
+	Preprocessor bool `key:"preprocessor"`
 	// Block opts us into a more complicated algorithm to try and understand blocks of code.
 	Block bool
+	// AngleBrackets tells Block to balance angle brackets, e.g. for generics.
+	AngleBrackets bool `key:"angle_brackets"`
+	// XML tells us to group lines together until every XML or HTML element is closed.
+	XML bool `key:"xml"`
+	// YAML tells us to group YAML mapping entries and sequence items together.
+	YAML bool `key:"yaml"`
+	// JSON tells us to group JSON object members like Block and sort them by key.
+	JSON bool `key:"json"`
+	// Markdown tells us to group Markdown list items together with their
+	// sub-items and paragraphs, and to sort them ignoring their list markers.
+	Markdown bool `key:"markdown"`
+	// Lang tells us which language's string literals and comments to expect.
+	Lang string `key:"lang"`
+	// Canonicalize tells us to report (and fix) start directives whose options
+	// aren't sorted and formatted consistently.
+	Canonicalize bool `key:"canonicalize"`
+	// AfterCode lets the start and end directives follow code on the same
+	// line, e.g. `foo(); // keep-sorted start`. Otherwise, such a block is
+	// ignored.
+	AfterCode bool `key:"after_code"`
+	// Preset is the name of a preset that provides the default values for the
+	// other options.
+	Preset string `key:"preset"`
 	// StickyComments tells us to attach comments to the line immediately below them while sorting.
 	StickyComments bool `key:"sticky_comments"`
 	// StickyPrefixes tells us about other types of lines that should behave as sticky comments.
 	StickyPrefixes map[string]bool `key:"sticky_prefixes"`
+	// StickySuffixes tells us about line endings that continue onto the next line.
+	StickySuffixes map[string]bool `key:"sticky_suffixes"`
+	// CommentMarker overrides the comment marker we'd otherwise guess from the start directive.
+	CommentMarker string `key:"comment_marker"`
 
 	///////////////////////
 	//  Sorting options  //
@@ -84,26 +231,130 @@ type blockOptions struct {
 
 	// CaseSensitive is whether we're case sensitive while sorting.
 	CaseSensitive bool `key:"case"`
+	// FoldAccents is whether accented letters sort alongside their base letter,
+	// e.g. é alongside e.
+	FoldAccents bool `key:"fold_accents"`
 	// Numeric indicates that the contents should be sorted like numbers.
 	Numeric bool
 	// PrefixOrder allows the user to explicitly order lines based on their matching prefix.
 	PrefixOrder []string `key:"prefix_order"`
+	// OrderFrom is a file that lists lines in the order they should be in,
+	// relative to the directory of the file that contains the block. Lines that
+	// aren't listed are sorted as usual, after the ones that are.
+	OrderFrom string `key:"order_from"`
 	// IgnorePrefixes is a slice of prefixes that we do not consider when sorting lines.
 	IgnorePrefixes []string `key:"ignore_prefixes"`
+	// ByRegex is a list of regular expressions that select the part of each
+	// line that we sort by. The first one that matches a line is used: if it has
+	// capturing groups, the groups are compared in order. Otherwise, the entire
+	// match is compared.
+	ByRegex []string `key:"by_regex"`
+	// ByRegexPriority is the order in which the capturing groups of ByRegex are
+	// compared, e.g. 3,1,2. Groups that aren't listed are compared afterwards,
+	// in their natural order.
+	ByRegexPriority []string `key:"by_regex_priority"`
+	// ByComment tells us to sort by the content of the trailing comment on each
+	// line instead of the entire line.
+	ByComment bool `key:"by_comment"`
+	// CSV tells us to treat each line as a record of comma-separated values and
+	// sort by one of its fields.
+	CSV bool `key:"csv"`
+	// Column is the 1-based index of the field that CSV sorts by. If zero, the
+	// first field is used.
+	Column int `key:"column"`
+	// Delimiter is the string that separates the fields for CSV. If empty, a
+	// comma is assumed.
+	Delimiter string `key:"delimiter"`
+	// PinFirst is the number of groups at the start of the block that stay
+	// where they are while the rest of the block is sorted.
+	PinFirst int `key:"pin_first"`
+	// PinLast is the number of groups at the end of the block that stay where
+	// they are while the rest of the block is sorted.
+	PinLast int `key:"pin_last"`
 
 	////////////////////////////
 	//  Post-sorting options  //
 	////////////////////////////
 
+	// Separator is the string that terminates every line but the last, e.g. a
+	// trailing comma. If empty, a comma is assumed.
+	Separator string `key:"separator"`
 	// NewlineSeparated indicates that the groups should be separated with newlines.
-	NewlineSeparated bool `key:"newline_separated"`
+	NewlineSeparated NewlineSeparation `key:"newline_separated"`
+	// GroupBy changes what we consider a group. The only supported value is
+	// blank_lines: every paragraph between blank lines is a group.
+	GroupBy string `key:"group_by"`
+	// Sections tells us to sort each run of lines between blank lines on its
+	// own, without moving lines from one run to another.
+	Sections bool `key:"sections"`
+	// NormalizeIndent re-indents every group like the first one after sorting.
+	NormalizeIndent bool `key:"normalize_indent"`
 	// RemoveDuplicates determines whether we drop lines that are an exact duplicate.
 	RemoveDuplicates bool `key:"remove_duplicates"`
+	// DedupeKeys tells RemoveDuplicates to compare the sort keys of the Preset
+	// instead of the entire lines, e.g. to find variables that are set twice.
+	DedupeKeys bool `key:"dedupe_keys"`
+	// Enforce is either "fix" (the default) or "lint". With lint, problems with
+	// this block are reported, but never fixed automatically.
+	Enforce string `key:"enforce"`
+	// Name lets other blocks in the same file refer to this block.
+	Name string `key:"name"`
+	// SameOrderAs is the Name of another block. Instead of being sorted, this
+	// block is reordered in the same way as that block, e.g. to keep an enum and
+	// its string table in sync.
+	SameOrderAs string `key:"same_order_as"`
+	// ReportTrivial determines whether blocks with fewer than two elements get
+	// a finding, since they're usually left behind after code was deleted.
+	ReportTrivial bool `key:"report_trivial"`
+	// ReportDuplicates determines whether duplicates get their own findings
+	// instead of being folded into the finding for the entire block.
+	ReportDuplicates bool `key:"report_duplicates"`
 
 	// Syntax used to start a comment for keep-sorted annotation, e.g. "//".
 	commentMarker string
+	// Presets that were added with BlockOptions.AddPreset, in addition to the
+	// built-in ones.
+	userPresets map[string]preset
+	// The position of every line in the OrderFrom file.
+	manifest map[string]int
+	// Options that were added with BlockOptions.AddOptionExtension.
+	extensions map[string]OptionExtension
+	// The parsed and unparsed values of the option extensions that are set.
+	extensionValues  map[string]any
+	extensionStrings map[string]string
+	// Hooks that were added with BlockOptions.AddSortHooks.
+	hooks []SortHooks
+	// Defaults that were added with BlockOptions.AddFileDefaults.
+	fileDefaults []fileDefault
 }
 
+// NewlineSeparation determines how blank lines between groups are handled.
+type NewlineSeparation int
+
+const (
+	// Blank lines are sorted like any other line.
+	NewlineSeparationNo NewlineSeparation = iota
+	// Groups are separated by exactly one blank line.
+	NewlineSeparationYes
+	// Groups are reordered, but the existing blank lines between them stay
+	// where they are.
+	NewlineSeparationPreserve
+)
+
+// The values of enforce.
+const (
+	enforceFix  = "fix"
+	enforceLint = "lint"
+)
+
+// groupByBlankLines is the value of group_by that makes every paragraph
+// between blank lines a group.
+const groupByBlankLines = "blank_lines"
+
+// untilDedent is the value of until that ends a block at the first line
+// that's indented less than its start directive.
+const untilDedent = "dedent"
+
 var (
 	defaultOptions = blockOptions{
 		AllowYAMLLists:   true,
@@ -143,43 +394,127 @@ func key(f reflect.StructField) string {
 
 func parseBlockOptions(commentMarker, options string, defaults blockOptions) (_ blockOptions, warnings []error) {
 	ret := defaults
-	opts := reflect.ValueOf(&ret).Elem()
+	warns := ret.set(options)
+	if p, ok := ret.preset(ret.Preset); ok && p.options != "" {
+		// The preset's options have to be in place before the rest of the
+		// options, so that the rest can override them.
+		// AddPreset checks the options of user-defined presets, but the defaults
+		// of a file may still disagree with them.
+		name := ret.Preset
+		ret = defaults
+		warns = nil
+		for _, warn := range ret.set(p.options) {
+			warns = append(warns, fmt.Errorf("preset %q: %w", name, warn))
+		}
+		warns = append(warns, ret.set(options)...)
+	}
+
+	cm := ret.CommentMarker
+	if cm == "" {
+		cm = languages[ret.Lang].commentMarker
+	}
+	if cm == "" {
+		cm = guessCommentMarker(commentMarker)
+	}
+	if cm != "" {
+		ret.setCommentMarker(cm)
+	}
+	if len(ret.IgnorePrefixes) > 1 {
+		// Look at longer prefixes first, in case one of these prefixes is a prefix of another.
+		ret.IgnorePrefixes = slices.Clone(ret.IgnorePrefixes)
+		slices.SortFunc(ret.IgnorePrefixes, func(a string, b string) int { return cmp.Compare(len(b), len(a)) })
+	}
+
+	if warn := validate(&ret); len(warn) > 0 {
+		warns = append(warns, warn...)
+	}
+
+	return ret, warns
+}
+
+// set parses options and sets the corresponding fields of opts.
+func (opts *blockOptions) set(options string) (warnings []error) {
+	val := reflect.ValueOf(opts).Elem()
 	var warns []error
 	parser := newParser(options)
+	// The value of each option that was set so far.
+	seen := make(map[string]string)
 	for {
-		parser.allowYAMLLists = ret.AllowYAMLLists
+		parser.allowYAMLLists = opts.AllowYAMLLists
 		key, ok := parser.popKey()
 		if !ok {
 			break
 		}
 		fieldIdx, ok := fieldIndexByKey[key]
 		if !ok {
-			warns = append(warns, fmt.Errorf("unrecognized option %q", key))
+			if ext, ok := opts.extensions[key]; ok {
+				if err := opts.setExtension(parser, ext); err != nil {
+					warns = append(warns, err)
+				}
+				continue
+			}
+			if s, ok := opts.suggestKey(key); ok {
+				warns = append(warns, warning(UnknownOption, key, "unrecognized option %q, did you mean %q?", key, s))
+			} else {
+				warns = append(warns, warning(UnknownOption, key, "unrecognized option %q", key))
+			}
 			continue
 		}
 
-		field := opts.Field(fieldIdx)
-		val, err := parser.popValue(field.Type())
+		field := val.Field(fieldIdx)
+		v, err := parser.popValue(field.Type())
 		if err != nil {
-			warns = append(warns, fmt.Errorf("while parsing option %q: %w", key, err))
+			warns = append(warns, warning(InvalidValue, key, "while parsing option %q: %w", key, err))
 			continue
 		}
-		field.Set(val)
+		s, err := formatValue(v)
+		if err != nil {
+			s = fmt.Sprint(v)
+		}
+		if prev, ok := seen[key]; ok {
+			warns = append(warns, warning(DuplicateOption, key, "option %q is set more than once (%s, then %s), so only the last value is used", key, prev, s))
+		}
+		seen[key] = s
+		field.Set(v)
 	}
+	return warns
+}
 
-	if cm := guessCommentMarker(commentMarker); cm != "" {
-		ret.setCommentMarker(cm)
-	}
-	if len(ret.IgnorePrefixes) > 1 {
-		// Look at longer prefixes first, in case one of these prefixes is a prefix of another.
-		slices.SortFunc(ret.IgnorePrefixes, func(a string, b string) int { return cmp.Compare(len(b), len(a)) })
+// suggestKey returns the known option whose key is closest to key, which isn't
+// one, if any is close enough to be a typo of it.
+func (opts *blockOptions) suggestKey(key string) (string, bool) {
+	keys := slices.Sorted(maps.Keys(fieldIndexByKey))
+	keys = append(keys, slices.Sorted(maps.Keys(opts.extensions))...)
+	// Short keys are too close to too many other keys.
+	best, bestDist := "", min(2, utf8.RuneCountInString(key)/3)
+	for _, k := range keys {
+		if d := editDistance(key, k); d <= bestDist && (best == "" || d < bestDist) {
+			best, bestDist = k, d
+		}
 	}
+	return best, best != ""
+}
 
-	if warn := validate(&ret); len(warn) > 0 {
-		warns = append(warns, warn...)
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
 	}
-
-	return ret, warns
+	for i := range ar {
+		cur[0] = i + 1
+		for j := range br {
+			cost := 1
+			if ar[i] == br[j] {
+				cost = 0
+			}
+			cur[j+1] = min(prev[j+1]+1, cur[j]+1, prev[j]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(br)]
 }
 
 func formatValue(val reflect.Value) (string, error) {
@@ -192,6 +527,10 @@ func formatValue(val reflect.Value) (string, error) {
 		return formatList(slices.Sorted(maps.Keys(val.Interface().(map[string]bool))))
 	case reflect.TypeFor[int]():
 		return strconv.Itoa(int(val.Int())), nil
+	case reflect.TypeFor[NewlineSeparation]():
+		return newlineSeparationString[NewlineSeparation(val.Int())], nil
+	case reflect.TypeFor[string]():
+		return formatString(val.String()), nil
 	}
 
 	panic(fmt.Errorf("unsupported blockOptions type: %v", val.Type()))
@@ -226,20 +565,22 @@ func formatList(vals []string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+func formatString(val string) string {
+	if val == "" || strings.ContainsAny(val, "\"'") || strings.ContainsFunc(val, unicode.IsSpace) {
+		return strconv.Quote(val)
+	}
+	return val
+}
+
+// commentMarkers are the comment markers that guessCommentMarker recognizes.
+var commentMarkers = []string{"//", "#", "/*", "--", ";", "<!--"}
+
 func guessCommentMarker(startLine string) string {
 	startLine = strings.TrimSpace(startLine)
-	if strings.HasPrefix(startLine, "//") {
-		return "//"
-	} else if strings.HasPrefix(startLine, "#") {
-		return "#"
-	} else if strings.HasPrefix(startLine, "/*") {
-		return "/*"
-	} else if strings.HasPrefix(startLine, "--") {
-		return "--"
-	} else if strings.HasPrefix(startLine, ";") {
-		return ";"
-	} else if strings.HasPrefix(startLine, "<!--") {
-		return "<!--"
+	for _, m := range commentMarkers {
+		if strings.HasPrefix(startLine, m) {
+			return m
+		}
 	}
 	return ""
 }
@@ -247,6 +588,8 @@ func guessCommentMarker(startLine string) string {
 func (opts *blockOptions) setCommentMarker(marker string) {
 	opts.commentMarker = marker
 	if opts.StickyComments {
+		// The map may be shared with the options that these were copied from.
+		opts.StickyPrefixes = maps.Clone(opts.StickyPrefixes)
 		if opts.StickyPrefixes == nil {
 			opts.StickyPrefixes = make(map[string]bool)
 		}
@@ -257,26 +600,161 @@ func (opts *blockOptions) setCommentMarker(marker string) {
 func validate(opts *blockOptions) (warnings []error) {
 	var warns []error
 	if opts.SkipLines < 0 {
-		warns = append(warns, fmt.Errorf("skip_lines has invalid value: %v", opts.SkipLines))
+		warns = append(warns, warning(InvalidValue, "skip_lines", "skip_lines has invalid value: %v", opts.SkipLines))
 		opts.SkipLines = 0
 	}
 
+	if opts.Until != "" && opts.Until != untilDedent {
+		warns = append(warns, warning(InvalidValue, "until", "until has unrecognized value %q. Valid values: %q", opts.Until, []string{untilDedent}))
+		opts.Until = ""
+	}
+
+	if opts.PinFirst < 0 {
+		warns = append(warns, warning(InvalidValue, "pin_first", "pin_first has invalid value: %v", opts.PinFirst))
+		opts.PinFirst = 0
+	}
+
+	if opts.PinLast < 0 {
+		warns = append(warns, warning(InvalidValue, "pin_last", "pin_last has invalid value: %v", opts.PinLast))
+		opts.PinLast = 0
+	}
+
+	if opts.TabWidth < 0 {
+		warns = append(warns, warning(InvalidValue, "tab_width", "tab_width has invalid value: %v", opts.TabWidth))
+		opts.TabWidth = 0
+	}
+
+	if opts.Column < 0 {
+		warns = append(warns, warning(InvalidValue, "column", "column has invalid value: %v", opts.Column))
+		opts.Column = 0
+	}
+
+	if opts.Delimiter != "" && utf8.RuneCountInString(opts.Delimiter) != 1 {
+		warns = append(warns, warning(InvalidValue, "delimiter", "delimiter must be a single character: %q", opts.Delimiter))
+		opts.Delimiter = ""
+	}
+
+	if (opts.Column != 0 || opts.Delimiter != "") && !opts.CSV {
+		warns = append(warns, warning(ConflictingOptions, "csv", "column and delimiter may not be used with csv=no"))
+		opts.Column = 0
+		opts.Delimiter = ""
+	}
+
+	for _, re := range opts.ByRegex {
+		if _, err := regexps.compile(re); err != nil {
+			warns = append(warns, warning(InvalidValue, "by_regex", "by_regex has invalid regex %q: %w", re, err))
+			opts.ByRegex = nil
+			break
+		}
+	}
+
+	for _, p := range opts.ByRegexPriority {
+		if i, err := strconv.Atoi(p); err != nil || i < 1 {
+			warns = append(warns, warning(InvalidValue, "by_regex_priority", "by_regex_priority has invalid group %q", p))
+			opts.ByRegexPriority = nil
+			break
+		}
+	}
+
+	for _, p := range opts.PrefixOrder {
+		if m := explicitPrefixWeight.FindStringSubmatch(p); m != nil {
+			if _, err := strconv.Atoi(m[2]); err != nil {
+				warns = append(warns, warning(InvalidValue, "prefix_order", "prefix_order has invalid weight %q", m[2]))
+				opts.PrefixOrder = nil
+				break
+			}
+		}
+	}
+
+	if opts.ByRegexPriority != nil && opts.ByRegex == nil {
+		warns = append(warns, warning(ConflictingOptions, "by_regex_priority", "by_regex_priority may not be used without by_regex"))
+		opts.ByRegexPriority = nil
+	}
+
+	if opts.ByComment && opts.CSV {
+		warns = append(warns, warning(ConflictingOptions, "by_comment", "by_comment may not be used with csv=yes"))
+		opts.ByComment = false
+	}
+
+	for _, p := range opts.PairedLines {
+		if o, c, ok := strings.Cut(p, ":"); !ok || o == "" || c == "" {
+			warns = append(warns, warning(InvalidValue, "paired_lines", "paired_lines must look like open:close, not %q", p))
+			opts.PairedLines = nil
+			break
+		}
+	}
+
+	if opts.AngleBrackets && !opts.Block && !opts.JSON {
+		warns = append(warns, warning(ConflictingOptions, "angle_brackets", "angle_brackets may not be used with block=no"))
+		opts.AngleBrackets = false
+	}
+
+	if _, ok := languages[opts.Lang]; !ok && opts.Lang != "" {
+		warns = append(warns, warning(InvalidValue, "lang", "lang has unrecognized value %q. Valid languages: %q", opts.Lang, knownLanguages()))
+		opts.Lang = ""
+	}
+
+	if _, ok := opts.preset(opts.Preset); !ok && opts.Preset != "" {
+		warns = append(warns, warning(InvalidValue, "preset", "preset has unrecognized value %q. Valid presets: %q", opts.Preset, opts.knownPresets()))
+		opts.Preset = ""
+	}
+
+	if opts.Enforce != "" && opts.Enforce != enforceFix && opts.Enforce != enforceLint {
+		warns = append(warns, warning(InvalidValue, "enforce", "enforce has unrecognized value %q. Valid values: %q", opts.Enforce, []string{enforceFix, enforceLint}))
+		opts.Enforce = ""
+	}
+
+	if opts.GroupBy != "" && opts.GroupBy != groupByBlankLines {
+		warns = append(warns, warning(InvalidValue, "group_by", "group_by has unrecognized value %q. Valid values: %q", opts.GroupBy, []string{groupByBlankLines}))
+		opts.GroupBy = ""
+	}
+
+	if opts.Sections && opts.GroupBy == groupByBlankLines {
+		warns = append(warns, warning(ConflictingOptions, "sections", "sections may not be used with group_by=%s", groupByBlankLines))
+		opts.Sections = false
+	}
+
+	if opts.Sections && opts.NewlineSeparated != NewlineSeparationNo {
+		warns = append(warns, warning(ConflictingOptions, "sections", "sections may not be used with newline_separated=%s", newlineSeparationString[opts.NewlineSeparated]))
+		opts.Sections = false
+	}
+
 	if opts.GroupPrefixes != nil && !opts.Group {
-		warns = append(warns, fmt.Errorf("group_prefixes may not be used with group=no"))
+		warns = append(warns, warning(ConflictingOptions, "group_prefixes", "group_prefixes may not be used with group=no"))
 		opts.GroupPrefixes = nil
 	}
 
+	if opts.DedupeKeys && !opts.RemoveDuplicates {
+		warns = append(warns, warning(ConflictingOptions, "dedupe_keys", "dedupe_keys may not be used with remove_duplicates=no"))
+		opts.DedupeKeys = false
+	}
+
+	if p, _ := opts.preset(opts.Preset); opts.DedupeKeys && p.key == nil {
+		warns = append(warns, warning(ConflictingOptions, "dedupe_keys", "dedupe_keys requires a preset that extracts keys"))
+		opts.DedupeKeys = false
+	}
+
+	if opts.ReportDuplicates && !opts.RemoveDuplicates {
+		warns = append(warns, warning(ConflictingOptions, "report_duplicates", "report_duplicates may not be used with remove_duplicates=no"))
+		opts.ReportDuplicates = false
+	}
+
 	return warns
 }
 
 func (opts blockOptions) String() string {
 	var s []string
 	val := reflect.ValueOf(opts)
+	// Options that match the preset don't need to be repeated.
+	var preset blockOptions
+	p, _ := opts.preset(opts.Preset)
+	preset.set(p.options)
+	presetVal := reflect.ValueOf(preset)
 	var errs []error
 	for _, key := range slices.Sorted(maps.Keys(fieldIndexByKey)) {
 		field := val.Type().Field(fieldIndexByKey[key])
 		fieldVal := val.FieldByIndex(field.Index)
-		if fieldVal.IsZero() {
+		if reflect.DeepEqual(fieldVal.Interface(), presetVal.FieldByIndex(field.Index).Interface()) || (fieldVal.IsZero() && presetVal.FieldByIndex(field.Index).IsZero()) {
 			continue
 		}
 		val, err := formatValue(fieldVal)
@@ -291,9 +769,65 @@ func (opts blockOptions) String() string {
 		panic(err)
 	}
 
+	s = append(s, opts.extensionsString()...)
 	return strings.Join(s, " ")
 }
 
+// canonicalOptions reformats options the way String() would: the keys are
+// sorted and every value is formatted consistently. The options are kept as
+// written otherwise, even if they match the defaults. If an option is set more
+// than once, only the last one is kept, since that's the one that takes effect.
+//
+// It returns false if options contains anything but valid options, e.g. a
+// trailing comment that we shouldn't throw away.
+func canonicalOptions(options string, defaults blockOptions) (string, bool) {
+	typ := reflect.TypeFor[blockOptions]()
+	allowYAMLLists := defaults.AllowYAMLLists
+	vals := make(map[string]string)
+	parser := newParser(options)
+	for {
+		parser.allowYAMLLists = allowYAMLLists
+		before := parser.line
+		key, ok := parser.popKey()
+		if !ok {
+			break
+		}
+		if strings.TrimSpace(before[:len(before)-len(parser.line)]) != key+"=" {
+			// There's something between the previous option and this one.
+			return "", false
+		}
+		fieldIdx, ok := fieldIndexByKey[key]
+		if !ok {
+			return "", false
+		}
+		val, err := parser.popValue(typ.Field(fieldIdx).Type)
+		if err != nil {
+			return "", false
+		}
+		if key == "allow_yaml_lists" {
+			allowYAMLLists = val.Bool()
+		}
+		formatted, err := formatValue(val)
+		if err != nil {
+			return "", false
+		}
+		vals[key] = formatted
+	}
+	if strings.TrimSpace(parser.line) != "" {
+		return "", false
+	}
+
+	var s []string
+	for _, key := range slices.Sorted(maps.Keys(vals)) {
+		if !allowYAMLLists && strings.HasPrefix(vals[key], "[") {
+			// The sorted options wouldn't parse the same way.
+			return "", false
+		}
+		s = append(s, fmt.Sprintf("%s=%s", key, vals[key]))
+	}
+	return strings.Join(s, " "), true
+}
+
 // hasPrefix determines if s has one of the prefixes.
 func hasPrefix(s string, prefixes map[string]bool) bool {
 	if len(prefixes) == 0 {
@@ -313,11 +847,304 @@ func (opts blockOptions) hasStickyPrefix(s string) bool {
 	return hasPrefix(s, opts.StickyPrefixes)
 }
 
+// hasStickySuffix determines if s has one of the StickySuffixes.
+func (opts blockOptions) hasStickySuffix(s string) bool {
+	if len(opts.StickySuffixes) == 0 {
+		return false
+	}
+	s = strings.TrimRightFunc(s, unicode.IsSpace)
+	for suffix := range opts.StickySuffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// pairedLines returns the open and close markers of PairedLines, and those of
+// preprocessor conditionals if Preprocessor is set.
+func (opts blockOptions) pairedLines() []linePair {
+	var pairs []linePair
+	if opts.Preprocessor {
+		pairs = append(pairs, linePair{"#if", "#endif"})
+	}
+	for _, p := range opts.PairedLines {
+		o, c, _ := strings.Cut(p, ":")
+		pairs = append(pairs, linePair{o, c})
+	}
+	return pairs
+}
+
 // hasGroupPrefix determines if s has one of the GroupPrefixes.
 func (opts blockOptions) hasGroupPrefix(s string) bool {
 	return hasPrefix(s, opts.GroupPrefixes)
 }
 
+// newlineSeparated returns how blank lines between groups are handled. Unless
+// told otherwise, group_by=blank_lines keeps the blank lines where they are.
+func (opts blockOptions) newlineSeparated() NewlineSeparation {
+	if opts.NewlineSeparated == NewlineSeparationNo && opts.GroupBy == groupByBlankLines {
+		return NewlineSeparationPreserve
+	}
+	return opts.NewlineSeparated
+}
+
+// separator returns the string that terminates every line but the last.
+func (opts blockOptions) separator() string {
+	if opts.Separator == "" {
+		return ","
+	}
+	return opts.Separator
+}
+
+// quotes returns the string literal delimiters for block=yes.
+func (opts blockOptions) quotes() []quote {
+	if l, ok := languages[opts.Lang]; ok {
+		return l.quotes
+	}
+	return defaultQuotes
+}
+
+// heredocs returns whether block=yes should look for heredocs.
+func (opts blockOptions) heredocs() bool {
+	if l, ok := languages[opts.Lang]; ok {
+		return l.heredocs
+	}
+	return true
+}
+
+// jsonKey matches the key of a JSON object member. Single quotes and
+// unquoted keys are allowed for JSON5.
+var jsonKey = regexp.MustCompile(`^\s*("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|[A-Za-z_$][\w$]*)\s*:`)
+
+// maybeJSONKey handles the JSON option.
+//
+// If JSON is true and s looks like a JSON object member, the member's key will
+// be returned. Otherwise, s will be returned unchanged.
+func (opts blockOptions) maybeJSONKey(s string) string {
+	if !opts.JSON {
+		return s
+	}
+	m := jsonKey.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	key := m[1]
+	if key[0] != '"' && key[0] != '\'' {
+		return key
+	}
+	if unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(key[1:len(key)-1], `\'`, `'`) + `"`); err == nil {
+		return unquoted
+	}
+	return key[1 : len(key)-1]
+}
+
+// maybePresetKey extracts the sort key from s, if the Preset has a special way
+// of doing so.
+func (opts blockOptions) maybePresetKey(s string) string {
+	if p, _ := opts.preset(opts.Preset); p.key != nil {
+		return p.key(s)
+	}
+	return s
+}
+
+// dedupKey returns a string that is equal for two lineGroups if and only if
+// RemoveDuplicates should consider one a duplicate of the other.
+func (opts blockOptions) dedupKey(lg lineGroup) string {
+	if opts.DedupeKeys {
+		return opts.maybePresetKey(lg.joinedLines())
+	}
+	return lg.dedupKey()
+}
+
+// dedupValue returns a string that is equal for two lineGroups with the same
+// dedupKey if and only if neither has information that the other one lacks.
+func (opts blockOptions) dedupValue(lg lineGroup) string {
+	if p, _ := opts.preset(opts.Preset); opts.DedupeKeys && p.value != nil {
+		return p.value(lg.joinedLines())
+	}
+	return lg.dedupKey()
+}
+
+// differentValue reports whether a and b, which have the same dedupKey, differ
+// in something that removing one of them would lose.
+func (opts blockOptions) differentValue(a, b lineGroup) bool {
+	return opts.dedupValue(a) != opts.dedupValue(b)
+}
+
+// regexKey handles the ByRegex option.
+//
+// It returns the parts of s that should be compared, in order of priority. If
+// none of the regexes match, s is compared as a whole.
+func regexKey(s string, regexes []*regexp.Regexp, priority []int) []string {
+	for _, re := range regexes {
+		m := re.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		if len(m) == 1 {
+			return m
+		}
+		groups := m[1:]
+		var key []string
+		used := make([]bool, len(groups))
+		for _, p := range priority {
+			if p <= len(groups) {
+				key = append(key, groups[p-1])
+				used[p-1] = true
+			}
+		}
+		for i, g := range groups {
+			if !used[i] {
+				key = append(key, g)
+			}
+		}
+		return key
+	}
+	return []string{s}
+}
+
+// byRegex returns the compiled ByRegex and the parsed ByRegexPriority.
+func (opts blockOptions) byRegex() ([]*regexp.Regexp, []int) {
+	var regexes []*regexp.Regexp
+	for _, re := range opts.ByRegex {
+		// validate already made sure that these compile.
+		r, _ := regexps.compile(re)
+		regexes = append(regexes, r)
+	}
+	var priority []int
+	for _, p := range opts.ByRegexPriority {
+		i, _ := strconv.Atoi(p)
+		priority = append(priority, i)
+	}
+	return regexes, priority
+}
+
+// maxRegexCost is the most regexCost that a block may have. Blocks that would
+// take longer to sort are reported instead, rather than appearing to hang.
+var maxRegexCost = 1 << 30
+
+// regexCost estimates how much work it is to match the by_regex patterns
+// against lines. Go's regular expressions take time linear in the size of the
+// input times the size of the compiled expression, so that's what this adds up.
+func (opts blockOptions) regexCost(lines []string) int {
+	if len(opts.ByRegex) == 0 {
+		return 0
+	}
+	var input int
+	for _, l := range lines {
+		input += len(l) + 1
+	}
+	var cost int
+	for _, re := range opts.ByRegex {
+		parsed, err := syntax.Parse(re, syntax.Perl)
+		if err != nil {
+			continue
+		}
+		prog, err := syntax.Compile(parsed.Simplify())
+		if err != nil {
+			continue
+		}
+		cost += input * len(prog.Inst)
+	}
+	return cost
+}
+
+// maybeTrailingComment handles the ByComment option.
+//
+// If ByComment is true, the content of the last comment in s is returned, or
+// the empty string if there isn't one. Comment markers inside string literals,
+// e.g. "http://example.com", don't start a comment.
+func (opts blockOptions) maybeTrailingComment(s string) string {
+	if !opts.ByComment {
+		return s
+	}
+	if opts.commentMarker == "" {
+		return ""
+	}
+	i := opts.commentStart(s)
+	if i < 0 {
+		return ""
+	}
+	i += strings.LastIndex(s[i:], opts.commentMarker)
+	s = strings.TrimSpace(s[i+len(opts.commentMarker):])
+	for _, closer := range []string{"*/", "-->"} {
+		s = strings.TrimSpace(strings.TrimSuffix(s, closer))
+	}
+	return s
+}
+
+// commentStart returns the index of the first comment marker in s that isn't
+// part of a string literal, or -1 if there isn't one.
+func (opts blockOptions) commentStart(s string) int {
+	quotes := opts.quotes()
+	var open *quote
+	for i := 0; i < len(s); {
+		if open == nil {
+			if strings.HasPrefix(s[i:], opts.commentMarker) {
+				return i
+			}
+			if q := findQuote(s, i, quotes); q != nil {
+				open = q
+				i += len(q.start)
+				continue
+			}
+		} else if open.endsAt(s, i) {
+			i += len(open.end)
+			open = nil
+			continue
+		}
+		i++
+	}
+	return -1
+}
+
+// manifestKey returns what's looked up in the OrderFrom file for lg: its
+// content without surrounding whitespace or a trailing separator.
+func (opts blockOptions) manifestKey(lg lineGroup) string {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(lg.joinedLines()), opts.separator()))
+}
+
+// maybeCSVField handles the CSV option.
+//
+// If CSV is true, s will be parsed as a CSV record and the field in Column
+// will be returned. If the record doesn't have that many fields, the empty
+// string will be returned.
+func (opts blockOptions) maybeCSVField(s string) string {
+	if !opts.CSV {
+		return s
+	}
+	r := csv.NewReader(strings.NewReader(s))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	if opts.Delimiter != "" {
+		r.Comma, _ = utf8.DecodeRuneInString(opts.Delimiter)
+	}
+	record, err := r.Read()
+	if err != nil {
+		return s
+	}
+	column := max(opts.Column, 1)
+	if column > len(record) {
+		return ""
+	}
+	return record[column-1]
+}
+
+// maybeRemoveListMarker handles the Markdown option.
+//
+// If Markdown is true, the list marker (e.g. "- ", "1. ", or "- [x] ") will be
+// removed from s.
+func (opts blockOptions) maybeRemoveListMarker(s string) string {
+	if !opts.Markdown {
+		return s
+	}
+	if m := markdownListMarker.FindStringIndex(s); m != nil {
+		return s[m[1]:]
+	}
+	return s
+}
+
 // removeIgnorePrefix removes the first matching IgnorePrefixes from s, if s
 // matches one of the IgnorePrefixes.
 func (opts blockOptions) removeIgnorePrefix(s string) (string, bool) {
@@ -0,0 +1,185 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// Options are the options of a keep-sorted block, for Go code that would
+// rather set them directly than write them as a string for
+// ParseBlockOptions. Every field corresponds to the option in the comment
+// above it; see the README for what each option does.
+//
+// Start from DefaultBlockOptions().Options() to keep the defaults that a start
+// directive without any options gets, and call Build to turn the result into
+// BlockOptions.
+type Options struct {
+	// allow_yaml_lists
+	AllowYAMLLists bool
+
+	// skip_lines
+	SkipLines int
+	// until
+	Until string
+	// group
+	Group bool
+	// tab_width
+	TabWidth int
+	// group_prefixes
+	GroupPrefixes map[string]bool
+	// paired_lines
+	PairedLines []string
+	// preprocessor
+	Preprocessor bool
+	// block
+	Block bool
+	// angle_brackets
+	AngleBrackets bool
+	// xml
+	XML bool
+	// yaml
+	YAML bool
+	// json
+	JSON bool
+	// markdown
+	Markdown bool
+	// lang
+	Lang string
+	// canonicalize
+	Canonicalize bool
+	// after_code
+	AfterCode bool
+	// preset
+	Preset string
+	// sticky_comments
+	StickyComments bool
+	// sticky_prefixes
+	StickyPrefixes map[string]bool
+	// sticky_suffixes
+	StickySuffixes map[string]bool
+	// comment_marker
+	CommentMarker string
+
+	// case
+	CaseSensitive bool
+	// fold_accents
+	FoldAccents bool
+	// numeric
+	Numeric bool
+	// prefix_order
+	PrefixOrder []string
+	// order_from
+	OrderFrom string
+	// ignore_prefixes
+	IgnorePrefixes []string
+	// by_regex
+	ByRegex []string
+	// by_regex_priority
+	ByRegexPriority []string
+	// by_comment
+	ByComment bool
+	// csv
+	CSV bool
+	// column
+	Column int
+	// delimiter
+	Delimiter string
+	// pin_first
+	PinFirst int
+	// pin_last
+	PinLast int
+
+	// separator
+	Separator string
+	// newline_separated
+	NewlineSeparated NewlineSeparation
+	// group_by
+	GroupBy string
+	// sections
+	Sections bool
+	// normalize_indent
+	NormalizeIndent bool
+	// remove_duplicates
+	RemoveDuplicates bool
+	// dedupe_keys
+	DedupeKeys bool
+	// enforce
+	Enforce string
+	// name
+	Name string
+	// same_order_as
+	SameOrderAs string
+	// report_trivial
+	ReportTrivial bool
+	// report_duplicates
+	ReportDuplicates bool
+}
+
+func init() {
+	// Options and blockOptions are converted into each other field by field, so
+	// they need to have the same options.
+	opts := reflect.TypeFor[Options]()
+	for i := range opts.NumField() {
+		field := opts.Field(i)
+		bf, ok := reflect.TypeFor[blockOptions]().FieldByName(field.Name)
+		if !ok || bf.Type != field.Type {
+			panic(fmt.Errorf("Options.%s doesn't match any field of blockOptions", field.Name))
+		}
+	}
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[blockOptions]()) {
+		if _, ok := opts.FieldByName(field.Name); field.IsExported() && !ok {
+			panic(fmt.Errorf("blockOptions.%s is missing from Options", field.Name))
+		}
+	}
+}
+
+// Options returns the options that are set in opts.
+func (opts BlockOptions) Options() Options {
+	var o Options
+	copyOptions(reflect.ValueOf(&o).Elem(), reflect.ValueOf(opts.opts))
+	return o
+}
+
+// Build checks that o is valid and returns the equivalent BlockOptions.
+func (o Options) Build() (BlockOptions, error) {
+	var opts blockOptions
+	copyOptions(reflect.ValueOf(&opts).Elem(), reflect.ValueOf(o))
+	if err := errors.Join(validate(&opts)...); err != nil {
+		return BlockOptions{}, err
+	}
+	return BlockOptions{opts}, nil
+}
+
+// copyOptions copies every field of Options from src to dst, which are either
+// Options or blockOptions. Slices and maps are cloned so that dst doesn't
+// share them with src.
+func copyOptions(dst, src reflect.Value) {
+	for i := range reflect.TypeFor[Options]().NumField() {
+		name := reflect.TypeFor[Options]().Field(i).Name
+		v := src.FieldByName(name)
+		switch s := v.Interface().(type) {
+		case []string:
+			v = reflect.ValueOf(slices.Clone(s))
+		case map[string]bool:
+			v = reflect.ValueOf(maps.Clone(s))
+		}
+		dst.FieldByName(name).Set(v)
+	}
+}
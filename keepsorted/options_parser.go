@@ -23,6 +23,11 @@ var (
 		true:  "yes",
 		false: "no",
 	}
+	newlineSeparationString = map[NewlineSeparation]string{
+		NewlineSeparationNo:       "no",
+		NewlineSeparationYes:      "yes",
+		NewlineSeparationPreserve: "preserve",
+	}
 	keyRegex = regexp.MustCompile("(^| )(?P<key>[a-z_]+)=")
 
 	errNotYAMLList = fmt.Errorf("content does not appear to be a YAML list")
@@ -62,6 +67,12 @@ func (p *parser) popValue(typ reflect.Type) (reflect.Value, error) {
 	case reflect.TypeFor[map[string]bool]():
 		val, err := p.popSet()
 		return reflect.ValueOf(val), err
+	case reflect.TypeFor[NewlineSeparation]():
+		val, err := p.popNewlineSeparation()
+		return reflect.ValueOf(val), err
+	case reflect.TypeFor[string]():
+		val, err := p.popString()
+		return reflect.ValueOf(val), err
 	}
 
 	panic(fmt.Errorf("unhandled case in switch: %v", typ))
@@ -77,6 +88,22 @@ func (p *parser) popBool() (bool, error) {
 	return b, nil
 }
 
+func (p *parser) popNewlineSeparation() (NewlineSeparation, error) {
+	val, rest, _ := strings.Cut(p.line, " ")
+	if val == newlineSeparationString[NewlineSeparationPreserve] {
+		p.line = rest
+		return NewlineSeparationPreserve, nil
+	}
+	b, err := p.popBool()
+	if err != nil {
+		return NewlineSeparationNo, fmt.Errorf("unrecognized newline_separated value %q", val)
+	}
+	if b {
+		return NewlineSeparationYes, nil
+	}
+	return NewlineSeparationNo, nil
+}
+
 func (p *parser) popInt() (int, error) {
 	val, rest, _ := strings.Cut(p.line, " ")
 	p.line = rest
@@ -87,6 +114,61 @@ func (p *parser) popInt() (int, error) {
 	return i, nil
 }
 
+func (p *parser) popString() (string, error) {
+	if p.line == "" || (p.line[0] != '"' && p.line[0] != '\'') {
+		val, rest, _ := strings.Cut(p.line, " ")
+		p.line = rest
+		return val, nil
+	}
+
+	val, rest, err := findQuotedStringAtStart(p.line)
+	if err != nil {
+		return "", err
+	}
+	p.line = rest
+	var s string
+	if err := yaml.Unmarshal([]byte(val), &s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// findQuotedStringAtStart finds the YAML quoted string at the start of s.
+// The closing quote must either be the end of s or followed by a space.
+func findQuotedStringAtStart(s string) (str, rest string, err error) {
+	iter := newRuneIter(s)
+	quote, _ := iter.pop()
+	for {
+		ch, ok := iter.pop()
+		if !ok {
+			return "", "", fmt.Errorf("content appears to be an unterminated string: %q", s)
+		}
+		if ch == '\\' && quote == '"' {
+			iter.pop()
+			continue
+		}
+		if ch != quote {
+			continue
+		}
+		if next, ok := iter.peek(); ok && next == '\'' && quote == '\'' {
+			// '' is an escaped single quote.
+			iter.pop()
+			continue
+		}
+		break
+	}
+
+	str = s[:iter.idx]
+	rest = s[iter.idx:]
+	if rest != "" {
+		if rest[0] != ' ' {
+			return "", "", fmt.Errorf("unexpected content after string: %q", rest)
+		}
+		rest = rest[1:]
+	}
+	return str, rest, nil
+}
+
 func (p *parser) popList() ([]string, error) {
 	if p.allowYAMLLists {
 		val, rest, err := tryFindYAMLListAtStart(p.line)
@@ -44,6 +44,51 @@ func TestPopValue(t *testing.T) {
 			want:    int(0),
 			wantErr: true,
 		},
+		{
+			name: "NewlineSeparation_Bool",
+
+			input: "yes",
+			want:  NewlineSeparationYes,
+		},
+		{
+			name: "NewlineSeparation_Preserve",
+
+			input: "preserve",
+			want:  NewlineSeparationPreserve,
+		},
+		{
+			name: "NewlineSeparation_Invalid",
+
+			input:   "sometimes",
+			want:    NewlineSeparationNo,
+			wantErr: true,
+		},
+		{
+			name: "String",
+
+			input: "foo",
+			want:  "foo",
+		},
+		{
+			name: "String_DoubleQuoted",
+
+			input: `" +\"foo\""`,
+			want:  ` +"foo"`,
+		},
+		{
+			name: "String_SingleQuoted",
+
+			input: `'it''s'`,
+			want:  "it's",
+		},
+		{
+			name: "String_Unterminated",
+
+			input:                     `"foo`,
+			want:                      "",
+			wantErr:                   true,
+			additionalTrailingContent: `"foo`,
+		},
 		{
 			name: "List_Empty",
 
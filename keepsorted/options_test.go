@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 
@@ -62,6 +63,18 @@ func TestBlockOptions(t *testing.T) {
 				commentMarker:  "//",
 			},
 		},
+		{
+			name:          "CommentMarker_Override",
+			commentMarker: "%",
+			in:            "sticky_comments=yes comment_marker=%",
+
+			want: blockOptions{
+				StickyComments: true,
+				StickyPrefixes: map[string]bool{"%": true},
+				CommentMarker:  "%",
+				commentMarker:  "%",
+			},
+		},
 		{
 			name: "SimpleSwitch",
 			in:   "group=yes",
@@ -80,6 +93,199 @@ func TestBlockOptions(t *testing.T) {
 
 			wantErr: "skip_lines has invalid value: -1",
 		},
+		{
+			name: "ErrorUnknownOption_Suggestion",
+			in:   "sticky_comment=yes",
+
+			wantErr: `unrecognized option "sticky_comment", did you mean "sticky_comments"?`,
+		},
+		{
+			name: "ErrorUnknownOption_NoSuggestion",
+			in:   "foo=yes",
+
+			wantErr: `unrecognized option "foo"`,
+		},
+		{
+			name: "ErrorDuplicateOption",
+			in:   "case=yes numeric=yes case=no",
+
+			want:    blockOptions{Numeric: true},
+			wantErr: `option "case" is set more than once (yes, then no), so only the last value is used`,
+		},
+		{
+			name: "UntilDedent",
+			in:   "until=dedent",
+
+			want: blockOptions{Until: "dedent"},
+		},
+		{
+			name: "ErrorUntilIsUnrecognized",
+			in:   "until=end",
+
+			wantErr: `until has unrecognized value "end". Valid values: ["dedent"]`,
+		},
+		{
+			name: "TabWidth",
+			in:   "tab_width=4",
+
+			want: blockOptions{TabWidth: 4},
+		},
+		{
+			name: "ErrorPinFirstIsNegative",
+			in:   "pin_first=-2",
+
+			wantErr: "pin_first has invalid value: -2",
+		},
+		{
+			name: "ErrorTabWidthIsNegative",
+			in:   "tab_width=-4",
+
+			wantErr: "tab_width has invalid value: -4",
+		},
+		{
+			name:          "Lang",
+			commentMarker: "#",
+			in:            "lang=sql",
+
+			want: blockOptions{
+				Lang:          "sql",
+				commentMarker: "--",
+			},
+		},
+		{
+			name: "ErrorLangIsUnrecognized",
+			in:   "lang=cobol",
+
+			wantErr: `lang has unrecognized value "cobol"`,
+		},
+		{
+			name: "Preset",
+			in:   "preset=go-imports",
+
+			want: blockOptions{
+				Preset:   "go-imports",
+				Sections: true,
+			},
+		},
+		{
+			name: "Preset_PipRequirements",
+			in:   "preset=pip-requirements",
+
+			want: blockOptions{
+				Preset:         "pip-requirements",
+				StickySuffixes: map[string]bool{`\`: true},
+			},
+		},
+		{
+			name: "Preset_Override",
+			in:   "sections=no preset=go-imports",
+
+			want: blockOptions{
+				Preset: "go-imports",
+			},
+		},
+		{
+			name: "ErrorPresetIsUnrecognized",
+			in:   "preset=cobol-copybooks",
+
+			wantErr: `preset has unrecognized value "cobol-copybooks"`,
+		},
+		{
+			name: "ErrorDedupeKeysRequiresPresetKey",
+			in:   "remove_duplicates=yes dedupe_keys=yes",
+
+			want: blockOptions{
+				RemoveDuplicates: true,
+			},
+			wantErr: "dedupe_keys requires a preset that extracts keys",
+		},
+		{
+			name: "ErrorSectionsWithNewlineSeparated",
+			in:   "sections=yes newline_separated=yes",
+
+			want: blockOptions{
+				NewlineSeparated: NewlineSeparationYes,
+			},
+			wantErr: "sections may not be used with newline_separated=yes",
+		},
+		{
+			name:           "ByRegex",
+			in:             `by_regex=['(\w+)-(\d+)', 'foo'] by_regex_priority=2,1`,
+			defaultOptions: blockOptions{AllowYAMLLists: true},
+
+			want: blockOptions{
+				AllowYAMLLists:  true,
+				ByRegex:         []string{`(\w+)-(\d+)`, "foo"},
+				ByRegexPriority: []string{"2", "1"},
+			},
+		},
+		{
+			name: "ErrorByRegexIsInvalid",
+			in:   "by_regex=(foo",
+
+			wantErr: `by_regex has invalid regex "(foo"`,
+		},
+		{
+			name: "ErrorByRegexPriorityIsInvalid",
+			in:   "by_regex=(a)(b) by_regex_priority=2,0",
+
+			want: blockOptions{
+				ByRegex: []string{"(a)(b)"},
+			},
+			wantErr: `by_regex_priority has invalid group "0"`,
+		},
+		{
+			name: "ErrorPrefixOrderWeightIsInvalid",
+			in:   "prefix_order=a,b=(99999999999999999999)",
+
+			wantErr: `prefix_order has invalid weight "99999999999999999999"`,
+		},
+		{
+			name: "ErrorByRegexPriorityRequiresByRegex",
+			in:   "by_regex_priority=2,1",
+
+			wantErr: "by_regex_priority may not be used without by_regex",
+		},
+		{
+			name: "CSV",
+			in:   `csv=yes column=3 delimiter="\t"`,
+
+			want: blockOptions{
+				CSV:       true,
+				Column:    3,
+				Delimiter: "\t",
+			},
+		},
+		{
+			name: "ErrorPairedLinesWithoutClose",
+			in:   "paired_lines=#if:#endif,BEGIN",
+
+			wantErr: `paired_lines must look like open:close, not "BEGIN"`,
+		},
+		{
+			name: "GroupBy",
+			in:   "group_by=blank_lines",
+
+			want: blockOptions{GroupBy: "blank_lines"},
+		},
+		{
+			name: "ErrorGroupByIsUnrecognized",
+			in:   "group_by=indentation",
+
+			wantErr: `group_by has unrecognized value "indentation"`,
+		},
+		{
+			name: "ErrorEnforceIsUnrecognized",
+			in:   "enforce=never",
+
+			wantErr: `enforce has unrecognized value "never"`,
+		},
+		{
+			name: "ErrorColumnRequiresCSV",
+			in:   "column=3",
+
+			wantErr: "column and delimiter may not be used with csv=no",
+		},
 		{
 			name: "ItemList",
 			in:   "prefix_order=a,b,c,d",
@@ -120,6 +326,30 @@ func TestBlockOptions(t *testing.T) {
 				StickyPrefixes: map[string]bool{"a": true, "b": true, "c d": true, `e",\f`: true},
 			},
 		},
+		{
+			name: "NewlineSeparated",
+			in:   "newline_separated=yes",
+
+			want: blockOptions{NewlineSeparated: NewlineSeparationYes},
+		},
+		{
+			name: "NewlineSeparated_Preserve",
+			in:   "newline_separated=preserve",
+
+			want: blockOptions{NewlineSeparated: NewlineSeparationPreserve},
+		},
+		{
+			name: "Separator",
+			in:   "separator=;",
+
+			want: blockOptions{Separator: ";"},
+		},
+		{
+			name: "Separator_Quoted",
+			in:   `separator=" +" case=no`,
+
+			want: blockOptions{Separator: " +"},
+		},
 		{
 			name: "ignore_prefixes",
 			in:   "ignore_prefixes=a,b,c,d",
@@ -142,6 +372,12 @@ func TestBlockOptions(t *testing.T) {
 
 			wantErr: "group_prefixes may not be used with group=no",
 		},
+		{
+			name: "AngleBracketsRequiresBlock",
+			in:   "angle_brackets=yes",
+
+			wantErr: "angle_brackets may not be used with block=no",
+		},
 		{
 			name:          "OptionInTrailingComment",
 			commentMarker: "#",
@@ -198,6 +434,258 @@ func TestBlockOptions(t *testing.T) {
 	}
 }
 
+func TestCanonicalOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+
+		want   string
+		wantOK bool
+	}{
+		{
+			name:   "SortsKeys",
+			in:     "numeric=yes case=no",
+			want:   "case=no numeric=yes",
+			wantOK: true,
+		},
+		{
+			name:   "CanonicalValues",
+			in:     "group=false sticky_prefixes=b,a separator=' +'",
+			want:   `group=no separator=" +" sticky_prefixes=a,b`,
+			wantOK: true,
+		},
+		{
+			name:   "LastValueWins",
+			in:     "numeric=yes numeric=no",
+			want:   "numeric=no",
+			wantOK: true,
+		},
+		{
+			name: "TrailingComment",
+			in:   "numeric=yes # TODO: case=no",
+		},
+		{
+			name: "UnknownOption",
+			in:   "foo=bar",
+		},
+		{
+			name: "InvalidValue",
+			in:   "numeric=maybe",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := canonicalOptions(tc.in, blockOptions{})
+			if ok != tc.wantOK || got != tc.want {
+				t.Errorf("canonicalOptions(%q) = %q, %t; want %q, %t", tc.in, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestBlockOptions_AddPreset(t *testing.T) {
+	opts := BlockOptions{}
+	if err := opts.AddPreset("proto-enums", "numeric=yes prefix_order=UNSPECIFIED"); err != nil {
+		t.Fatalf("AddPreset() = %v", err)
+	}
+
+	got, warns := parseBlockOptions("", "preset=proto-enums case=no", opts.opts)
+	if err := errors.Join(warns...); err != nil {
+		t.Errorf("parseBlockOptions() = _, %v", err)
+	}
+	want := blockOptions{
+		Preset:      "proto-enums",
+		Numeric:     true,
+		PrefixOrder: []string{"UNSPECIFIED"},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(blockOptions{})); diff != "" {
+		t.Errorf("parseBlockOptions() mismatch (-want +got):\n%s", diff)
+	}
+	if s := got.String(); s != "preset=proto-enums" {
+		t.Errorf("String() = %q, want %q", s, "preset=proto-enums")
+	}
+
+	for _, tc := range []struct {
+		name, options, wantErr string
+	}{
+		{"go-imports", "", "already built in"},
+		{"bad", "numeric=maybe", "invalid options"},
+		{"nested", "preset=proto-enums", "may not refer to another preset"},
+	} {
+		if err := opts.AddPreset(tc.name, tc.options); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("AddPreset(%q, %q) = %v, want error containing %q", tc.name, tc.options, err, tc.wantErr)
+		}
+	}
+}
+
+func TestBlockOptions_AddPreset_Defaults(t *testing.T) {
+	// Blocks allow YAML lists by default, so this is an unterminated list.
+	opts := DefaultBlockOptions()
+	if err := opts.AddPreset("bad", "sticky_prefixes=[a"); err == nil {
+		t.Errorf("AddPreset() succeeded, want error")
+	}
+
+	// Without YAML lists the preset is fine, but blocks that use it with
+	// other defaults only get a warning.
+	opts = BlockOptions{}
+	if err := opts.AddPreset("bad", "sticky_prefixes=[a"); err != nil {
+		t.Fatalf("AddPreset() = %v", err)
+	}
+	defaults := defaultOptions
+	defaults.userPresets = opts.opts.userPresets
+	_, warns := parseBlockOptions("", "preset=bad", defaults)
+	if err := errors.Join(warns...); err == nil || !strings.Contains(err.Error(), `preset "bad"`) {
+		t.Errorf("parseBlockOptions() = _, %v, want a warning about the preset", err)
+	}
+}
+
+func TestOptions_Build(t *testing.T) {
+	o := DefaultBlockOptions().Options()
+	o.Numeric = true
+	o.PrefixOrder = []string{"UNSPECIFIED"}
+	o.NewlineSeparated = NewlineSeparationYes
+	opts, err := o.Build()
+	if err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	want, err := ParseBlockOptions("allow_yaml_lists=yes group=yes sticky_comments=yes case=yes remove_duplicates=yes numeric=yes prefix_order=UNSPECIFIED newline_separated=yes")
+	if err != nil {
+		t.Fatalf("ParseBlockOptions() = %v", err)
+	}
+	if diff := cmp.Diff(want.opts, opts.opts, cmp.AllowUnexported(blockOptions{}), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Build() mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(o, opts.Options()); diff != "" {
+		t.Errorf("Options() mismatch (-want +got):\n%s", diff)
+	}
+
+	o.PrefixOrder[0] = "changed"
+	if got := opts.opts.PrefixOrder[0]; got != "UNSPECIFIED" {
+		t.Errorf("Build() shares PrefixOrder with Options: got %q", got)
+	}
+
+	o.Group = false
+	o.GroupPrefixes = map[string]bool{"and": true}
+	if _, err := o.Build(); err == nil || !strings.Contains(err.Error(), "group_prefixes may not be used with group=no") {
+		t.Errorf("Build() = _, %v, want error about group_prefixes", err)
+	}
+}
+
+func TestBlockOptions_AddFileDefaults(t *testing.T) {
+	opts := DefaultBlockOptions()
+	if err := opts.AddFileDefaults("*.py", "case=no"); err != nil {
+		t.Fatalf("AddFileDefaults() = %v", err)
+	}
+	if err := opts.AddFileDefaults("docs/*.md", "numeric=yes"); err != nil {
+		t.Fatalf("AddFileDefaults() = %v", err)
+	}
+	in := `
+# keep-sorted-test start
+a
+B
+10
+9
+# keep-sorted-test end`
+
+	for _, tc := range []struct {
+		filename string
+		want     []string
+	}{
+		{"x.go", []string{"10", "9", "B", "a"}},
+		{"dir/x.py", []string{"10", "9", "a", "B"}},
+		{"docs/x.md", []string{"9", "10", "B", "a"}},
+		{"other/x.md", []string{"10", "9", "B", "a"}},
+	} {
+		got, _, _ := New("keep-sorted-test", opts).Fix(tc.filename, in, nil)
+		want := "\n# keep-sorted-test start\n" + strings.Join(tc.want, "\n") + "\n# keep-sorted-test end"
+		if got != want {
+			t.Errorf("Fix(%q) mismatch (-want +got):\n%s", tc.filename, cmp.Diff(want, got))
+		}
+	}
+
+	for _, tc := range []struct {
+		pattern, options, wantErr string
+	}{
+		{"[", "", "invalid file pattern"},
+		{"*.py", "numeric=maybe", "invalid options"},
+	} {
+		if err := opts.AddFileDefaults(tc.pattern, tc.options); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("AddFileDefaults(%q, %q) = %v, want error containing %q", tc.pattern, tc.options, err, tc.wantErr)
+		}
+	}
+}
+
+func TestBlockOptions_AddOptionExtension(t *testing.T) {
+	// Orders lines by the team at the start of the line, in the given order.
+	teamOrder := OptionExtension{
+		Key: "team_order",
+		Parse: func(value string) (any, error) {
+			if value == "" {
+				return nil, errors.New("no teams")
+			}
+			return strings.Split(value, ","), nil
+		},
+		Compare: func(value any, a, b string) int {
+			teams := value.([]string)
+			rank := func(s string) int {
+				team, _, _ := strings.Cut(s, ":")
+				if i := slices.Index(teams, team); i >= 0 {
+					return i
+				}
+				return len(teams)
+			}
+			return rank(a) - rank(b)
+		},
+	}
+	opts := BlockOptions{}
+	if err := opts.AddOptionExtension(teamOrder); err != nil {
+		t.Fatalf("AddOptionExtension() = %v", err)
+	}
+
+	got, warns := parseBlockOptions("", "team_order=search,ads numeric=yes", opts.opts)
+	if err := errors.Join(warns...); err != nil {
+		t.Errorf("parseBlockOptions() = _, %v", err)
+	}
+	if s := got.String(); s != "numeric=yes team_order=search,ads" {
+		t.Errorf("String() = %q, want %q", s, "numeric=yes team_order=search,ads")
+	}
+	if _, warns := parseBlockOptions("", `team_order=""`, opts.opts); len(warns) != 1 {
+		t.Errorf("parseBlockOptions(%q) = _, %v, want one warning", `team_order=""`, warns)
+	}
+
+	in := `
+// keep-sorted-test start team_order=search,ads
+ads: b
+infra: a
+ads: a
+search: z
+// keep-sorted-test end`
+	want := `
+// keep-sorted-test start team_order=search,ads
+search: z
+ads: a
+ads: b
+infra: a
+// keep-sorted-test end`
+	if got, _, _ := New("keep-sorted-test", opts).Fix("unused-filename", in, nil); got != want {
+		t.Errorf("Fix() mismatch (-want +got):\n%s", cmp.Diff(want, got))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		ext     OptionExtension
+		wantErr string
+	}{
+		{"BuiltIn", OptionExtension{Key: "numeric", Parse: teamOrder.Parse, Compare: teamOrder.Compare}, "already built in"},
+		{"AlreadyAdded", teamOrder, "already added"},
+		{"InvalidKey", OptionExtension{Key: "Team-Order", Parse: teamOrder.Parse, Compare: teamOrder.Compare}, "must only contain"},
+		{"MissingCompare", OptionExtension{Key: "other", Parse: teamOrder.Parse}, "need both Parse and Compare"},
+	} {
+		if err := opts.AddOptionExtension(tc.ext); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: AddOptionExtension() = %v, want error containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
 func TestBlockOptions_ClonesDefaultOptions(t *testing.T) {
 	defaults := blockOptions{
 		StickyPrefixes: map[string]bool{},
@@ -216,6 +704,10 @@ func TestBlockOptions_ClonesDefaultOptions_Reflection(t *testing.T) {
 	defaultOpts := reflect.ValueOf(&defaults).Elem()
 	var s []string
 	for i := 0; i < defaultOpts.NumField(); i++ {
+		if !defaultOpts.Type().Field(i).IsExported() {
+			// Not an option.
+			continue
+		}
 		val := defaultOpts.Field(i)
 		switch val.Kind() {
 		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.String:
@@ -236,3 +728,26 @@ func TestBlockOptions_ClonesDefaultOptions_Reflection(t *testing.T) {
 		t.Errorf("defaults appear to have been modified (-want +got):\n%s", diff)
 	}
 }
+
+func TestRegexpCache(t *testing.T) {
+	c := newRegexpCache(2)
+	a, err := c.compile("a+")
+	if err != nil {
+		t.Fatalf("compile(%q) = %v", "a+", err)
+	}
+	if again, _ := c.compile("a+"); again != a {
+		t.Errorf("compile(%q) compiled the regex again", "a+")
+	}
+	if _, err := c.compile("("); err == nil {
+		t.Errorf("compile(%q) = nil error, want one", "(")
+	}
+
+	c.compile("b+")
+	c.compile("c+")
+	if again, _ := c.compile("a+"); again == a {
+		t.Errorf("compile(%q) wasn't evicted as the least recently used regex", "a+")
+	}
+	if got := c.lru.Len(); got != 2 {
+		t.Errorf("len(cache) = %d, want 2", got)
+	}
+}
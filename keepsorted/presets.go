@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// preset is a named set of options for a common kind of list, so that users
+// don't need to figure out the right combination of options themselves.
+type preset struct {
+	// options are applied before the rest of the start directive, so any of
+	// them can still be overridden there.
+	options string
+	// key, if set, extracts the part of a lineGroup that's compared while
+	// sorting.
+	key func(string) string
+	// value, if set, extracts the part of a lineGroup that dedupe_keys=yes
+	// compares to tell whether two lineGroups with the same key differ.
+	// Otherwise, their entire lines are compared.
+	value func(string) string
+}
+
+var presets = map[string]preset{
+	"go-imports": {
+		options: "sections=yes",
+		key:     goImportPath,
+	},
+	"dotenv": {
+		key:   dotenvKey,
+		value: dotenvValue,
+	},
+	"pip-requirements": {
+		// Hashes are usually on continuation lines.
+		options: `sticky_suffixes=\`,
+		key:     pipRequirementName,
+	},
+	"terraform": {
+		options: "block=yes sticky_comments=yes newline_separated=yes",
+		key:     hclBlockKey,
+	},
+}
+
+// preset returns the built-in or user-defined preset with the given name.
+func (opts blockOptions) preset(name string) (preset, bool) {
+	if p, ok := presets[name]; ok {
+		return p, true
+	}
+	p, ok := opts.userPresets[name]
+	return p, ok
+}
+
+func (opts blockOptions) knownPresets() []string {
+	names := slices.AppendSeq(slices.Collect(maps.Keys(presets)), maps.Keys(opts.userPresets))
+	slices.Sort(names)
+	return names
+}
+
+var goImport = regexp.MustCompile(`^\s*(?:[\p{L}\p{N}_.]+\s+)?(?:"([^"]*)"|` + "`([^`]*)`)")
+
+// goImportPath returns the path of a Go import spec, since goimports ignores
+// the package name when sorting.
+func goImportPath(s string) string {
+	m := goImport.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	return m[1] + m[2]
+}
+
+var (
+	pipRequirement    = regexp.MustCompile(`^\s*([A-Za-z0-9][A-Za-z0-9._-]*)`)
+	pipNameSeparators = regexp.MustCompile(`[-_.]+`)
+)
+
+// pipRequirementName returns the normalized distribution name of a pip
+// requirement, without any extras, version specifiers, or environment markers.
+// Lines with pip options (e.g. -r other.txt) are returned as is, which sorts
+// them before any requirements.
+func pipRequirementName(s string) string {
+	m := pipRequirement.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	// https://packaging.python.org/en/latest/specifications/name-normalization/
+	return pipNameSeparators.ReplaceAllString(strings.ToLower(m[1]), "-")
+}
+
+var dotenvAssignment = regexp.MustCompile(`^\s*(?:export\s+)?([^=\s]+)\s*=(.*)`)
+
+// dotenvKey returns the name of the variable that a line of a .env file sets.
+func dotenvKey(s string) string {
+	m := dotenvAssignment.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	return m[1]
+}
+
+// dotenvValue returns the value that a line of a .env file sets, without the
+// quotes around it, if any.
+func dotenvValue(s string) string {
+	m := dotenvAssignment.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	v := strings.TrimSpace(m[2])
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+var (
+	hclBlockHeader = regexp.MustCompile(`^\s*([\w-]+)((?:\s+(?:"[^"]*"|[\w-]+))*)\s*\{`)
+	hclBlockLabel  = regexp.MustCompile(`"([^"]*)"|([\w-]+)`)
+)
+
+// hclBlockKey returns the type and labels of an HCL block, e.g.
+// `resource "aws_instance" "web" {` becomes "resource aws_instance web".
+func hclBlockKey(s string) string {
+	m := hclBlockHeader.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	key := []string{m[1]}
+	for _, l := range hclBlockLabel.FindAllStringSubmatch(m[2], -1) {
+		key = append(key, l[1]+l[2])
+	}
+	return strings.Join(key, " ")
+}
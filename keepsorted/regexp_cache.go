@@ -0,0 +1,73 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+)
+
+// regexps caches the by_regex patterns, which tend to be repeated in many
+// blocks and files, so that each one is only compiled once.
+var regexps = newRegexpCache(256)
+
+// regexpCache is a concurrency-safe cache of compiled regular expressions that
+// evicts the least recently used one once it's full.
+type regexpCache struct {
+	size int
+
+	mu sync.Mutex
+	// The elements are *regexp.Regexp, the most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newRegexpCache(size int) *regexpCache {
+	return &regexpCache{size: size, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// compile is like regexp.Compile, but reuses the result of an earlier call
+// with the same expr if there was one. Errors aren't cached.
+func (c *regexpCache) compile(expr string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[expr]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*regexp.Regexp), nil
+	}
+	c.mu.Unlock()
+
+	// Compile without holding the lock. If another goroutine compiles expr at
+	// the same time, the last one wins, which doesn't matter.
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[expr]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*regexp.Regexp), nil
+	}
+	c.entries[expr] = c.lru.PushFront(re)
+	if c.lru.Len() > c.size {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.entries, last.Value.(*regexp.Regexp).String())
+	}
+	return re, nil
+}
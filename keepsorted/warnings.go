@@ -0,0 +1,85 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keepsorted
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// WarningCode is a stable identifier for a class of warnings about the options
+// of a keep-sorted block. Unlike the message of a warning, codes don't change
+// between releases, so tools can use them to filter or suppress warnings.
+type WarningCode string
+
+const (
+	// UnknownOption means that an option isn't recognized.
+	UnknownOption WarningCode = "UNKNOWN_OPTION"
+	// InvalidValue means that an option has a value that it doesn't accept.
+	InvalidValue WarningCode = "INVALID_VALUE"
+	// ConflictingOptions means that an option may not be used together with
+	// the value of another option.
+	ConflictingOptions WarningCode = "CONFLICTING_OPTIONS"
+	// DuplicateOption means that an option is set more than once, so all but
+	// the last value are ignored.
+	DuplicateOption WarningCode = "DUPLICATE_OPTION"
+)
+
+// Warning is a problem with the options of a keep-sorted block.
+type Warning struct {
+	// What kind of problem this is.
+	Code WarningCode `json:"code"`
+	// The option that the problem is with.
+	Key string `json:"key"`
+	// The 1-based line and column of Key within the file, or 0 if Key isn't
+	// written out, e.g. because it comes from a preset.
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+
+	err error
+}
+
+func (w *Warning) Error() string {
+	return w.err.Error()
+}
+
+func (w *Warning) Unwrap() error {
+	return w.err
+}
+
+func warning(code WarningCode, key, format string, a ...any) *Warning {
+	return &Warning{Code: code, Key: key, err: fmt.Errorf(format, a...)}
+}
+
+// optionFinding returns a finding for warn, which is about the options on
+// lines[start:end+1]. If warn is a *Warning, the finding includes a copy of it
+// that knows where its key is.
+func optionFinding(filename string, lines []string, start, end, offset int, warn error) *Finding {
+	f := finding(filename, start+offset, end+offset, warn.Error())
+	var w *Warning
+	if !errors.As(warn, &w) {
+		return f
+	}
+	pos := *w
+	for i := start; i <= end && i < len(lines); i++ {
+		if col := strings.Index(lines[i], pos.Key+"="); col >= 0 {
+			pos.Line, pos.Column = i+offset, col+1
+			break
+		}
+	}
+	f.Warning = &pos
+	return f
+}
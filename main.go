@@ -16,8 +16,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"runtime/debug"
 	"time"
@@ -73,7 +75,10 @@ func main() {
 	}
 	log.Logger = log.Output(cw)
 	zerolog.SetGlobalLevel(zerolog.Level(int(zerolog.WarnLevel) - *logLevel))
-	if ok, err := cmd.Run(c, flag.Args()); err != nil {
+	// Stop early if we're interrupted, e.g. by an editor that saved again.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if ok, err := cmd.RunContext(ctx, c, flag.Args()); err != nil {
 		log.Fatal().AnErr("error", err).Msg("")
 	} else if !ok {
 		os.Exit(1)
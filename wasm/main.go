@@ -0,0 +1,125 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build js && wasm
+
+// The wasm command makes keep-sorted available to JavaScript, e.g. for web
+// playgrounds and editor extensions that can't run the keep-sorted binary.
+//
+// Build it with:
+//
+//	GOOS=js GOARCH=wasm go build -o keep-sorted.wasm ./wasm
+//
+// and load it with the wasm_exec.js that comes with Go. Once it's running, it
+// defines a global keepSorted object with two functions:
+//
+//	keepSorted.fix(contents, config) => {fixed, alreadyCorrect, warnings}
+//	keepSorted.findings(contents, config) => [finding, ...]
+//
+// config is optional and may have these properties:
+//
+//	id:             the identifier of the directives (default: "keep-sorted")
+//	filename:       the name of the file that contents came from
+//	defaultOptions: the options that every block starts out with, e.g. "case=no"
+//
+// Findings and warnings look like the output of --mode=lint. If the arguments
+// are invalid, both functions return an Error instead.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"syscall/js"
+
+	"github.com/google/keep-sorted/keepsorted"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	log.Logger = log.Output(io.Discard)
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	js.Global().Set("keepSorted", map[string]any{
+		"fix": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return call(args, func(fixer *keepsorted.Fixer, filename, contents string) any {
+				fixed, alreadyCorrect, warnings := fixer.Fix(filename, contents, nil)
+				if warnings == nil {
+					warnings = []*keepsorted.Finding{}
+				}
+				return map[string]any{
+					"fixed":          fixed,
+					"alreadyCorrect": alreadyCorrect,
+					"warnings":       toJS(warnings),
+				}
+			})
+		}),
+		"findings": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return call(args, func(fixer *keepsorted.Fixer, filename, contents string) any {
+				findings := fixer.Findings(filename, contents, nil)
+				if findings == nil {
+					findings = []*keepsorted.Finding{}
+				}
+				return toJS(findings)
+			})
+		}),
+	})
+	// Keep the functions above alive.
+	select {}
+}
+
+// call parses the arguments of a function on the keepSorted object and passes
+// them to fn.
+func call(args []js.Value, fn func(fixer *keepsorted.Fixer, filename, contents string) any) any {
+	if len(args) < 1 || args[0].Type() != js.TypeString {
+		return jsError(fmt.Errorf("contents must be a string"))
+	}
+	id := "keep-sorted"
+	var filename string
+	opts := keepsorted.DefaultBlockOptions()
+	if len(args) > 1 && args[1].Type() == js.TypeObject {
+		config := args[1]
+		if v := config.Get("id"); v.Type() == js.TypeString {
+			id = v.String()
+		}
+		if v := config.Get("filename"); v.Type() == js.TypeString {
+			filename = v.String()
+		}
+		if v := config.Get("defaultOptions"); v.Type() == js.TypeString {
+			var err error
+			if opts, err = keepsorted.ParseBlockOptions(v.String()); err != nil {
+				return jsError(fmt.Errorf("invalid defaultOptions: %w", err))
+			}
+		}
+	}
+	return fn(keepsorted.New(id, opts), filename, args[0].String())
+}
+
+// toJS converts v to a JavaScript value in the same way as it'd be converted
+// to JSON.
+func toJS(v any) any {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return jsError(err)
+	}
+	return js.Global().Get("JSON").Call("parse", string(b))
+}
+
+// jsError converts err to a JavaScript Error. Panicking in a function that's
+// called from JavaScript would stop the whole program, so errors are returned
+// instead of thrown.
+func jsError(err error) js.Value {
+	return js.Global().Get("Error").New(err.Error())
+}